@@ -0,0 +1,349 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The formats of the access log.
+const (
+	logJSON     = "json"
+	logLogfmt   = "logfmt"
+	logCombined = "combined" // the Apache combined log format
+	logNone     = "none"     // disables the access log of a route
+)
+
+// The outputs of the access log other than a file.
+const (
+	logStdout = "stdout"
+	logStderr = "stderr"
+)
+
+// The routes of the server, which configure their access logs.
+const (
+	routeShort   = "s"
+	routeX       = "x"
+	routeMetrics = "metrics"
+)
+
+// accessLogConfig configures the access log. The format applies to the
+// routes without their own format in routes.
+type accessLogConfig struct {
+	Format     string            `yaml:"format"`
+	Output     string            `yaml:"output"`      // stdout, stderr or a file
+	MaxSize    int64             `yaml:"max_size"`    // in megabytes, a file is not rotated if zero
+	MaxBackups int               `yaml:"max_backups"` // the rotated files that are kept
+	Routes     map[string]string `yaml:"routes"`      // the format of each route
+}
+
+func (c *accessLogConfig) validate() error {
+	formats := []string{c.Format}
+	for r, f := range c.Routes {
+		switch r {
+		case routeShort, routeX, routeMetrics:
+		default:
+			return fmt.Errorf("unknown access log route: %s", r)
+		}
+		formats = append(formats, f)
+	}
+	for _, f := range formats {
+		switch f {
+		case "", logJSON, logLogfmt, logCombined, logNone:
+		default:
+			return fmt.Errorf("unsupported access log format: %s", f)
+		}
+	}
+	if c.MaxSize < 0 || c.MaxBackups < 0 {
+		return errors.New("access log max_size and max_backups must not be negative")
+	}
+	return nil
+}
+
+// format returns the format of the access log of a route.
+func (c *accessLogConfig) format(route string) string {
+	if f, ok := c.Routes[route]; ok && f != "" {
+		return f
+	}
+	if c.Format == "" {
+		return logLogfmt
+	}
+	return c.Format
+}
+
+// accessEntry is an entry of the access log.
+type accessEntry struct {
+	Time     time.Time `json:"time"`
+	Route    string    `json:"route"`
+	IP       string    `json:"ip"`
+	Method   string    `json:"method"`
+	Host     string    `json:"host"`
+	Path     string    `json:"path"`
+	Proto    string    `json:"proto"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"duration_ms"`
+	Referer  string    `json:"referer"`
+	UA       string    `json:"ua"`
+	Alias    string    `json:"alias"`  // the resolved alias of a short link
+	Target   string    `json:"target"` // where the visitor is sent
+}
+
+// accessLog writes an entry for each request of the routes that have an
+// access log. The query of a request is not logged since it may contain
+// the API token.
+type accessLog struct {
+	conf accessLogConfig
+
+	mu sync.Mutex // serializes the entries
+	w  io.Writer
+	c  io.Closer // nil if the output is not a file
+}
+
+func newAccessLog(c accessLogConfig) (*accessLog, error) {
+	a := &accessLog{conf: c}
+	switch c.Output {
+	case "", logStdout:
+		a.w = os.Stdout
+	case logStderr:
+		a.w = os.Stderr
+	default:
+		f, err := openRotatingFile(c.Output, c.MaxSize<<20, c.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		a.w, a.c = f, f
+	}
+	return a, nil
+}
+
+// handler logs the requests of next under the given route, unless its
+// access log is disabled.
+func (a *accessLog) handler(route string, next http.Handler) http.Handler {
+	format := a.conf.format(route)
+	if format == logNone {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		r, rt := withRoute(r)
+		defer func() {
+			a.write(format, &accessEntry{
+				Time:     start.UTC(),
+				Route:    route,
+				IP:       accessIP(readIP(r)),
+				Method:   r.Method,
+				Host:     r.Host,
+				Path:     r.URL.Path,
+				Proto:    r.Proto,
+				Status:   sw.code(),
+				Bytes:    sw.bytes,
+				Duration: float64(time.Since(start).Microseconds()) / 1000,
+				Referer:  r.Referer(),
+				UA:       r.UserAgent(),
+				Alias:    rt.alias,
+				Target:   rt.target,
+			})
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+func (a *accessLog) write(format string, e *accessEntry) {
+	b := formatEntry(format, e)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err := a.w.Write(b)
+	if err != nil {
+		log.Printf("cannot write access log: %v\n", err)
+	}
+}
+
+// close closes the file of the access log, if any.
+func (a *accessLog) close() error {
+	if a.c == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.c.Close()
+}
+
+// accessIP returns the IP of an access log entry, which is truncated
+// unless the privacy policy keeps the visitor IPs.
+func accessIP(ip string) string {
+	switch conf.Privacy.IP {
+	case "", ipKeep:
+		return ip
+	}
+	return truncateIP(ip)
+}
+
+// formatEntry formats an entry as a line of the given format.
+func formatEntry(format string, e *accessEntry) []byte {
+	b := bytes.Buffer{}
+	switch format {
+	case logJSON:
+		// an entry only has strings and numbers, which always encode.
+		d, _ := json.Marshal(e)
+		b.Write(d)
+	case logCombined:
+		size := "-"
+		if e.Bytes > 0 {
+			size = strconv.FormatInt(e.Bytes, 10)
+		}
+		fmt.Fprintf(&b, "%s - - [%s] %s %d %s %s %s",
+			orDash(e.IP), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(e.Method+" "+e.Path+" "+e.Proto), e.Status, size,
+			strconv.Quote(orDash(e.Referer)), strconv.Quote(orDash(e.UA)))
+	default:
+		pairs := []struct{ k, v string }{
+			{"time", e.Time.Format(time.RFC3339Nano)},
+			{"route", e.Route},
+			{"ip", e.IP},
+			{"method", e.Method},
+			{"host", e.Host},
+			{"path", e.Path},
+			{"proto", e.Proto},
+			{"status", strconv.Itoa(e.Status)},
+			{"bytes", strconv.FormatInt(e.Bytes, 10)},
+			{"duration_ms", strconv.FormatFloat(e.Duration, 'f', 3, 64)},
+			{"referer", e.Referer},
+			{"ua", e.UA},
+			{"alias", e.Alias},
+			{"target", e.Target},
+		}
+		for i, p := range pairs {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(p.k + "=" + logfmtValue(p.v))
+		}
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// logfmtValue quotes a logfmt value if it is empty or contains a space,
+// a quote, an equals sign or a control character.
+func logfmtValue(v string) string {
+	if v == "" || strings.IndexFunc(v, func(r rune) bool {
+		return r <= ' ' || r == '"' || r == '=' || r == 0x7f
+	}) >= 0 {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// rotatingFile is a log file that is rotated once it would exceed its
+// maximum size. The rotated files are named by appending .1, .2, ... to
+// the name, .1 being the newest.
+type rotatingFile struct {
+	name    string
+	maxSize int64 // in bytes, the file is not rotated if zero
+	backups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(name string, maxSize int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{name: name, maxSize: maxSize, backups: backups}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the rotated files, dropping the oldest one, and starts a
+// new file. The file is reopened even if the rotation fails, so that the
+// log goes on.
+func (f *rotatingFile) rotate() error {
+	err := f.f.Close()
+	f.f = nil
+	if err == nil {
+		err = f.shift()
+	}
+	if oerr := f.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+func (f *rotatingFile) shift() error {
+	for i := f.backups; i > 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.name, i-1), fmt.Sprintf("%s.%d", f.name, i))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if f.backups > 0 {
+		return os.Rename(f.name, f.name+".1")
+	}
+	return os.Remove(f.name)
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+func TestFormatEntry(t *testing.T) {
+	e := &accessEntry{
+		Time:     time.Date(2021, 12, 1, 8, 30, 0, 0, time.UTC),
+		Route:    routeShort,
+		IP:       "1.2.3.4",
+		Method:   http.MethodGet,
+		Host:     "golang.design",
+		Path:     "/s/a",
+		Proto:    "HTTP/1.1",
+		Status:   http.StatusTemporaryRedirect,
+		Bytes:    42,
+		Duration: 1.5,
+		UA:       `Mozilla/5.0 "x"`,
+		Alias:    "a",
+		Target:   "https://example.com/?q=1",
+	}
+
+	got := string(formatEntry(logLogfmt, e))
+	want := `time=2021-12-01T08:30:00Z route=s ip=1.2.3.4 method=GET host=golang.design path=/s/a proto=HTTP/1.1 status=307 bytes=42 duration_ms=1.500 referer="" ua="Mozilla/5.0 \"x\"" alias=a target="https://example.com/?q=1"` + "\n"
+	if got != want {
+		t.Fatalf("logfmt entry want\n%s got\n%s", want, got)
+	}
+
+	got = string(formatEntry(logCombined, e))
+	want = `1.2.3.4 - - [01/Dec/2021:08:30:00 +0000] "GET /s/a HTTP/1.1" 307 42 "-" "Mozilla/5.0 \"x\""` + "\n"
+	if got != want {
+		t.Fatalf("combined entry want\n%s got\n%s", want, got)
+	}
+
+	d := accessEntry{}
+	if err := json.Unmarshal(formatEntry(logJSON, e), &d); err != nil || d != *e {
+		t.Fatalf("json entry want %+v, got %+v, %v", *e, d, err)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	b := &bytes.Buffer{}
+	a := &accessLog{
+		conf: accessLogConfig{Format: logJSON, Routes: map[string]string{routeMetrics: logNone}},
+		w:    b,
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resolved(r.Context(), &model.Redirect{Alias: "a"})
+		resolvedTarget(r.Context(), "https://example.com")
+		http.Redirect(w, r, "https://example.com", http.StatusTemporaryRedirect)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/s/a?token=secret", nil)
+	r.Header.Set("User-Agent", "test")
+	w := httptest.NewRecorder()
+	a.handler(routeShort, next).ServeHTTP(w, r)
+
+	e := accessEntry{}
+	if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+		t.Fatalf("access log writes invalid json %q: %v", b.String(), err)
+	}
+	if e.Route != routeShort || e.Status != http.StatusTemporaryRedirect || e.Bytes != int64(w.Body.Len()) ||
+		e.Path != "/s/a" || e.UA != "test" || e.Alias != "a" || e.Target != "https://example.com" {
+		t.Fatalf("access log writes a wrong entry: %+v", e)
+	}
+	if strings.Contains(b.String(), "secret") {
+		t.Fatalf("access log writes the query: %s", b.String())
+	}
+
+	// a disabled route is not logged.
+	b.Reset()
+	a.handler(routeMetrics, next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if b.Len() != 0 {
+		t.Fatalf("access log writes a disabled route: %s", b.String())
+	}
+}
+
+func TestAccessLogConfig(t *testing.T) {
+	for _, c := range []accessLogConfig{
+		{Format: "xml"},
+		{Routes: map[string]string{"y": logJSON}},
+		{Routes: map[string]string{routeX: "off"}},
+		{MaxSize: -1},
+	} {
+		if err := c.validate(); err == nil {
+			t.Fatalf("invalid access log config %+v is accepted", c)
+		}
+	}
+	c := accessLogConfig{Routes: map[string]string{routeX: logCombined}}
+	if err := c.validate(); err != nil {
+		t.Fatalf("valid access log config with err: %v", err)
+	}
+	if c.format(routeShort) != logLogfmt || c.format(routeX) != logCombined {
+		t.Fatalf("access log config has wrong formats: %s, %s", c.format(routeShort), c.format(routeX))
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(name, 10, 2)
+	if err != nil {
+		t.Fatalf("openRotatingFile with err: %v", err)
+	}
+	for _, line := range []string{"1111\n", "2222\n", "3333\n", "4444\n", "5555\n", "6666\n", "7777\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write with err: %v", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close with err: %v", err)
+	}
+
+	// each file holds two lines, and only two rotated files are kept.
+	for file, want := range map[string]string{
+		name:        "7777\n",
+		name + ".1": "5555\n6666\n",
+		name + ".2": "3333\n4444\n",
+	} {
+		got, err := os.ReadFile(file)
+		if err != nil || string(got) != want {
+			t.Fatalf("%s want %q, got %q, %v", file, want, got, err)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("rotating file keeps too many files: %v", err)
+	}
+}
+
+func TestAccessLogTarget(t *testing.T) {
+	passwordTmpl = template.Must(template.ParseFiles("public/password.html"))
+	noticeTmpl = template.Must(template.ParseFiles("public/notice.html"))
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatalf("hashPassword with err: %v", err)
+	}
+	s := &server{cache: newLRU(false), metrics: newMetrics()}
+	s.cache.Put("locked", &model.Redirect{Alias: "locked", URL: "https://example.com/destination", Password: hash})
+	s.cache.Put("denied", &model.Redirect{Alias: "denied", URL: "https://denied.example.com/destination"})
+	deny := conf.Policy.Deny
+	conf.Policy.Deny = []string{"denied.example.com"}
+	defer func() { conf.Policy.Deny = deny }()
+
+	// the target is not logged unless the visitor is sent there.
+	for _, alias := range []string{"locked", "denied"} {
+		b := &bytes.Buffer{}
+		a := &accessLog{conf: accessLogConfig{Format: logJSON}, w: b}
+		a.handler(routeShort, s.shortHandler()).ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodGet, conf.S.Prefix+alias, nil))
+
+		e := accessEntry{}
+		if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+			t.Fatalf("access log writes invalid json %q: %v", b.String(), err)
+		}
+		if e.Alias != alias || e.Target != "" {
+			t.Fatalf("access log writes a target the visitor is not sent to: %+v", e)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// authorized reports whether the request carries the configured API
+// token, either as a bearer token of the Authorization header or as the
+// token query parameter. No request is authorized if the API token is
+// not configured.
+func authorized(r *http.Request) bool {
+	if conf.APIToken == "" {
+		return false
+	}
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(conf.APIToken)) == 1
+}
@@ -14,7 +14,8 @@ import (
 )
 
 type item struct {
-	k, v string
+	k string
+	v interface{}
 }
 
 // lru is a naive thread-safe lru cache
@@ -65,7 +66,7 @@ func (l *lru) Len() uint {
 	return l.size
 }
 
-func (l *lru) Get(k string) (string, bool) {
+func (l *lru) Get(k string) (interface{}, bool) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
@@ -75,10 +76,10 @@ func (l *lru) Get(k string) (string, bool) {
 			return e.Value.(*item).v, true
 		}
 	}
-	return "", false
+	return nil, false
 }
 
-func (l *lru) Put(k, v string) {
+func (l *lru) Put(k string, v interface{}) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
@@ -11,16 +11,20 @@ import (
 	_ "embed"
 	"log"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type config struct {
-	Title string `yaml:"title"`
-	Host  string `yaml:"host"`
-	Addr  string `yaml:"addr"`
-	Store string `yaml:"store"`
-	S     struct {
+	Title    string `yaml:"title"`
+	Host     string `yaml:"host"`
+	Addr     string `yaml:"addr"`
+	Store    string `yaml:"store"`
+	Secret   string `yaml:"secret"`
+	APIToken string `yaml:"api_token"`
+	GeoIP    string `yaml:"geoip"`
+	S        struct {
 		Prefix string `yaml:"prefix"`
 	} `yaml:"s"`
 	X struct {
@@ -30,7 +34,28 @@ type config struct {
 		RepoPath   string `yaml:"repo_path"`
 		GoDocHost  string `yaml:"godoc_host"`
 	} `yaml:"x"`
-	GoogleAnalytics string `yaml:"google_analytics"`
+	GoogleAnalytics string         `yaml:"google_analytics"`
+	Policy          domainPolicy   `yaml:"policy"`
+	TrustedProxies  trustedProxies `yaml:"trusted_proxies"`
+	Privacy         privacyPolicy  `yaml:"privacy"`
+	Visits          recorderConfig `yaml:"visits"`
+	Bots            struct {
+		Patterns []string `yaml:"patterns"`
+		Head     bool     `yaml:"head"`
+	} `yaml:"bots"`
+	Health struct {
+		Interval     time.Duration `yaml:"interval"`
+		Timeout      time.Duration `yaml:"timeout"`
+		Concurrency  int           `yaml:"concurrency"`
+		HostInterval time.Duration `yaml:"host_interval"`
+	} `yaml:"health"`
+	Rollup struct {
+		Interval  time.Duration `yaml:"interval"`
+		Retention time.Duration `yaml:"retention"`
+		Top       int           `yaml:"top"`
+	} `yaml:"rollup"`
+	AccessLog accessLogConfig `yaml:"access_log"`
+	Webhooks  webhookConfig   `yaml:"webhooks"`
 }
 
 //go:embed config.yml
@@ -51,6 +76,23 @@ func (c *config) parse() {
 	if err != nil {
 		log.Fatalf("cannot parse configuration: %v\n", err)
 	}
+	c.Policy.load()
+	err = c.Privacy.validate()
+	if err != nil {
+		log.Fatalf("cannot parse configuration: %v\n", err)
+	}
+	err = c.Visits.validate()
+	if err != nil {
+		log.Fatalf("cannot parse configuration: %v\n", err)
+	}
+	err = c.AccessLog.validate()
+	if err != nil {
+		log.Fatalf("cannot parse configuration: %v\n", err)
+	}
+	err = c.Webhooks.validate()
+	if err != nil {
+		log.Fatalf("cannot parse configuration: %v\n", err)
+	}
 }
 
 var conf config
@@ -0,0 +1,256 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+// The kinds of exports.
+const (
+	exportVisits = "visits" // the raw visits
+	exportDaily  = "daily"  // the PV and UV of each alias on each day
+)
+
+// The formats of exports.
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson" // a JSON object per line
+)
+
+// exportFlush is the number of rows after which an export is flushed to
+// the client, so that a large export is streamed rather than buffered.
+const exportFlush = 1000
+
+var (
+	visitHeader = []string{
+		"time", "alias", "ip", "ua", "referer", "referer_host", "referer_path",
+		"channel", "variant", "country", "bot", "browser", "browser_version",
+		"os", "device",
+	}
+	dailyHeader = []string{"alias", "day", "pv", "uv"}
+)
+
+func validExport(kind, format string) error {
+	switch kind {
+	case exportVisits, exportDaily:
+	default:
+		return fmt.Errorf("unsupported export: %s", kind)
+	}
+	switch format {
+	case formatCSV, formatNDJSON:
+	default:
+		return fmt.Errorf("unsupported format: %s", format)
+	}
+	return nil
+}
+
+// exportWriter writes the rows of an export as CSV with a header, or as
+// newline delimited JSON.
+type exportWriter struct {
+	w    io.Writer
+	csv  *csv.Writer
+	json *json.Encoder
+	rows int
+}
+
+func newExportWriter(w io.Writer, format string, header []string) (*exportWriter, error) {
+	e := &exportWriter{w: w}
+	if format == formatNDJSON {
+		e.json = json.NewEncoder(w)
+		return e, nil
+	}
+	e.csv = csv.NewWriter(w)
+	return e, e.csv.Write(header)
+}
+
+// write writes a row, which is the record in CSV or v in JSON.
+func (e *exportWriter) write(record []string, v interface{}) error {
+	var err error
+	if e.json != nil {
+		err = e.json.Encode(v)
+	} else {
+		err = e.csv.Write(record)
+	}
+	if err != nil {
+		return err
+	}
+	e.rows++
+	if e.rows%exportFlush == 0 {
+		return e.flush()
+	}
+	return nil
+}
+
+// flush sends the written rows to the underlying writer, and to the
+// client if the writer is an http.ResponseWriter.
+func (e *exportWriter) flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func visitRecord(v *model.Visit) []string {
+	return []string{
+		v.Time.UTC().Format(time.RFC3339), v.Alias, v.IP, v.UA, v.Referer,
+		v.RefererHost, v.RefererPath, v.Channel, v.Variant, v.Country,
+		strconv.FormatBool(v.Bot), v.Browser, v.BrowserVersion, v.OS, v.Device,
+	}
+}
+
+func dailyRecord(d *model.Daystat) []string {
+	return []string{
+		d.Alias, d.Day, strconv.FormatInt(d.PV, 10), strconv.FormatInt(d.UV, 10),
+	}
+}
+
+// writeExport writes the visits or the daily stats of the given alias, or
+// of all aliases if alias is empty, from start to end to w.
+func writeExport(ctx context.Context, db model.RedirStatModel, w io.Writer, kind, format, alias string, start, end time.Time, f model.Filter) error {
+	header := visitHeader
+	if kind == exportDaily {
+		header = dailyHeader
+	}
+	e, err := newExportWriter(w, format, header)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case exportDaily:
+		err = db.StreamDaily(ctx, alias, start, end, f, func(d *model.Daystat) error {
+			return e.write(dailyRecord(d), d)
+		})
+	default:
+		err = db.StreamVisits(ctx, alias, start, end, f, func(v *model.Visit) error {
+			v.Time = v.Time.UTC()
+			return e.write(visitRecord(v), v)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return e.flush()
+}
+
+// export serves the export of the stat data. The daily stats are public
+// like the stats page, whereas the raw visits, which contain the IP and
+// the user agent of the visitors, require the API token.
+func (s *server) export(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+	kind, format := params.Get("export"), params.Get("format")
+	if format == "" {
+		format = formatCSV
+	}
+	err := validExport(kind, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if kind == exportVisits && !authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "a valid API token is required", http.StatusUnauthorized)
+		return nil
+	}
+
+	loc, err := parseLocation(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	start, end, err := parseDuration(params, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	f := model.Filter{Variant: params.Get("variant")}
+	if v := params.Get("bots"); v != "" {
+		f.Bots, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid bots parameter: %v", err), http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	a := params.Get("a")
+	name := "redir"
+	if a != "" {
+		name = a
+	}
+	name = fmt.Sprintf("%s-%s-%s.%s", name, kind, start.Format("20060102"), format)
+	if format == formatNDJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+
+	// the response is already sent in part if the export fails, thus
+	// the error can only be logged.
+	err = writeExport(ctx, s.db, w, kind, format, a, start, end, f)
+	if err != nil {
+		log.Printf("cannot export %s of alias %q: %v\n", kind, a, err)
+	}
+	return nil
+}
+
+// statsCmd exports the visits or the daily stats of the given alias, or of
+// all aliases if alias is empty, to the given file or to stdout.
+func statsCmd(ctx context.Context, alias, kind, format, t0, t1, out string, bots bool) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("cannot export stats: %w", err)
+		}
+	}()
+
+	err = validExport(kind, format)
+	if err != nil {
+		return
+	}
+	start, end, err := parseDuration(url.Values{"t0": {t0}, "t1": {t1}}, time.UTC)
+	if err != nil {
+		return
+	}
+
+	s, err := model.NewDB(conf.Store)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		var f *os.File
+		f, err = os.Create(out)
+		if err != nil {
+			return
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		w = f
+	}
+	return writeExport(ctx, s, w, kind, format, alias, start, end, model.Filter{Bots: bots})
+}
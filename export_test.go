@@ -0,0 +1,140 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+func TestExportWriter(t *testing.T) {
+	d := &model.Daystat{Alias: "a", Day: "2021-12-01", PV: 3, UV: 2}
+
+	w := httptest.NewRecorder()
+	e, err := newExportWriter(w, formatCSV, dailyHeader)
+	if err != nil {
+		t.Fatalf("newExportWriter with err: %v", err)
+	}
+	for i := 0; i < exportFlush; i++ {
+		err = e.write(dailyRecord(d), d)
+		if err != nil {
+			t.Fatalf("write with err: %v", err)
+		}
+	}
+	if !w.Flushed {
+		t.Fatalf("export writer does not flush the response")
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("export writer writes invalid csv: %v", err)
+	}
+	if len(records) != exportFlush+1 || strings.Join(records[0], ",") != "alias,day,pv,uv" || strings.Join(records[1], ",") != "a,2021-12-01,3,2" {
+		t.Fatalf("export writer writes wrong csv: %v", records[:2])
+	}
+
+	w = httptest.NewRecorder()
+	e, err = newExportWriter(w, formatNDJSON, dailyHeader)
+	if err != nil {
+		t.Fatalf("newExportWriter with err: %v", err)
+	}
+	e.write(dailyRecord(d), d)
+	e.write(dailyRecord(d), d)
+	e.flush()
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("export writer want 2 json lines, got %q", w.Body.String())
+	}
+	got := model.Daystat{}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil || got != *d {
+		t.Fatalf("export writer want %+v, got %+v, %v", *d, got, err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	conf.parse()
+	conf.APIToken = "token"
+	defer func() { conf.APIToken = "" }()
+
+	db, err := model.NewDB(conf.Store)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	err = db.RecordVisits(ctx, []*model.Visit{
+		{Alias: "export", IP: "1.1.1.1", Referer: "https://t.co/x", Time: now},
+		{Alias: "export", IP: "1.1.1.2", Time: now},
+	})
+	if err != nil {
+		t.Fatalf("RecordVisits with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "export")
+
+	s := &server{db: db}
+	get := func(query, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/s/?"+query, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		if err := s.stats(ctx, w, r); err != nil {
+			t.Fatalf("stats with err: %v", err)
+		}
+		return w
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if w := get("export=visits&a=export", token); w.Code != http.StatusUnauthorized {
+			t.Fatalf("export of visits with token %q want status %d, got %d", token, http.StatusUnauthorized, w.Code)
+		}
+	}
+	if w := get("export=visits&format=xml", "token"); w.Code != http.StatusBadRequest {
+		t.Fatalf("export with an invalid format want status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w := get("export=visits&a=export&format=ndjson", "token")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("export of visits want ndjson, got %d %v", w.Code, w.Header())
+	}
+	n := 0
+	for sc := bufio.NewScanner(w.Body); sc.Scan(); n++ {
+		v := model.Visit{}
+		if err := json.Unmarshal(sc.Bytes(), &v); err != nil || v.Alias != "export" {
+			t.Fatalf("export of visits gives a wrong visit: %s, %v", sc.Text(), err)
+		}
+		if v.IP == "1.1.1.1" && (v.RefererHost != "t.co" || v.Channel != "social") {
+			t.Fatalf("export of visits loses the parsed referer: %+v", v)
+		}
+	}
+	if n != 2 {
+		t.Fatalf("export of visits want 2 visits, got %d", n)
+	}
+
+	// the daily stats do not require the token.
+	w = get("export=daily&a=export", "")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") ||
+		!strings.Contains(w.Header().Get("Content-Disposition"), "attachment") {
+		t.Fatalf("export of daily stats want csv attachment, got %d %v", w.Code, w.Header())
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("export of daily stats gives invalid csv: %v", err)
+	}
+	want := []string{"export", now.Format("2006-01-02"), "2", "2"}
+	if len(records) != 2 || strings.Join(records[1], ",") != strings.Join(want, ",") {
+		t.Fatalf("export of daily stats want %v, got %v", want, records)
+	}
+}
@@ -16,80 +16,147 @@ import (
 	"net/http"
 	"strings"
 
+	"golang.design/x/redir/internal/geoip"
 	"golang.design/x/redir/internal/model"
+	"golang.design/x/redir/internal/ua"
 )
 
 type server struct {
-	db    *model.Store
-	cache *lru
+	db       *model.Store
+	cache    *lru
+	attempts *attempts
+	geo      *geoip.Reader
+	hasher   *ipHasher
+	visits   *recorder
+	live     *broker
+	bots     *ua.Bots
+	metrics  *metrics
+	access   *accessLog
+	hooks    *webhooks
 }
 
 var (
-	xTmpl     *template.Template
-	statsTmpl *template.Template
+	xTmpl        *template.Template
+	statsTmpl    *template.Template
+	noticeTmpl   *template.Template
+	previewTmpl  *template.Template
+	passwordTmpl *template.Template
 )
 
 func newServer(ctx context.Context) *server {
 	xTmpl = template.Must(template.ParseFiles("public/x.html"))
 	statsTmpl = template.Must(template.ParseFiles("public/stats.html"))
+	noticeTmpl = template.Must(template.ParseFiles("public/notice.html"))
+	previewTmpl = template.Must(template.ParseFiles("public/preview.html"))
+	passwordTmpl = template.Must(template.ParseFiles("public/password.html"))
 
 	db, err := model.NewDB(conf.Store)
 	if err != nil {
 		log.Fatalf("cannot establish connection to database: %v", err)
 	}
-	return &server{
-		db:    db,
-		cache: newLRU(true),
+	if conf.Health.Interval > 0 {
+		go newChecker(db).run(ctx, conf.Health.Interval)
 	}
+	if conf.Rollup.Interval > 0 {
+		go runRollup(ctx, db, conf.Rollup.Interval, conf.Rollup.Retention, conf.Rollup.Top)
+	}
+	if conf.Privacy.Retention > 0 {
+		go runRetention(ctx, db, conf.Privacy)
+	}
+	access, err := newAccessLog(conf.AccessLog)
+	if err != nil {
+		log.Fatalf("cannot open access log: %v", err)
+	}
+	var geo *geoip.Reader
+	if conf.GeoIP != "" {
+		geo, err = geoip.Open(conf.GeoIP)
+		if err != nil {
+			log.Fatalf("cannot open geoip database: %v", err)
+		}
+	}
+	s := &server{
+		db:       db,
+		cache:    newLRU(true),
+		attempts: newAttempts(maxPasswordAttempts, attemptWindow),
+		geo:      geo,
+		hasher:   &ipHasher{db: db},
+		live:     newBroker(),
+		bots:     ua.NewBots(conf.Bots.Patterns...),
+		metrics:  newMetrics(),
+		access:   access,
+		hooks:    newWebhooks(db, conf.Webhooks),
+	}
+	if len(conf.Webhooks.Endpoints) > 0 {
+		s.hooks.start(ctx)
+	}
+	s.visits = newRecorder(&liveWriter{&webhookWriter{&metricsWriter{db, s.metrics}, s.hooks}, s.live}, func(ctx context.Context, v *model.Visit) {
+		v.IP = s.visitorIP(ctx, v.IP, v.Time)
+	}, conf.Visits)
+	s.registerMetrics()
+	return s
 }
 
 func (s *server) close() {
+	s.live.close()
+	// flush the queued visits before closing the database.
+	s.visits.close()
+	c := s.visits.counters()
+	log.Printf("visits: %d queued, %d recorded, %d dropped, %d sampled out, %d failed\n",
+		c.Queued, c.Recorded, c.Dropped, c.Sampled, c.Failed)
+	// the webhooks of the flushed visits are delivered after a restart.
+	s.hooks.wait()
 	log.Println(s.db.Close())
+	if err := s.access.close(); err != nil {
+		log.Printf("cannot close access log: %v\n", err)
+	}
 }
 
 func (s *server) registerHandler() {
-	l := logging()
+	l := s.access.handler
 
 	// short redirector
-	http.Handle(conf.S.Prefix, l(s.shortHandler()))
+	http.Handle(conf.S.Prefix, l(routeShort, s.metrics.instrument(s.shortHandler())))
 	// repo redirector
-	http.Handle(conf.X.Prefix, l(s.xHandler()))
+	http.Handle(conf.X.Prefix, l(routeX, s.xHandler()))
+	// metrics in the Prometheus text format
+	http.Handle("/metrics", l(routeMetrics, s.metrics.handler()))
 }
 
-func logging() func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer func() {
-				log.Println(readIP(r), r.Method, r.URL.Path)
-			}()
-			next.ServeHTTP(w, r)
-		})
-	}
+// readIP returns the real client IP. The Forwarded, X-Forwarded-For,
+// X-Real-Ip and X-Appengine-Remote-Addr headers are only honored if the
+// request comes from one of the configured trusted proxies, such as
+// nginx, haproxy or traefik, so that clients cannot spoof their IP.
+func readIP(r *http.Request) string {
+	return conf.TrustedProxies.clientIP(r)
 }
 
-// readIP implements a best effort approach to return the real client IP,
-// it parses X-Real-IP and X-Forwarded-For in order to work properly with
-// reverse-proxies such us: nginx or haproxy. Use X-Forwarded-For before
-// X-Real-Ip as nginx uses X-Real-Ip with the proxy's IP.
-//
-// This implementation is derived from gin-gonic/gin.
-func readIP(r *http.Request) string {
-	clientIP := r.Header.Get("X-Forwarded-For")
-	clientIP = strings.TrimSpace(strings.Split(clientIP, ",")[0])
-	if clientIP == "" {
-		clientIP = strings.TrimSpace(r.Header.Get("X-Real-Ip"))
+// country returns the country code of the client IP of the request, or
+// an empty string if the country is unknown or no geoip database is
+// configured.
+func (s *server) country(r *http.Request) string {
+	if s.geo == nil {
+		return ""
 	}
-	if clientIP != "" {
-		return clientIP
+	ip := net.ParseIP(readIP(r))
+	if ip == nil {
+		return ""
 	}
-	if addr := r.Header.Get("X-Appengine-Remote-Addr"); addr != "" {
-		return addr
-	}
-	ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	c, err := s.geo.Country(ip)
 	if err != nil {
-		return "unknown" // use unknown to guarantee non empty string
+		log.Printf("cannot look up country of %v: %v\n", ip, err)
+		return ""
+	}
+	return c
+}
+
+// isBot reports whether the request is from a bot, crawler or link
+// unfurler, either by its user agent or, if configured, because it is a
+// HEAD request that only checks the link.
+func (s *server) isBot(r *http.Request) bool {
+	if conf.Bots.Head && r.Method == http.MethodHead {
+		return true
 	}
-	return ip
+	return s.bots.Match(r.UserAgent())
 }
 
 // xHandler redirect returns an HTTP handler that redirects requests for
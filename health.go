@@ -0,0 +1,240 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+// checker periodically checks whether the links of all aliases are
+// still reachable and records the results in the data store.
+type checker struct {
+	db          *model.Store
+	client      *http.Client
+	concurrency int
+	limiter     *hostLimiter
+}
+
+func newChecker(db *model.Store) *checker {
+	c := &checker{
+		db:          db,
+		client:      &http.Client{Timeout: conf.Health.Timeout},
+		concurrency: conf.Health.Concurrency,
+		limiter:     newHostLimiter(conf.Health.HostInterval),
+	}
+	if c.concurrency <= 0 {
+		c.concurrency = 1
+	}
+	return c
+}
+
+// run checks all links every interval until the context is canceled.
+func (c *checker) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		_, err := c.checkAll(ctx)
+		if err != nil {
+			log.Printf("cannot check links: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// checkAll checks the links of all aliases with bounded concurrency and
+// returns the check results.
+func (c *checker) checkAll(ctx context.Context) ([]model.Health, error) {
+	rs, err := c.db.FetchAliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkRedirects(ctx, rs), nil
+}
+
+// checkRedirects checks the given redirects with bounded concurrency, and
+// returns the results of the redirects that have links to check.
+func (c *checker) checkRedirects(ctx context.Context, rs []*model.Redirect) []model.Health {
+	var (
+		hs      = make([]model.Health, len(rs))
+		checked = make([]bool, len(rs))
+		wg      sync.WaitGroup
+		sema    = make(chan struct{}, c.concurrency)
+	)
+	for i := range rs {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return checkedHealth(hs[:i], checked)
+		case sema <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sema; wg.Done() }()
+
+			hs[i], checked[i] = c.check(ctx, rs[i])
+			if !checked[i] {
+				return
+			}
+			err := c.db.RecordHealth(ctx, &hs[i])
+			if err != nil {
+				log.Printf("cannot record health of %s: %v\n", rs[i].Alias, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return checkedHealth(hs, checked)
+}
+
+// checkedHealth returns the results that are checked.
+func checkedHealth(hs []model.Health, checked []bool) []model.Health {
+	res := hs[:0]
+	for i := range hs {
+		if checked[i] {
+			res = append(res, hs[i])
+		}
+	}
+	return res
+}
+
+// placeholder matches a {name} placeholder of a link, which is only
+// filled by the parameters of a signed short link.
+var placeholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// targets returns the links that the visitors of the given alias can be
+// sent to: its link, and the links of its variants and rules. The links
+// with placeholders are left out since they are incomplete.
+func targets(r *model.Redirect) []string {
+	links := []string{r.URL}
+	for _, v := range r.Variants {
+		links = append(links, v.URL)
+	}
+	for _, rule := range r.Rules {
+		links = append(links, rule.URL)
+	}
+	seen := map[string]bool{}
+	ts := []string{}
+	for _, link := range links {
+		if seen[link] || r.Signed && placeholder.MatchString(link) {
+			continue
+		}
+		seen[link] = true
+		ts = append(ts, link)
+	}
+	return ts
+}
+
+// check checks the targets of the given alias, and reports the first
+// broken one, or the first target if none is broken. It reports false
+// if the alias has no target to check.
+func (c *checker) check(ctx context.Context, r *model.Redirect) (model.Health, bool) {
+	ts := targets(r)
+	if len(ts) == 0 {
+		return model.Health{}, false
+	}
+	h := c.checkLink(ctx, ts[0])
+	for _, link := range ts[1:] {
+		if h.Broken() {
+			break
+		}
+		if lh := c.checkLink(ctx, link); lh.Broken() {
+			h = lh
+		}
+	}
+	h.Alias = r.Alias
+	return h, true
+}
+
+// checkLink issues a HEAD request to the given link, and falls back to
+// a GET request if the server does not support HEAD.
+func (c *checker) checkLink(ctx context.Context, link string) model.Health {
+	h := model.Health{URL: link}
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		h.CheckedAt = time.Now().UTC()
+		return h
+	}
+	err = c.limiter.wait(ctx, u.Host)
+	if err != nil {
+		h.CheckedAt = time.Now().UTC()
+		return h
+	}
+
+	start := time.Now()
+	status := c.do(ctx, http.MethodHead, link)
+	if status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented {
+		status = c.do(ctx, http.MethodGet, link)
+	}
+	h.Status = status
+	h.Latency = time.Since(start).Milliseconds()
+	h.CheckedAt = time.Now().UTC()
+	return h
+}
+
+// do sends a request and returns its status code, or zero if the
+// request failed.
+func (c *checker) do(ctx context.Context, method, link string) int {
+	req, err := http.NewRequestWithContext(ctx, method, link, nil)
+	if err != nil {
+		return 0
+	}
+	req.Header.Set("User-Agent", "redir-health-checker")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// hostLimiter guarantees a minimum interval between two requests
+// that are sent to the same host.
+type hostLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+func newHostLimiter(interval time.Duration) *hostLimiter {
+	return &hostLimiter{interval: interval, next: map[string]time.Time{}}
+}
+
+// wait blocks until a request to the given host is allowed.
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[host] = at.Add(l.interval)
+	l.mu.Unlock()
+
+	d := time.Until(at)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+func TestCheckerCheck(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/dead", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/nohead", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	c := &checker{
+		client:  ts.Client(),
+		limiter: newHostLimiter(0),
+	}
+	tests := []struct {
+		link   string
+		status int
+		broken bool
+	}{
+		{ts.URL + "/ok", http.StatusOK, false},
+		{ts.URL + "/dead", http.StatusNotFound, true},
+		{ts.URL + "/nohead", http.StatusOK, false},
+		{"http://127.0.0.1:0/unreachable", 0, true},
+		{"not a link", 0, true},
+	}
+	for _, tt := range tests {
+		h, ok := c.check(context.Background(), &model.Redirect{Alias: "a", URL: tt.link})
+		if !ok {
+			t.Fatalf("check %s: the link is not checked", tt.link)
+		}
+		if h.Status != tt.status {
+			t.Fatalf("check %s: want status %d, got %d", tt.link, tt.status, h.Status)
+		}
+		if h.Broken() != tt.broken {
+			t.Fatalf("check %s: want broken %v, got %v", tt.link, tt.broken, h.Broken())
+		}
+		if h.CheckedAt.IsZero() {
+			t.Fatalf("check %s: missing check time", tt.link)
+		}
+	}
+}
+
+func TestCheckerTargets(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/dead", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	c := &checker{
+		client:  ts.Client(),
+		limiter: newHostLimiter(0),
+	}
+	tests := []struct {
+		r       *model.Redirect
+		checked bool
+		url     string
+	}{
+		{&model.Redirect{URL: ts.URL + "/ok", Variants: model.Variants{{Name: "a", URL: ts.URL + "/ok"}, {Name: "b", URL: ts.URL + "/dead"}}}, true, ts.URL + "/dead"},
+		{&model.Redirect{URL: ts.URL + "/ok", Rules: model.Rules{{Platform: "ios", URL: ts.URL + "/dead"}}}, true, ts.URL + "/dead"},
+		{&model.Redirect{URL: ts.URL + "/ok", Rules: model.Rules{{Platform: "ios", URL: ts.URL + "/ok?ios"}}}, true, ts.URL + "/ok"},
+		// the placeholders of signed links are only filled by visitors.
+		{&model.Redirect{URL: ts.URL + "/dead/{id}", Signed: true}, false, ""},
+		{&model.Redirect{URL: ts.URL + "/dead/{id}", Signed: true, Variants: model.Variants{{Name: "a", URL: ts.URL + "/ok"}}}, true, ts.URL + "/ok"},
+	}
+	for _, tt := range tests {
+		tt.r.Alias = "a"
+		h, ok := c.check(context.Background(), tt.r)
+		if ok != tt.checked || h.URL != tt.url {
+			t.Fatalf("check %+v: want checked %v at %q, got %v at %q", tt.r, tt.checked, tt.url, ok, h.URL)
+		}
+		if ok && h.Broken() != strings.HasSuffix(tt.url, "/dead") {
+			t.Fatalf("check %+v: want broken at %s, got %+v", tt.r, tt.url, h)
+		}
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	l := newHostLimiter(50 * time.Millisecond)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.wait(ctx, "a.com"); err != nil {
+			t.Fatalf("wait with err: %v", err)
+		}
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("requests to the same host are not limited, took %v", d)
+	}
+
+	start = time.Now()
+	if err := l.wait(ctx, "b.com"); err != nil {
+		t.Fatalf("wait with err: %v", err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("requests to a different host are limited, took %v", d)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	l.wait(ctx, "c.com") // first request is allowed immediately
+	if err := l.wait(ctx, "c.com"); err == nil {
+		t.Fatalf("wait should fail with a canceled context")
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+	_ "time/tzdata" // time zones for the hosts without a zoneinfo database
+
+	"golang.design/x/redir/internal/model"
+)
+
+// The buckets of visit histograms.
+const (
+	bucketMinute = "minute"
+	bucketHour   = "hour"
+	bucketDay    = "day"
+	bucketWeek   = "week" // starts on Monday
+	bucketMonth  = "month"
+)
+
+// maxBuckets bounds the number of buckets of a histogram.
+const maxBuckets = 10000
+
+func validBucket(b string) bool {
+	switch b {
+	case bucketMinute, bucketHour, bucketDay, bucketWeek, bucketMonth:
+		return true
+	}
+	return false
+}
+
+// truncateBucket returns the start of the bucket that contains t in the
+// location of t.
+func truncateBucket(t time.Time, bucket string) time.Time {
+	switch bucket {
+	case bucketMinute, bucketHour:
+		// truncate the absolute local time, so that the repeated hour
+		// of a daylight saving transition is kept as two buckets.
+		size := int64(time.Minute / time.Second)
+		if bucket == bucketHour {
+			size = int64(time.Hour / time.Second)
+		}
+		_, offset := t.Zone()
+		local := t.Unix() + int64(offset)
+		m := local % size
+		if m < 0 {
+			m += size
+		}
+		return time.Unix(local-m-int64(offset), 0).In(t.Location())
+	case bucketWeek:
+		y, m, d := t.Date()
+		weekday := (int(t.Weekday()) + 6) % 7 // days since Monday
+		return time.Date(y, m, d-weekday, 0, 0, 0, 0, t.Location())
+	case bucketMonth:
+		y, m, _ := t.Date()
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	default:
+		y, m, d := t.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// nextBucket returns the start of the bucket after the bucket that
+// starts at t.
+func nextBucket(t time.Time, bucket string) time.Time {
+	switch bucket {
+	case bucketMinute:
+		return truncateBucket(t.Add(time.Minute), bucketMinute)
+	case bucketHour:
+		// the next local hour is less than an hour later if the offset
+		// of the location changes by half an hour in between.
+		return truncateBucket(t.Add(time.Hour), bucketHour)
+	case bucketWeek:
+		return truncateBucket(t.AddDate(0, 0, 7), bucketWeek)
+	case bucketMonth:
+		return truncateBucket(t.AddDate(0, 1, 0), bucketMonth)
+	default:
+		return truncateBucket(t.AddDate(0, 0, 1), bucketDay)
+	}
+}
+
+// bucketHist sums up the counts of hist into contiguous buckets of the
+// given location from the bucket of start to the bucket of end. The
+// buckets without visits are zero. The counts of rolled-up days are at
+// their midnight in UTC, so they are only spread correctly into buckets
+// of a day or longer in UTC.
+func bucketHist(hist []model.Timehist, start, end time.Time, bucket string, loc *time.Location) ([]model.Timehist, error) {
+	start, end = start.In(loc), end.In(loc)
+	if end.Before(start) {
+		return nil, fmt.Errorf("t1 %v is before t0 %v", end, start)
+	}
+
+	buckets := []model.Timehist{}
+	index := map[int64]int{}
+	for t := truncateBucket(start, bucket); !t.After(end); t = nextBucket(t, bucket) {
+		if len(buckets) >= maxBuckets {
+			return nil, fmt.Errorf("more than %d %s buckets", maxBuckets, bucket)
+		}
+		index[t.Unix()] = len(buckets)
+		buckets = append(buckets, model.Timehist{Time: t})
+	}
+	for _, h := range hist {
+		i, ok := index[truncateBucket(h.Time.In(loc), bucket).Unix()]
+		if !ok {
+			continue
+		}
+		buckets[i].Count += h.Count
+	}
+	return buckets, nil
+}
+
+// parseBucket parses the bucket parameter of a histogram, which is an
+// hour by default.
+func parseBucket(p url.Values) (string, error) {
+	bucket := p.Get("bucket")
+	if bucket == "" {
+		return bucketHour, nil
+	}
+	if !validBucket(bucket) {
+		return "", fmt.Errorf("unsupported bucket: %s", bucket)
+	}
+	return bucket, nil
+}
+
+// parseLocation parses the IANA time zone of the tz parameter, which is
+// UTC by default.
+func parseLocation(p url.Values) (*time.Location, error) {
+	tz := p.Get("tz")
+	if tz == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone: %w", err)
+	}
+	return loc, nil
+}
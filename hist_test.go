@@ -0,0 +1,140 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+func TestTruncateBucket(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatalf("cannot load location: %v", err)
+	}
+	ts := time.Date(2021, 12, 1, 18, 42, 17, 0, time.UTC) // Wednesday, 02:42 on Thursday in Shanghai
+	tests := []struct {
+		loc    *time.Location
+		bucket string
+		want   string
+	}{
+		{time.UTC, bucketMinute, "2021-12-01T18:42:00Z"},
+		{time.UTC, bucketHour, "2021-12-01T18:00:00Z"},
+		{time.UTC, bucketDay, "2021-12-01T00:00:00Z"},
+		{time.UTC, bucketWeek, "2021-11-29T00:00:00Z"},
+		{time.UTC, bucketMonth, "2021-12-01T00:00:00Z"},
+		{shanghai, bucketHour, "2021-12-02T02:00:00+08:00"},
+		{shanghai, bucketDay, "2021-12-02T00:00:00+08:00"},
+		{shanghai, bucketWeek, "2021-11-29T00:00:00+08:00"},
+		{shanghai, bucketMonth, "2021-12-01T00:00:00+08:00"},
+	}
+	for _, tt := range tests {
+		got := truncateBucket(ts.In(tt.loc), tt.bucket).Format(time.RFC3339)
+		if got != tt.want {
+			t.Fatalf("truncateBucket(%v, %s) want %s, got %s", ts.In(tt.loc), tt.bucket, tt.want, got)
+		}
+	}
+}
+
+func TestBucketHist(t *testing.T) {
+	hist := []model.Timehist{
+		{Time: time.Date(2021, 12, 1, 1, 10, 0, 0, time.UTC), Count: 1},
+		{Time: time.Date(2021, 12, 1, 1, 50, 0, 0, time.UTC), Count: 2},
+		{Time: time.Date(2021, 12, 1, 4, 0, 0, 0, time.UTC), Count: 3},
+		{Time: time.Date(2021, 12, 2, 0, 0, 0, 0, time.UTC), Count: 4}, // out of range
+	}
+	start := time.Date(2021, 12, 1, 0, 30, 0, 0, time.UTC)
+	end := time.Date(2021, 12, 1, 4, 30, 0, 0, time.UTC)
+	got, err := bucketHist(hist, start, end, bucketHour, time.UTC)
+	if err != nil {
+		t.Fatalf("bucketHist with err: %v", err)
+	}
+	want := []int{0, 3, 0, 0, 3}
+	if len(got) != len(want) {
+		t.Fatalf("bucketHist want %d buckets, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i].Count != want[i] || !got[i].Time.Equal(start.Truncate(time.Hour).Add(time.Duration(i)*time.Hour)) {
+			t.Fatalf("bucketHist bucket %d want %d visits, got %+v", i, want[i], got)
+		}
+	}
+
+	_, err = bucketHist(hist, start, start.AddDate(1, 0, 0), bucketMinute, time.UTC)
+	if err == nil {
+		t.Fatalf("bucketHist accepts too many buckets")
+	}
+	_, err = bucketHist(hist, end, start, bucketHour, time.UTC)
+	if err == nil {
+		t.Fatalf("bucketHist accepts t1 before t0")
+	}
+}
+
+func TestBucketHistDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("cannot load location: %v", err)
+	}
+	// the clocks fall back from 02:00 EDT to 01:00 EST on 2021-11-07, so
+	// the day has 25 hours and 01:00 is repeated.
+	start := time.Date(2021, 11, 7, 0, 0, 0, 0, ny)
+	end := time.Date(2021, 11, 7, 23, 59, 0, 0, ny)
+	hist := []model.Timehist{
+		{Time: time.Date(2021, 11, 7, 5, 30, 0, 0, time.UTC), Count: 1}, // 01:30 EDT
+		{Time: time.Date(2021, 11, 7, 6, 30, 0, 0, time.UTC), Count: 2}, // 01:30 EST
+	}
+	got, err := bucketHist(hist, start, end, bucketHour, ny)
+	if err != nil {
+		t.Fatalf("bucketHist with err: %v", err)
+	}
+	if len(got) != 25 {
+		t.Fatalf("bucketHist want 25 hours, got %d", len(got))
+	}
+	if got[1].Count != 1 || got[2].Count != 2 || got[1].Time.Hour() != 1 || got[2].Time.Hour() != 1 {
+		t.Fatalf("bucketHist does not keep the repeated hour: %+v", got[:4])
+	}
+
+	days, err := bucketHist(hist, start, end.AddDate(0, 0, 1), bucketDay, ny)
+	if err != nil {
+		t.Fatalf("bucketHist with err: %v", err)
+	}
+	if len(days) != 2 || days[0].Count != 3 || days[1].Count != 0 {
+		t.Fatalf("bucketHist want 2 days with 3 and 0 visits, got %+v", days)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatalf("cannot load location: %v", err)
+	}
+	p := url.Values{}
+	p.Set("t0", "2021-12-01")
+	p.Set("t1", "2021-12-02T08:00:00+08:00")
+	start, end, err := parseDuration(p, shanghai)
+	if err != nil {
+		t.Fatalf("parseDuration with err: %v", err)
+	}
+	if want := time.Date(2021, 11, 30, 16, 0, 0, 0, time.UTC); !start.Equal(want) || start.Location() != time.UTC {
+		t.Fatalf("parseDuration want start %v, got %v", want, start)
+	}
+	if want := time.Date(2021, 12, 2, 0, 0, 0, 0, time.UTC); !end.Equal(want) || end.Location() != time.UTC {
+		t.Fatalf("parseDuration want end %v, got %v", want, end)
+	}
+
+	p.Set("t0", "yesterday")
+	if _, _, err := parseDuration(p, time.UTC); err == nil {
+		t.Fatalf("parseDuration accepts an invalid time")
+	}
+
+	if _, err := parseLocation(url.Values{"tz": {"Mars/Olympus"}}); err == nil {
+		t.Fatalf("parseLocation accepts an invalid time zone")
+	}
+	if _, err := parseBucket(url.Values{"bucket": {"year"}}); err == nil {
+		t.Fatalf("parseBucket accepts an invalid bucket")
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// The data types of the data section.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// maxDepth bounds the nesting of values and pointers so that a corrupted
+// database cannot cause an infinite recursion.
+const maxDepth = 32
+
+var errUnexpectedEnd = errors.New("unexpected end of data")
+
+// decoder decodes the values of a data section. Maps are decoded as
+// map[string]interface{}, arrays as []interface{}, unsigned integers as
+// uint64, except uint128 as *big.Int, and int32 as int64.
+type decoder struct {
+	buf []byte
+}
+
+// decode decodes the value at the given offset, and returns the value
+// and the offset right after it.
+func (d *decoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("data is nested too deep")
+	}
+	typ, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == typePointer {
+		ptr, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, next, err
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			k, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is %T, not string", k)
+			}
+			v, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			v, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errUnexpectedEnd
+	}
+	b, next := d.buf[offset:offset+size], offset+size
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(uint64(readUint(b))), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(uint32(readUint(b)))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid unsigned integer size %d", size)
+		}
+		return readUint(b), next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid int32 size %d", size)
+		}
+		return int64(int32(uint32(readUint(b)))), next, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, fmt.Errorf("invalid uint128 size %d", size)
+		}
+		return new(big.Int).SetBytes(b), next, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+	}
+}
+
+// control decodes the control byte at the given offset, and returns the
+// type and the size of the value, and the offset of its payload. For a
+// pointer, the size is the control byte itself.
+func (d *decoder) control(offset uint) (typ, size, next uint, err error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, errUnexpectedEnd
+	}
+	ctrl := uint(d.buf[offset])
+	offset++
+	typ = ctrl >> 5
+	if typ == typePointer {
+		return typ, ctrl, offset, nil
+	}
+	if typ == typeExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, errUnexpectedEnd
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+
+	size = ctrl & 0x1f
+	if size < 29 {
+		return typ, size, offset, nil
+	}
+	n := size - 28
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, 0, errUnexpectedEnd
+	}
+	v := uint(readUint(d.buf[offset : offset+n]))
+	switch n {
+	case 1:
+		size = 29 + v
+	case 2:
+		size = 285 + v
+	default:
+		size = 65821 + v
+	}
+	return typ, size, offset + n, nil
+}
+
+// pointer decodes a pointer of the given control byte whose payload
+// starts at offset, and returns the pointed offset and the offset right
+// after the pointer.
+func (d *decoder) pointer(ctrl, offset uint) (ptr, next uint, err error) {
+	n := (ctrl>>3)&0x3 + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errUnexpectedEnd
+	}
+	v := uint(readUint(d.buf[offset : offset+n]))
+	switch n {
+	case 1:
+		ptr = (ctrl&0x7)<<8 | v
+	case 2:
+		ptr = ((ctrl&0x7)<<16 | v) + 2048
+	case 3:
+		ptr = ((ctrl&0x7)<<24 | v) + 526336
+	default:
+		ptr = v
+	}
+	return ptr, offset + n, nil
+}
+
+// readUint reads a big-endian unsigned integer of at most 8 bytes.
+func readUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
@@ -0,0 +1,186 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+// Package geoip implements a reader of MaxMind DB files, such as the
+// GeoLite2 and GeoIP2 country databases, in pure Go.
+//
+// The file format is specified at https://maxmind.github.io/MaxMind-DB/.
+package geoip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// metadataMarker starts the metadata section at the end of a database.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// dataSeparator is the size of the zero bytes between the search tree
+// and the data section.
+const dataSeparator = 16
+
+var errInvalidDatabase = errors.New("invalid maxmind database")
+
+// Metadata describes a database.
+type Metadata struct {
+	DatabaseType string
+	IPVersion    uint
+	NodeCount    uint
+	RecordSize   uint
+	BuildEpoch   uint64
+}
+
+// Reader looks up the records of IP addresses in a database.
+type Reader struct {
+	Metadata Metadata
+
+	buf       []byte
+	data      []byte // the data section
+	ipv4Start uint   // the node of ::/96 in an IPv6 tree
+}
+
+// Open reads the database from the given file.
+func Open(path string) (*Reader, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(b)
+}
+
+// FromBytes reads the database from the given bytes.
+func FromBytes(b []byte) (*Reader, error) {
+	i := bytes.LastIndex(b, metadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", errInvalidDatabase)
+	}
+	metaStart := i + len(metadataMarker)
+	v, _, err := (&decoder{buf: b[metaStart:]}).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidDatabase, err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", errInvalidDatabase)
+	}
+
+	r := &Reader{buf: b}
+	r.Metadata.DatabaseType, _ = m["database_type"].(string)
+	r.Metadata.IPVersion = uint(toUint(m["ip_version"]))
+	r.Metadata.NodeCount = uint(toUint(m["node_count"]))
+	r.Metadata.RecordSize = uint(toUint(m["record_size"]))
+	r.Metadata.BuildEpoch = toUint(m["build_epoch"])
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d", errInvalidDatabase, r.Metadata.RecordSize)
+	}
+	if r.Metadata.IPVersion != 4 && r.Metadata.IPVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported ip version %d", errInvalidDatabase, r.Metadata.IPVersion)
+	}
+	treeSize := r.Metadata.NodeCount * r.Metadata.RecordSize / 4
+	if treeSize+dataSeparator > uint(i) {
+		return nil, fmt.Errorf("%w: search tree exceeds the file", errInvalidDatabase)
+	}
+	r.data = b[treeSize+dataSeparator : i]
+
+	if r.Metadata.IPVersion == 6 {
+		for j := 0; j < 96 && r.ipv4Start < r.Metadata.NodeCount; j++ {
+			r.ipv4Start = r.readNode(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// Lookup returns the record of the given IP address, or nil if there is
+// no record of the address.
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	node, bits := uint(0), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+		node = r.ipv4Start
+	} else if r.Metadata.IPVersion == 4 {
+		return nil, fmt.Errorf("cannot look up IPv6 address %v in an IPv4 database", ip)
+	}
+	if len(ip) == 0 {
+		return nil, errors.New("invalid ip address")
+	}
+
+	n := r.Metadata.NodeCount
+	for i := 0; i < bits && node < n; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i&7))) & 1
+		node = r.readNode(node, bit)
+	}
+	if node == n {
+		return nil, nil
+	}
+	if node < n {
+		return nil, fmt.Errorf("%w: search tree is too deep", errInvalidDatabase)
+	}
+	offset := node - n - dataSeparator
+	if offset >= uint(len(r.data)) {
+		return nil, fmt.Errorf("%w: record pointer exceeds the data section", errInvalidDatabase)
+	}
+	v, _, err := (&decoder{buf: r.data}).decode(offset, 0)
+	return v, err
+}
+
+// Country returns the ISO 3166-1 country code of the given IP address in
+// upper case, or an empty string if the country is unknown. The
+// registered country is used if the address has no located country.
+func (r *Reader) Country(ip net.IP) (string, error) {
+	v, err := r.Lookup(ip)
+	if err != nil || v == nil {
+		return "", err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return "", nil
+	}
+	for _, k := range []string{"country", "registered_country"} {
+		c, ok := m[k].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if code, ok := c["iso_code"].(string); ok && code != "" {
+			return strings.ToUpper(code), nil
+		}
+	}
+	return "", nil
+}
+
+// readNode returns the left (index 0) or right (index 1) record of the
+// given node.
+func (r *Reader) readNode(node, index uint) uint {
+	b := r.buf
+	switch r.Metadata.RecordSize {
+	case 24:
+		o := node*6 + index*3
+		return uint(b[o])<<16 | uint(b[o+1])<<8 | uint(b[o+2])
+	case 28:
+		o := node * 7
+		if index == 0 {
+			return uint(b[o+3]&0xF0)<<20 | uint(b[o])<<16 | uint(b[o+1])<<8 | uint(b[o+2])
+		}
+		return uint(b[o+3]&0x0F)<<24 | uint(b[o+4])<<16 | uint(b[o+5])<<8 | uint(b[o+6])
+	default:
+		o := node*8 + index*4
+		return uint(b[o])<<24 | uint(b[o+1])<<16 | uint(b[o+2])<<8 | uint(b[o+3])
+	}
+}
+
+func toUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		return uint64(n)
+	}
+	return 0
+}
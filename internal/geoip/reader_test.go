@@ -0,0 +1,243 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package geoip
+
+import (
+	"bytes"
+	"flag"
+	"net"
+	"os"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the test database in testdata")
+
+const fixture = "testdata/country.mmdb"
+
+func TestFixture(t *testing.T) {
+	b := buildDB(t, 24)
+	if *update {
+		err := os.WriteFile(fixture, b, 0644)
+		if err != nil {
+			t.Fatalf("cannot update %s: %v", fixture, err)
+		}
+	}
+	want, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatalf("cannot read %s: %v", fixture, err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("%s is outdated, run go test -update", fixture)
+	}
+}
+
+func TestCountry(t *testing.T) {
+	r, err := Open(fixture)
+	if err != nil {
+		t.Fatalf("Open with err: %v", err)
+	}
+	if r.Metadata.DatabaseType != "Redir-Test-Country" || r.Metadata.IPVersion != 6 {
+		t.Fatalf("Open returns wrong metadata: %+v", r.Metadata)
+	}
+	testCountry(t, r)
+
+	for _, size := range []uint{28, 32} {
+		r, err := FromBytes(buildDB(t, size))
+		if err != nil {
+			t.Fatalf("FromBytes with record size %d with err: %v", size, err)
+		}
+		testCountry(t, r)
+	}
+}
+
+func testCountry(t *testing.T, r *Reader) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"1.0.0.1", "CN"},
+		{"1.0.0.255", "CN"},
+		{"1.0.1.1", ""},
+		{"8.8.8.8", "US"},
+		{"10.1.2.3", "JP"}, // registered country only
+		{"::ffff:8.8.4.4", "US"},
+		{"2001:db8::1", "DE"},
+		{"2001:db9::1", ""},
+		{"::1", ""},
+	}
+	for _, tt := range tests {
+		got, err := r.Country(net.ParseIP(tt.ip))
+		if err != nil {
+			t.Fatalf("Country(%s) with record size %d with err: %v", tt.ip, r.Metadata.RecordSize, err)
+		}
+		if got != tt.want {
+			t.Fatalf("Country(%s) with record size %d want %q, got %q", tt.ip, r.Metadata.RecordSize, tt.want, got)
+		}
+	}
+}
+
+func TestInvalidDatabase(t *testing.T) {
+	if _, err := FromBytes([]byte("not a database")); err == nil {
+		t.Fatalf("FromBytes accepts an invalid database")
+	}
+	b := buildDB(t, 24)
+	if _, err := FromBytes(b[len(b)/2:]); err == nil {
+		t.Fatalf("FromBytes accepts a truncated database")
+	}
+}
+
+// buildDB builds an IPv6 country database with the given record size.
+// The IPv4 networks are stored under ::/96 like the MaxMind databases.
+func buildDB(t *testing.T, recordSize uint) []byte {
+	t.Helper()
+
+	data := &bytes.Buffer{}
+	country := func(code string) []byte {
+		return encMap("iso_code", encString(code), "names", encMap("en", encString(code)))
+	}
+	jp := uint(data.Len())
+	data.Write(country("JP"))
+	records := []struct {
+		network string
+		record  []byte
+	}{
+		{"1.0.0.0/24", encMap("country", country("CN"), "registered_country", country("CN"))},
+		{"8.8.0.0/16", encMap("country", country("US"))},
+		{"10.0.0.0/8", encMap("registered_country", encPointer(jp))},
+		{"2001:db8::/32", encMap("country", country("DE"))},
+	}
+
+	root := &trieNode{}
+	for _, r := range records {
+		_, n, err := net.ParseCIDR(r.network)
+		if err != nil {
+			t.Fatalf("invalid network %s: %v", r.network, err)
+		}
+		ones, bits := n.Mask.Size()
+		ip := n.IP.To16()
+		if bits == 32 {
+			ones += 96
+			ip = append(make(net.IP, 12), n.IP.To4()...)
+		}
+		root.insert(ip, ones, uint(data.Len()))
+		data.Write(r.record)
+	}
+
+	// number the nodes in breadth-first order.
+	nodes := []*trieNode{root}
+	for i := 0; i < len(nodes); i++ {
+		nodes[i].id = uint(i)
+		for _, c := range nodes[i].next {
+			if c != nil {
+				nodes = append(nodes, c)
+			}
+		}
+	}
+	n := uint(len(nodes))
+
+	b := &bytes.Buffer{}
+	for _, node := range nodes {
+		var rec [2]uint
+		for i := range rec {
+			switch {
+			case node.next[i] != nil:
+				rec[i] = node.next[i].id
+			case node.leaf[i]:
+				rec[i] = n + dataSeparator + node.data[i]
+			default:
+				rec[i] = n
+			}
+		}
+		switch recordSize {
+		case 24:
+			b.Write([]byte{byte(rec[0] >> 16), byte(rec[0] >> 8), byte(rec[0])})
+			b.Write([]byte{byte(rec[1] >> 16), byte(rec[1] >> 8), byte(rec[1])})
+		case 28:
+			b.Write([]byte{byte(rec[0] >> 16), byte(rec[0] >> 8), byte(rec[0]),
+				byte(rec[0]>>20)&0xF0 | byte(rec[1]>>24)&0x0F,
+				byte(rec[1] >> 16), byte(rec[1] >> 8), byte(rec[1])})
+		case 32:
+			b.Write([]byte{byte(rec[0] >> 24), byte(rec[0] >> 16), byte(rec[0] >> 8), byte(rec[0])})
+			b.Write([]byte{byte(rec[1] >> 24), byte(rec[1] >> 16), byte(rec[1] >> 8), byte(rec[1])})
+		}
+	}
+	b.Write(make([]byte, dataSeparator))
+	b.Write(data.Bytes())
+	b.Write(metadataMarker)
+	b.Write(encMap(
+		"binary_format_major_version", encUint(typeUint16, 2),
+		"binary_format_minor_version", encUint(typeUint16, 0),
+		"build_epoch", encUint(typeUint64, 1609459200),
+		"database_type", encString("Redir-Test-Country"),
+		"description", encMap("en", encString("Test database of redir")),
+		"ip_version", encUint(typeUint16, 6),
+		"languages", encArray(encString("en")),
+		"node_count", encUint(typeUint32, uint64(n)),
+		"record_size", encUint(typeUint16, uint64(recordSize)),
+	))
+	return b.Bytes()
+}
+
+type trieNode struct {
+	id   uint
+	next [2]*trieNode
+	leaf [2]bool
+	data [2]uint
+}
+
+func (t *trieNode) insert(ip net.IP, prefix int, data uint) {
+	node := t
+	for i := 0; i < prefix; i++ {
+		bit := ip[i>>3] >> (7 - uint(i&7)) & 1
+		if i == prefix-1 {
+			node.leaf[bit], node.data[bit] = true, data
+			return
+		}
+		if node.next[bit] == nil {
+			node.next[bit] = &trieNode{}
+		}
+		node = node.next[bit]
+	}
+}
+
+func encControl(typ, size int) []byte {
+	if typ <= typeMap {
+		return []byte{byte(typ<<5 | size)}
+	}
+	return []byte{byte(size), byte(typ - 7)}
+}
+
+func encString(s string) []byte {
+	return append(encControl(typeString, len(s)), s...)
+}
+
+func encUint(typ int, v uint64) []byte {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append(encControl(typ, len(b)), b...)
+}
+
+func encMap(kvs ...interface{}) []byte {
+	b := encControl(typeMap, len(kvs)/2)
+	for i := 0; i < len(kvs); i += 2 {
+		b = append(b, encString(kvs[i].(string))...)
+		b = append(b, kvs[i+1].([]byte)...)
+	}
+	return b
+}
+
+func encArray(vs ...[]byte) []byte {
+	b := encControl(typeArray, len(vs))
+	for _, v := range vs {
+		b = append(b, v...)
+	}
+	return b
+}
+
+func encPointer(ptr uint) []byte {
+	return []byte{byte(typePointer<<5 | ptr>>8&0x7), byte(ptr)}
+}
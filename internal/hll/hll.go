@@ -0,0 +1,200 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+// Package hll implements HyperLogLog sketches, which estimate the number
+// of distinct elements, such as the unique visitors of an alias, in a
+// fixed amount of memory. Sketches can be merged, so that the estimate of
+// a union of sets is the estimate of the merged sketches of the sets.
+package hll
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	// Precision is the number of bits of a hash that select a register.
+	Precision = 14
+	// registers is the number of registers, the standard error of an
+	// estimate is about 1.04/sqrt(registers), i.e. 0.81%.
+	registers = 1 << Precision
+	// maxRank is the largest value of a register.
+	maxRank = 64 - Precision + 1
+)
+
+// The encodings of a sketch. A sparse sketch stores the index and the
+// value of each non-zero register, a dense sketch stores all registers.
+const (
+	encodingSparse = 1
+	encodingDense  = 2
+)
+
+// Sketch is a HyperLogLog sketch. The zero value is an empty sketch.
+type Sketch struct {
+	regs []uint8 // nil if the sketch is empty
+}
+
+// New returns an empty sketch.
+func New() *Sketch {
+	return &Sketch{}
+}
+
+// Add adds an element to the sketch.
+func (s *Sketch) Add(x string) {
+	s.AddHash(hash(x))
+}
+
+// AddHash adds an element with the given 64-bit hash to the sketch.
+func (s *Sketch) AddHash(h uint64) {
+	if s.regs == nil {
+		s.regs = make([]uint8, registers)
+	}
+	i := h >> (64 - Precision)
+	rank := uint8(bits.LeadingZeros64(h<<Precision|1<<(Precision-1)) + 1)
+	if rank > s.regs[i] {
+		s.regs[i] = rank
+	}
+}
+
+// Merge merges the elements of the given sketch into s.
+func (s *Sketch) Merge(o *Sketch) {
+	if o == nil || o.regs == nil {
+		return
+	}
+	if s.regs == nil {
+		s.regs = make([]uint8, registers)
+	}
+	for i, r := range o.regs {
+		if r > s.regs[i] {
+			s.regs[i] = r
+		}
+	}
+}
+
+// Estimate estimates the number of distinct elements of the sketch. It
+// uses the improved estimator of Otmar Ertl, which has no bias for small
+// and large numbers and thus needs no empirical corrections.
+func (s *Sketch) Estimate() uint64 {
+	if s.regs == nil {
+		return 0
+	}
+	counts := [maxRank + 1]int{}
+	for _, r := range s.regs {
+		counts[r]++
+	}
+	m := float64(registers)
+	z := m * tau(1-float64(counts[maxRank])/m)
+	for k := maxRank - 1; k >= 1; k-- {
+		z = 0.5 * (z + float64(counts[k]))
+	}
+	z += m * sigma(float64(counts[0])/m)
+	return uint64(math.Round(0.5 / math.Ln2 * m * m / z))
+}
+
+func sigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+func tau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+// MarshalBinary encodes the sketch, sparsely if most of its registers are
+// zero.
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	nonzero := 0
+	for _, r := range s.regs {
+		if r != 0 {
+			nonzero++
+		}
+	}
+	if nonzero*3 >= registers {
+		b := make([]byte, 0, 2+registers)
+		b = append(b, encodingDense, Precision)
+		return append(b, s.regs...), nil
+	}
+	b := make([]byte, 0, 2+nonzero*3)
+	b = append(b, encodingSparse, Precision)
+	for i, r := range s.regs {
+		if r != 0 {
+			b = append(b, byte(i>>8), byte(i), r)
+		}
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a sketch encoded by MarshalBinary.
+func (s *Sketch) UnmarshalBinary(b []byte) error {
+	if len(b) < 2 || b[1] != Precision {
+		return errors.New("hll: invalid sketch")
+	}
+	regs := make([]uint8, registers)
+	switch b[0] {
+	case encodingDense:
+		if len(b) != 2+registers {
+			return errors.New("hll: invalid dense sketch")
+		}
+		copy(regs, b[2:])
+	case encodingSparse:
+		if (len(b)-2)%3 != 0 {
+			return errors.New("hll: invalid sparse sketch")
+		}
+		for p := 2; p < len(b); p += 3 {
+			i := int(b[p])<<8 | int(b[p+1])
+			if i >= registers {
+				return errors.New("hll: invalid sparse sketch")
+			}
+			regs[i] = b[p+2]
+		}
+	default:
+		return errors.New("hll: unknown encoding")
+	}
+	for _, r := range regs {
+		if r > maxRank {
+			return errors.New("hll: invalid register")
+		}
+	}
+	s.regs = regs
+	return nil
+}
+
+// hash hashes x into 64 bits. FNV-1a does not mix its last bytes well
+// enough for the registers, thus its result is finalized like MurmurHash3.
+func hash(x string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(x))
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
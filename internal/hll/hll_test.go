@@ -0,0 +1,88 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package hll
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	// three times the standard error of 1.04/sqrt(registers).
+	bound := 3 * 1.04 / math.Sqrt(registers)
+
+	s := New()
+	if got := s.Estimate(); got != 0 {
+		t.Fatalf("empty sketch estimates %d", got)
+	}
+	n := 0
+	for _, want := range []int{1, 10, 100, 1000, 10000, 50000, 100000, 500000, 1000000} {
+		for ; n < want; n++ {
+			s.Add(fmt.Sprintf("192.168.%d.%d", n/256, n%256))
+		}
+		// adding an element again does not change the estimate.
+		s.Add("192.168.0.0")
+		got := s.Estimate()
+		e := math.Abs(float64(got)-float64(want)) / float64(want)
+		if e > bound {
+			t.Fatalf("estimate of %d elements is %d, error %.4f exceeds %.4f", want, got, e, bound)
+		}
+		// small sets are almost exact.
+		if want <= 100 && got != uint64(want) {
+			t.Fatalf("estimate of %d elements is %d", want, got)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := New(), New()
+	for i := 0; i < 20000; i++ {
+		a.Add(fmt.Sprint(i))
+		b.Add(fmt.Sprint(i + 10000))
+	}
+	a.Merge(b)
+	a.Merge(New())
+	got := a.Estimate()
+	if e := math.Abs(float64(got)-30000) / 30000; e > 3*1.04/math.Sqrt(registers) {
+		t.Fatalf("estimate of merged sketches is %d, want about 30000", got)
+	}
+
+	empty := New()
+	empty.Merge(b)
+	if empty.Estimate() != b.Estimate() {
+		t.Fatalf("merging into an empty sketch estimates %d, want %d", empty.Estimate(), b.Estimate())
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	for _, n := range []int{0, 10, 100000} {
+		s := New()
+		for i := 0; i < n; i++ {
+			s.Add(fmt.Sprint(i))
+		}
+		b, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary with err: %v", err)
+		}
+		if n == 10 && len(b) != 2+10*3 {
+			t.Fatalf("sketch of 10 elements is not sparse: %d bytes", len(b))
+		}
+		got := New()
+		err = got.UnmarshalBinary(b)
+		if err != nil {
+			t.Fatalf("UnmarshalBinary with err: %v", err)
+		}
+		if got.Estimate() != s.Estimate() {
+			t.Fatalf("unmarshaled sketch estimates %d, want %d", got.Estimate(), s.Estimate())
+		}
+	}
+
+	for _, b := range [][]byte{nil, {encodingDense, Precision, 1}, {encodingSparse, Precision, 0xff, 0xff, 1}, {3, Precision}, {encodingSparse, 10}} {
+		if err := New().UnmarshalBinary(b); err == nil {
+			t.Fatalf("UnmarshalBinary accepts %v", b)
+		}
+	}
+}
@@ -9,7 +9,10 @@ package model
 
 import (
 	"context"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 )
 
@@ -20,8 +23,108 @@ var (
 
 // Redirect records alias and its correlated link.
 type Redirect struct {
-	Alias string `json:"alias"   db:"alias"`
-	URL   string `json:"url"     db:"url"`
+	Alias        string    `json:"alias"        db:"alias"`
+	URL          string    `json:"url"          db:"url"`
+	Owner        string    `json:"owner"        db:"owner"`
+	Description  string    `json:"description"  db:"description"`
+	Interstitial int       `json:"interstitial" db:"interstitial"` // countdown in seconds, 0 redirects immediately
+	Password     string    `json:"-"            db:"password"`     // bcrypt hash, empty if not protected
+	MaxVisits    int64     `json:"max_visits"   db:"max_visits"`   // 0 for unlimited visits
+	Visits       int64     `json:"visits"       db:"visits"`       // consumed visits if MaxVisits is set
+	Signed       bool      `json:"signed"       db:"signed"`       // requires a signature over the alias and its parameters
+	Variants     Variants  `json:"variants"     db:"variants"`     // weighted targets that replace URL if not empty
+	Sticky       bool      `json:"sticky"       db:"sticky"`       // keeps a visitor on the same variant
+	Rules        Rules     `json:"rules"        db:"rules"`        // ordered rules that are evaluated before URL and Variants
+	CreatedAt    time.Time `json:"created_at"   db:"created_at"`
+}
+
+// Variant is one of the weighted targets of an A/B split redirect.
+type Variant struct {
+	Name   string `json:"name"   yaml:"name"`
+	URL    string `json:"url"    yaml:"url"`
+	Weight int    `json:"weight" yaml:"weight"`
+}
+
+// Variants is a list of variants that is stored as JSON.
+type Variants []Variant
+
+// Value implements driver.Valuer.
+func (vs Variants) Value() (driver.Value, error) {
+	if len(vs) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(vs)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner.
+func (vs *Variants) Scan(src interface{}) error {
+	return scanJSON(src, vs)
+}
+
+// Rule redirects the visits that match all its non-empty conditions to
+// its URL.
+type Rule struct {
+	Platform string `json:"platform,omitempty" yaml:"platform"` // ios, android, windows, macos or linux
+	Language string `json:"language,omitempty" yaml:"language"` // language tag, e.g. zh or zh-TW
+	Referer  string `json:"referer,omitempty"  yaml:"referer"`  // referer host pattern, e.g. *.google.com
+	Country  string `json:"country,omitempty"  yaml:"country"`  // ISO 3166-1 country code, e.g. CN
+	URL      string `json:"url"                yaml:"url"`
+}
+
+// Rules is a list of ordered rules that is stored as JSON.
+type Rules []Rule
+
+// Value implements driver.Valuer.
+func (rs Rules) Value() (driver.Value, error) {
+	if len(rs) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(rs)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner.
+func (rs *Rules) Scan(src interface{}) error {
+	return scanJSON(src, rs)
+}
+
+// scanJSON scans a JSON column into v, a NULL or empty column leaves v
+// unchanged.
+func scanJSON(src interface{}, v interface{}) error {
+	var b []byte
+	switch s := src.(type) {
+	case nil:
+		return nil
+	case string:
+		b = []byte(s)
+	case []byte:
+		b = s
+	default:
+		return fmt.Errorf("cannot scan %T into %T", src, v)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Remaining returns the number of remaining visits of a redirect, or -1
+// if the visits are unlimited.
+func (r *Redirect) Remaining() int64 {
+	if r.MaxVisits <= 0 {
+		return -1
+	}
+	if r.Visits >= r.MaxVisits {
+		return 0
+	}
+	return r.MaxVisits - r.Visits
 }
 
 // Visit indicates an Record of Visit pattern.
@@ -31,6 +134,30 @@ type Visit struct {
 	UA      string    `json:"ua"      db:"ua"`
 	Referer string    `json:"referer" db:"referer"`
 	Time    time.Time `json:"time"    db:"time"`
+	Variant string    `json:"variant" db:"variant"`
+	Country string    `json:"country" db:"country"` // ISO 3166-1 code, empty if unknown
+	Bot     bool      `json:"bot"     db:"bot"`     // whether the visitor is a bot or crawler
+
+	// The parsed user agent, which is parsed from UA when the visit is
+	// recorded if Browser is empty.
+	Browser        string `json:"browser"         db:"browser"`
+	BrowserVersion string `json:"browser_version" db:"browser_version"` // the major version
+	OS             string `json:"os"              db:"os"`
+	Device         string `json:"device"          db:"device"`
+
+	// The normalized referer, which is parsed from Referer when the visit
+	// is recorded if they are empty.
+	RefererHost string `json:"referer_host" db:"referer_host"`
+	RefererPath string `json:"referer_path" db:"referer_path"` // the host followed by the path
+	Channel     string `json:"channel"      db:"channel"`      // direct, search, social, email, internal or referral
+}
+
+// Filter narrows down the visits that are counted.
+type Filter struct {
+	// Variant only counts the visits of the given variant if not empty.
+	Variant string
+	// Bots counts the visits of bots as well, which are excluded by default.
+	Bots bool
 }
 
 // Refstat counts the occurrence of a referer.
@@ -39,18 +166,122 @@ type Refstat struct {
 	Count   int64  `json:"count"`
 }
 
+// Channelstat counts the visits of a channel.
+type Channelstat struct {
+	Channel string `json:"channel"`
+	Count   int64  `json:"count"`
+}
+
 // UAstat counts the occurrence of a user agent.
 type UAstat struct {
 	UA    string `json:"ua"`
 	Count int64  `json:"count"`
 }
 
-// Timehist counts the occurrence of visit events during a time period (an hour).
+// Browserstat counts the visits of a major version of a browser.
+type Browserstat struct {
+	Browser string `json:"browser"`
+	Version string `json:"version"`
+	Count   int64  `json:"count"`
+}
+
+// OSstat counts the visits of an operating system.
+type OSstat struct {
+	OS    string `json:"os"`
+	Count int64  `json:"count"`
+}
+
+// Devicestat counts the visits of a device type.
+type Devicestat struct {
+	Device string `json:"device"`
+	Count  int64  `json:"count"`
+}
+
+// Countrystat counts the visits of a country.
+type Countrystat struct {
+	Country string `json:"country"`
+	Count   int64  `json:"count"`
+}
+
+// Variantstat counts the visits of a variant.
+type Variantstat struct {
+	Variant string `json:"variant" db:"variant"`
+	PV      int64  `json:"pv"      db:"pv"`
+	UV      int64  `json:"uv"      db:"uv"`
+}
+
+// Daystat counts the visits of an alias on a day.
+type Daystat struct {
+	Alias string `json:"alias" db:"alias"`
+	Day   string `json:"day"   db:"day"` // the date in UTC, e.g. 2021-12-01
+	PV    int64  `json:"pv"    db:"pv"`
+	UV    int64  `json:"uv"    db:"uv"`
+}
+
+// Timehist counts the occurrence of visit events at or since a time.
 type Timehist struct {
 	Time  time.Time `json:"time"`
 	Count int       `json:"count"`
 }
 
+// Health records the latest health check result of an alias. A zero
+// Status indicates the link could not be reached at all.
+type Health struct {
+	Alias     string    `json:"alias"      db:"alias"`
+	URL       string    `json:"url"        db:"url"`
+	Status    int       `json:"status"     db:"status"`
+	Latency   int64     `json:"latency"    db:"latency"` // in milliseconds
+	CheckedAt time.Time `json:"checked_at" db:"checked_at"`
+}
+
+// Broken reports whether the checked link is considered dead.
+func (h *Health) Broken() bool {
+	return h.Status == 0 || h.Status >= 400
+}
+
+// Rangestat counts the visits of an alias in a time range.
+type Rangestat struct {
+	PV    int64      `json:"pv"    db:"pv"`
+	UV    int64      `json:"uv"    db:"uv"`
+	First *time.Time `json:"first" db:"-"` // nil if there is no visit
+	Last  *time.Time `json:"last"  db:"-"`
+}
+
+// The states of a webhook in the outbox.
+const (
+	WebhookPending   = "pending"   // waiting for its next attempt
+	WebhookDelivered = "delivered" // accepted by the endpoint
+	WebhookFailed    = "failed"    // given up after the last attempt
+)
+
+// Webhook is a webhook event to be delivered to an endpoint, stored in
+// the outbox until it is delivered or given up.
+type Webhook struct {
+	ID        int64     `json:"id"         db:"id"`
+	Event     string    `json:"event"      db:"event"`
+	Alias     string    `json:"alias"      db:"alias"`
+	URL       string    `json:"url"        db:"url"`
+	Payload   string    `json:"payload"    db:"payload"` // the JSON body of the request
+	State     string    `json:"state"      db:"state"`
+	Attempts  int       `json:"attempts"   db:"attempts"`
+	NextAt    time.Time `json:"next_at"    db:"next_at"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Delivery records an attempt to deliver a webhook.
+type Delivery struct {
+	ID        int64     `json:"id"         db:"id"`
+	WebhookID int64     `json:"webhook_id" db:"webhook_id"`
+	Event     string    `json:"event"      db:"event"`
+	Alias     string    `json:"alias"      db:"alias"`
+	URL       string    `json:"url"        db:"url"`
+	Attempt   int       `json:"attempt"    db:"attempt"`
+	Status    int       `json:"status"     db:"status"` // 0 if no response is received
+	Error     string    `json:"error"      db:"error"`
+	Latency   int64     `json:"latency"    db:"latency"` // in milliseconds
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
 // Record contains a record of alias's UV/PV
 type Record struct {
 	Alias string `json:"alias"`
@@ -63,15 +294,59 @@ type RedirAliasDataModel interface {
 	UpdateAlias(ctx context.Context, red *Redirect) error
 	DeleteAlias(ctx context.Context, alias string) error
 	FetchAlias(ctx context.Context, alias string) (*Redirect, error)
+	FetchAliases(ctx context.Context) ([]*Redirect, error)
+	ConsumeVisit(ctx context.Context, alias string) (bool, error)
 }
 
 type RedirVisitDataModel interface {
 	RecordVisit(context.Context, *Visit) error
+	RecordVisits(context.Context, []*Visit) error
+	DeleteVisits(ctx context.Context, before time.Time) (int64, error)
+	AnonymizeVisits(ctx context.Context, before time.Time, anonymize func(ip string) string) (int64, error)
+}
+
+// RedirRollupModel aggregates the raw visits into daily rollups.
+type RedirRollupModel interface {
+	RolledUntil(ctx context.Context) (time.Time, error)
+	RollupVisits(ctx context.Context, now time.Time, top int) (int, error)
+	DeleteRolledVisits(ctx context.Context, before time.Time) (int64, error)
+}
+
+// RedirSaltModel manages the daily salts to hash visitor IPs.
+type RedirSaltModel interface {
+	FetchSalt(ctx context.Context, day string, salt string) (string, error)
+	DeleteSalts(ctx context.Context, before string) error
 }
 
 type RedirStatModel interface {
-	CountReferer(ctx context.Context, alias string, start, end time.Time) ([]Refstat, error)
-	CountUA(ctx context.Context, alias string, start, end time.Time) ([]UAstat, error)
-	CountVisitHist(ctx context.Context, alias string, start, end time.Time) ([]Timehist, error)
-	CountVisit(context.Context) (rs []Record, err error)
+	CountReferer(ctx context.Context, alias string, start, end time.Time, f Filter) ([]Refstat, error)
+	CountRefererHost(ctx context.Context, alias string, start, end time.Time, path bool, f Filter) ([]Refstat, error)
+	CountChannel(ctx context.Context, alias string, start, end time.Time, f Filter) ([]Channelstat, error)
+	CountUA(ctx context.Context, alias string, start, end time.Time, f Filter) ([]UAstat, error)
+	CountVisitHist(ctx context.Context, alias string, start, end time.Time, f Filter) ([]Timehist, error)
+	CountVariant(ctx context.Context, alias string, start, end time.Time, f Filter) ([]Variantstat, error)
+	CountCountry(ctx context.Context, alias string, start, end time.Time, f Filter) ([]Countrystat, error)
+	CountBrowser(ctx context.Context, alias string, start, end time.Time, f Filter) ([]Browserstat, error)
+	CountOS(ctx context.Context, alias string, start, end time.Time, f Filter) ([]OSstat, error)
+	CountDevice(ctx context.Context, alias string, start, end time.Time, f Filter) ([]Devicestat, error)
+	CountVisit(ctx context.Context, f Filter) (rs []Record, err error)
+	StreamVisits(ctx context.Context, alias string, start, end time.Time, f Filter, fn func(*Visit) error) error
+	StreamDaily(ctx context.Context, alias string, start, end time.Time, f Filter, fn func(*Daystat) error) error
+	CountAliasVisit(ctx context.Context, alias string, f Filter) (*Record, error)
+	CountAliasRange(ctx context.Context, alias string, start, end time.Time, f Filter) (*Rangestat, error)
+}
+
+type RedirHealthModel interface {
+	RecordHealth(context.Context, *Health) error
+	FetchBrokenLinks(context.Context) ([]Health, error)
+}
+
+// RedirWebhookModel stores the outbox and the delivery log of webhooks.
+type RedirWebhookModel interface {
+	EnqueueWebhooks(ctx context.Context, ws []*Webhook) error
+	FetchDueWebhooks(ctx context.Context, now time.Time, limit int) ([]*Webhook, error)
+	RecordDelivery(ctx context.Context, w *Webhook, d *Delivery) error
+	FetchDeliveries(ctx context.Context, limit int) ([]Delivery, error)
+	ReachMilestones(ctx context.Context, alias string, milestones []int64) ([]int64, error)
+	CountPV(ctx context.Context, aliases []string, f Filter) (map[string]int64, error)
 }
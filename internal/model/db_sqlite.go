@@ -10,12 +10,21 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
+	"golang.design/x/redir/internal/hll"
+	"golang.design/x/redir/internal/referer"
+	"golang.design/x/redir/internal/ua"
 )
 
+// redirectColumns are the columns of a collink row that are read into
+// a Redirect.
+const redirectColumns = `alias, url, owner, description, interstitial, password, max_visits, visits, signed, variants, sticky, rules, created_at`
+
 // Store is persistent storage that provides a group of operations
 // to interact with the underlying database.
 type Store struct {
@@ -24,7 +33,8 @@ type Store struct {
 
 // NewDB parses a given DSN and returns a DB instance for
 // further operations. It returns an error if the database
-// instance is not able to connect.
+// instance is not able to connect. The tables of a database
+// created from an earlier schema are upgraded in place.
 func NewDB(dsn string) (*Store, error) {
 	db, err := sqlx.Open("sqlite3", dsn)
 	if err != nil {
@@ -33,7 +43,13 @@ func NewDB(dsn string) (*Store, error) {
 	}
 	db.SetMaxOpenConns(120)
 	db.SetMaxIdleConns(50)
-	return &Store{sqlxDB: db}, nil
+	s := &Store{sqlxDB: db}
+	err = s.upgrade()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to upgrade database: %w", err)
+	}
+	return s, nil
 }
 
 func (db Store) Close() (err error) {
@@ -48,9 +64,9 @@ func (db Store) Close() (err error) {
 func (db Store) StoreAlias(ctx context.Context, r *Redirect) error {
 	now := time.Now().UTC()
 	query, args, err := sqlx.In(`
-INSERT INTO collink (alias, url, created_at, updated_at)
-VALUES(?, ?, ?, ?)
-`, r.Alias, r.URL, now, now)
+INSERT INTO collink (alias, url, owner, description, interstitial, password, max_visits, signed, variants, sticky, rules, created_at, updated_at)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`, r.Alias, r.URL, r.Owner, r.Description, r.Interstitial, r.Password, r.MaxVisits, r.Signed, r.Variants, r.Sticky, r.Rules, now, now)
 	if err != nil {
 		return err
 	}
@@ -63,7 +79,11 @@ VALUES(?, ?, ?, ?)
 
 // UpdateAlias updates the link of a given alias
 func (db Store) UpdateAlias(ctx context.Context, red *Redirect) error {
-	query, args, err := sqlx.In(`UPDATE collink SET url=? WHERE alias=?`, red.URL, red.Alias)
+	query, args, err := sqlx.In(`
+UPDATE collink
+SET url=?, owner=?, description=?, interstitial=?, password=?, max_visits=?, signed=?, variants=?, sticky=?, rules=?, updated_at=?
+WHERE alias=?
+`, red.URL, red.Owner, red.Description, red.Interstitial, red.Password, red.MaxVisits, red.Signed, red.Variants, red.Sticky, red.Rules, time.Now().UTC(), red.Alias)
 	if err != nil {
 		return err
 	}
@@ -74,62 +94,187 @@ func (db Store) UpdateAlias(ctx context.Context, red *Redirect) error {
 	return nil
 }
 
+// aliasTables are the tables whose rows of an alias are deleted together
+// with the alias.
+var aliasTables = []string{"collink", "visit", "health", "visit_daily", "visit_daily_referer", "visit_daily_ua", "visit_daily_dim", "visit_hll", "visit_hll_total", "webhook_milestone"}
+
 // DeleteAlias deletes a given short alias if exists
 func (db Store) DeleteAlias(ctx context.Context, a string) error {
 	tx, err := db.sqlxDB.Begin()
 	if err != nil {
 		return err
 	}
-	query, args, err := sqlx.In(`DELETE FROM collink WHERE alias=?`, a)
+	for _, table := range aliasTables {
+		query, args, err := sqlx.In(`DELETE FROM `+table+` WHERE alias=?`, a)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
 	if err != nil {
 		return err
 	}
-	_, err = tx.ExecContext(ctx, query, args...)
+	return nil
+}
+
+// FetchAlias reads a given alias and returns the associated link
+func (db Store) FetchAlias(ctx context.Context, a string) (*Redirect, error) {
+	query, args, err := sqlx.In(`SELECT `+redirectColumns+` FROM collink WHERE alias=?`, a)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	red := []*Redirect{}
+	err = db.sqlxDB.SelectContext(ctx, &red, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(red) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return red[0], nil
+}
 
-	query, args, err = sqlx.In(`DELETE FROM visit WHERE alias=?`, a)
+// FetchAliases reads all stored aliases and their associated links
+func (db Store) FetchAliases(ctx context.Context) ([]*Redirect, error) {
+	red := []*Redirect{}
+	err := db.sqlxDB.SelectContext(ctx, &red, `SELECT `+redirectColumns+` FROM collink ORDER BY alias`)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return red, nil
+}
+
+// ConsumeVisit consumes one visit of a given alias that has a limited
+// number of visits. It reports false if all visits have been consumed.
+// The check and the consumption happen in a single statement so that
+// concurrent visits cannot consume the last visit twice.
+func (db Store) ConsumeVisit(ctx context.Context, a string) (bool, error) {
+	query, args, err := sqlx.In(`
+UPDATE collink
+SET visits = visits + 1
+WHERE alias=?
+  AND (max_visits = 0 OR visits < max_visits)
+`, a)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.sqlxDB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
 	}
-	_, err = tx.ExecContext(ctx, query, args...)
+	return n == 1, nil
+}
+
+// RecordHealth records the latest health check result of an alias
+func (db Store) RecordHealth(ctx context.Context, h *Health) error {
+	query, args, err := sqlx.In(`
+REPLACE INTO health (alias, url, status, latency, checked_at)
+VALUES(?, ?, ?, ?, ?)
+`, h.Alias, h.URL, h.Status, h.Latency, h.CheckedAt)
 	if err != nil {
 		return err
 	}
-	err = tx.Commit()
+	_, err = db.sqlxDB.ExecContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// FetchAlias reads a given alias and returns the associated link
-func (db Store) FetchAlias(ctx context.Context, a string) (*Redirect, error) {
-	query, args, err := sqlx.In(`SELECT alias, url FROM collink WHERE alias=?`, a)
+// FetchBrokenLinks reads all aliases whose latest health check failed,
+// with the links that are broken, or the links of the aliases if the
+// checks did not record them. Protected and signed aliases are left out
+// since their targets must not be listed on the public stats page.
+func (db Store) FetchBrokenLinks(ctx context.Context) ([]Health, error) {
+	hs := []Health{}
+	err := db.sqlxDB.SelectContext(ctx, &hs, `
+SELECT health.alias, COALESCE(NULLIF(health.url, ''), collink.url) AS url, status, latency, checked_at
+FROM health
+JOIN collink ON collink.alias = health.alias
+WHERE (status = 0 OR status >= 400)
+  AND collink.password = '' AND collink.signed = 0
+ORDER BY health.alias
+`)
 	if err != nil {
 		return nil, err
 	}
-	red := []*Redirect{}
-	err = db.sqlxDB.SelectContext(ctx, &red, query, args...)
+	return hs, nil
+}
+
+// where returns the conditions and the arguments of the filter.
+func (f Filter) where() (string, []interface{}) {
+	cond, args := f.rolledWhere(), []interface{}{}
+	if f.Variant != "" {
+		cond += `
+  AND variant=?`
+		args = append(args, f.Variant)
+	}
+	return cond, args
+}
+
+// rolledWhere returns the conditions of the filter on the daily rollups.
+func (f Filter) rolledWhere() string {
+	if f.Bots {
+		return ""
+	}
+	return `
+  AND bot=0`
+}
+
+// raw reports whether the filter can only be applied to the raw visits.
+func (f Filter) raw() bool {
+	return f.Variant != ""
+}
+
+// CountReferer fetches and counts all referers of a given alias. The
+// referers of the rolled-up days are only the top referers of each day.
+func (db Store) CountReferer(ctx context.Context, a string, start, end time.Time, f Filter) ([]Refstat, error) {
+	rawStart, rolled, err := db.splitRange(ctx, start, end, f)
 	if err != nil {
 		return nil, err
 	}
-	if len(red) == 0 {
-		return nil, sql.ErrNoRows
+
+	counts := map[string]int64{}
+	if rolled != nil {
+		query, args, err := sqlx.In(`
+SELECT referer, SUM(count) AS count
+FROM visit_daily_referer
+WHERE alias=?
+  AND day >= ? AND day <= ? AND day < ?`+f.rolledWhere()+`
+GROUP BY referer
+`, a, rolled.start, end, rolled.end)
+		if err != nil {
+			return nil, err
+		}
+		ref := []Refstat{}
+		err = db.sqlxDB.SelectContext(ctx, &ref, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range ref {
+			counts[r.Referer] += r.Count
+		}
 	}
-	return red[0], nil
-}
 
-// CountReferer fetches and counts all referers of a given alias
-func (db Store) CountReferer(ctx context.Context, a string, start, end time.Time) ([]Refstat, error) {
+	cond, cargs := f.where()
 	query, args, err := sqlx.In(`
 SELECT IFNULL(referer, 'NULL') AS referer, COUNT(*) AS count
 FROM visit
 WHERE alias=?
-  AND created_at BETWEEN ? AND ?
+  AND created_at BETWEEN ? AND ?`+cond+`
 GROUP BY referer
-`, a, start, end)
+ORDER BY count DESC, referer
+`, append([]interface{}{a, rawStart, end}, cargs...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -138,18 +283,96 @@ GROUP BY referer
 	if err != nil {
 		return nil, err
 	}
+	if rolled == nil {
+		return ref, nil
+	}
+	for _, r := range ref {
+		counts[r.Referer] += r.Count
+	}
+	ref = ref[:0]
+	for k, v := range counts {
+		ref = append(ref, Refstat{Referer: k, Count: v})
+	}
+	sort.Slice(ref, func(i, j int) bool {
+		if ref[i].Count != ref[j].Count {
+			return ref[i].Count > ref[j].Count
+		}
+		return ref[i].Referer < ref[j].Referer
+	})
+	return ref, nil
+}
+
+// CountRefererHost counts the visits of each referer host of a given
+// alias, or of each referer host and path if path is true. The visits
+// without a referer are counted as an empty referer. The rolled-up days
+// only have the top hosts and paths of each day.
+func (db Store) CountRefererHost(ctx context.Context, a string, start, end time.Time, path bool, f Filter) ([]Refstat, error) {
+	dim := "referer_host"
+	if path {
+		dim = "referer_path"
+	}
+	cs, err := db.countDim(ctx, a, start, end, f, dim)
+	if err != nil {
+		return nil, err
+	}
+	ref := make([]Refstat, 0, len(cs))
+	for _, c := range cs {
+		ref = append(ref, Refstat{Referer: c.Key, Count: c.Count})
+	}
 	return ref, nil
 }
 
-// CountUA fetches and counts all uas of a given alias
-func (db Store) CountUA(ctx context.Context, a string, start, end time.Time) ([]UAstat, error) {
+// CountChannel counts the visits of each channel of a given alias.
+func (db Store) CountChannel(ctx context.Context, a string, start, end time.Time, f Filter) ([]Channelstat, error) {
+	cs, err := db.countDim(ctx, a, start, end, f, "channel")
+	if err != nil {
+		return nil, err
+	}
+	chs := make([]Channelstat, 0, len(cs))
+	for _, c := range cs {
+		chs = append(chs, Channelstat{Channel: c.Key, Count: c.Count})
+	}
+	return chs, nil
+}
+
+// CountUA counts the visits of each user agent family of a given alias.
+// The rolled-up days only have the top families of each day.
+func (db Store) CountUA(ctx context.Context, a string, start, end time.Time, f Filter) ([]UAstat, error) {
+	rawStart, rolled, err := db.splitRange(ctx, start, end, f)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int64{}
+	if rolled != nil {
+		query, args, err := sqlx.In(`
+SELECT family AS ua, SUM(count) AS count
+FROM visit_daily_ua
+WHERE alias=?
+  AND day >= ? AND day <= ? AND day < ?`+f.rolledWhere()+`
+GROUP BY family
+`, a, rolled.start, end, rolled.end)
+		if err != nil {
+			return nil, err
+		}
+		uas := []UAstat{}
+		err = db.sqlxDB.SelectContext(ctx, &uas, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range uas {
+			counts[u.UA] += u.Count
+		}
+	}
+
+	cond, cargs := f.where()
 	query, args, err := sqlx.In(`
-SELECT IFNULL(ua, 'NULL') AS ua, COUNT(*) AS count
+SELECT IFNULL(ua, '') AS ua, COUNT(*) AS count
 FROM visit
 WHERE alias=?
-  AND created_at BETWEEN ? AND ?
+  AND created_at BETWEEN ? AND ?`+cond+`
 GROUP BY ua
-`, a, start, end)
+`, append([]interface{}{a, rawStart, end}, cargs...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -158,36 +381,639 @@ GROUP BY ua
 	if err != nil {
 		return nil, err
 	}
+	// the raw user agents are grouped by their families as the rollups.
+	for _, u := range ref {
+		counts[ua.Family(u.UA)] += u.Count
+	}
+	ref = ref[:0]
+	for k, v := range counts {
+		ref = append(ref, UAstat{UA: k, Count: v})
+	}
+	sort.Slice(ref, func(i, j int) bool {
+		if ref[i].Count != ref[j].Count {
+			return ref[i].Count > ref[j].Count
+		}
+		return ref[i].UA < ref[j].UA
+	})
 	return ref, nil
 }
 
-// CountVisitHist counts the recorded history every an hour from Visit history.
-func (db Store) CountVisitHist(ctx context.Context, a string, start, end time.Time) ([]Timehist, error) {
+// CountVisitHist counts the visits of a given alias in each minute. The
+// rolled-up days are counted once per day at their start, i.e. at the
+// midnight (UTC) of the day.
+func (db Store) CountVisitHist(ctx context.Context, a string, start, end time.Time, f Filter) ([]Timehist, error) {
+	rawStart, rolled, err := db.splitRange(ctx, start, end, f)
+	if err != nil {
+		return nil, err
+	}
+
+	timehists := []Timehist{}
+	if rolled != nil {
+		query, args, err := sqlx.In(`
+SELECT day AS time, SUM(pv) AS count
+FROM visit_daily
+WHERE alias=?
+  AND day >= ? AND day <= ? AND day < ?`+f.rolledWhere()+`
+GROUP BY day
+ORDER BY day
+`, a, rolled.start, end, rolled.end)
+		if err != nil {
+			return nil, err
+		}
+		err = db.sqlxDB.SelectContext(ctx, &timehists, query, args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cond, cargs := f.where()
 	query, args, err := sqlx.In(`
-SELECT created_at AS time, COUNT(1) AS count
+SELECT CAST(strftime('%s', created_at) AS INTEGER) / 60 AS minute, COUNT(1) AS count
 FROM visit
 WHERE alias=?
-  AND created_at BETWEEN ? AND ?
-GROUP BY time
-ORDER BY time
-`, a, start, end)
+  AND created_at BETWEEN ? AND ?`+cond+`
+GROUP BY minute
+ORDER BY minute
+`, append([]interface{}{a, rawStart, end}, cargs...)...)
 	if err != nil {
 		return nil, err
 	}
-	timehists := []Timehist{}
-	err = db.sqlxDB.SelectContext(ctx, &timehists, query, args...)
+	raw := []struct {
+		Minute int64 `db:"minute"`
+		Count  int   `db:"count"`
+	}{}
+	err = db.sqlxDB.SelectContext(ctx, &raw, query, args...)
 	if err != nil {
 		return nil, err
 	}
+	for _, h := range raw {
+		timehists = append(timehists, Timehist{Time: time.Unix(h.Minute*60, 0).UTC(), Count: h.Count})
+	}
 	return timehists, nil
 }
 
+// CountVariant counts the visits of each variant of a given alias. The
+// UV of the rolled-up days is the sum of the UV of each day.
+func (db Store) CountVariant(ctx context.Context, a string, start, end time.Time, f Filter) ([]Variantstat, error) {
+	cs, err := db.countDim(ctx, a, start, end, f, "variant")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Key < cs[j].Key })
+	vs := make([]Variantstat, 0, len(cs))
+	for _, c := range cs {
+		vs = append(vs, Variantstat{Variant: c.Key, PV: c.Count, UV: c.UV})
+	}
+	return vs, nil
+}
+
+// CountCountry counts the visits of each country of a given alias
+func (db Store) CountCountry(ctx context.Context, a string, start, end time.Time, f Filter) ([]Countrystat, error) {
+	cs, err := db.countDim(ctx, a, start, end, f, "country")
+	if err != nil {
+		return nil, err
+	}
+	countries := make([]Countrystat, 0, len(cs))
+	for _, c := range cs {
+		countries = append(countries, Countrystat{Country: c.Key, Count: c.Count})
+	}
+	return countries, nil
+}
+
+// CountBrowser counts the visits of each major version of each browser
+// of a given alias.
+func (db Store) CountBrowser(ctx context.Context, a string, start, end time.Time, f Filter) ([]Browserstat, error) {
+	cs, err := db.countDim(ctx, a, start, end, f, "browser")
+	if err != nil {
+		return nil, err
+	}
+	bs := make([]Browserstat, 0, len(cs))
+	for _, c := range cs {
+		// the key joins the browser, which has no slash, and its version.
+		b := Browserstat{Browser: c.Key, Count: c.Count}
+		if i := strings.Index(c.Key, "/"); i >= 0 {
+			b.Browser, b.Version = c.Key[:i], c.Key[i+1:]
+		}
+		bs = append(bs, b)
+	}
+	return bs, nil
+}
+
+// CountOS counts the visits of each operating system of a given alias.
+func (db Store) CountOS(ctx context.Context, a string, start, end time.Time, f Filter) ([]OSstat, error) {
+	cs, err := db.countDim(ctx, a, start, end, f, "os")
+	if err != nil {
+		return nil, err
+	}
+	oss := make([]OSstat, 0, len(cs))
+	for _, c := range cs {
+		oss = append(oss, OSstat{OS: c.Key, Count: c.Count})
+	}
+	return oss, nil
+}
+
+// CountDevice counts the visits of each device type of a given alias.
+func (db Store) CountDevice(ctx context.Context, a string, start, end time.Time, f Filter) ([]Devicestat, error) {
+	cs, err := db.countDim(ctx, a, start, end, f, "device")
+	if err != nil {
+		return nil, err
+	}
+	ds := make([]Devicestat, 0, len(cs))
+	for _, c := range cs {
+		ds = append(ds, Devicestat{Device: c.Key, Count: c.Count})
+	}
+	return ds, nil
+}
+
+// dimensions are the dimensions of the visits that are rolled up into
+// the visit_daily_dim table besides the referers and user agents, which
+// have their own daily tables, with the expressions of their keys in the
+// raw visits. The key of a browser joins it and its major version.
+var dimensions = map[string]string{
+	"referer_host": "referer_host",
+	"referer_path": "referer_path",
+	"channel":      "channel",
+	"variant":      "variant",
+	"country":      "country",
+	"browser":      "browser || '/' || browser_version",
+	"os":           "os",
+	"device":       "device",
+}
+
+// topDimensions are the dimensions of which only the top keys of each
+// alias and day are rolled up.
+var topDimensions = map[string]bool{"referer_host": true, "referer_path": true}
+
+// dimCount counts the visits of a key of a dimension.
+type dimCount struct {
+	Alias string `db:"alias"`
+	Bot   bool   `db:"bot"`
+	Key   string `db:"k"`
+	Count int64  `db:"count"`
+	UV    int64  `db:"uv"`
+}
+
+// countDim counts the visits of each key of a given dimension of an
+// alias from the daily rollups of the rolled-up days and from the raw
+// visits after them, sorted by count and key.
+func (db Store) countDim(ctx context.Context, a string, start, end time.Time, f Filter, dim string) ([]dimCount, error) {
+	rawStart, rolled, err := db.splitRange(ctx, start, end, f)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]*dimCount{}
+	add := func(cs []dimCount) {
+		for _, c := range cs {
+			if counts[c.Key] == nil {
+				counts[c.Key] = &dimCount{Key: c.Key}
+			}
+			counts[c.Key].Count += c.Count
+			counts[c.Key].UV += c.UV
+		}
+	}
+	if rolled != nil {
+		query, args, err := sqlx.In(`
+SELECT k, SUM(count) AS count, SUM(uv) AS uv
+FROM visit_daily_dim
+WHERE alias=? AND dim=?
+  AND day >= ? AND day <= ? AND day < ?`+f.rolledWhere()+`
+GROUP BY k
+`, a, dim, rolled.start, end, rolled.end)
+		if err != nil {
+			return nil, err
+		}
+		cs := []dimCount{}
+		err = db.sqlxDB.SelectContext(ctx, &cs, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		add(cs)
+	}
+
+	cond, cargs := f.where()
+	query, args, err := sqlx.In(`
+SELECT `+dimensions[dim]+` AS k, COUNT(*) AS count, COUNT(DISTINCT ip) AS uv
+FROM visit
+WHERE alias=?
+  AND created_at BETWEEN ? AND ?`+cond+`
+GROUP BY k
+`, append([]interface{}{a, rawStart, end}, cargs...)...)
+	if err != nil {
+		return nil, err
+	}
+	cs := []dimCount{}
+	err = db.sqlxDB.SelectContext(ctx, &cs, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	add(cs)
+
+	cs = cs[:0]
+	for _, c := range counts {
+		cs = append(cs, *c)
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].Count != cs[j].Count {
+			return cs[i].Count > cs[j].Count
+		}
+		return cs[i].Key < cs[j].Key
+	})
+	return cs, nil
+}
+
+// parse fills the parsed user agent and referer of the visit if they are
+// not parsed.
+func (v *Visit) parse() {
+	if v.Browser == "" {
+		a := ua.Parse(v.UA)
+		v.Browser, v.BrowserVersion, v.OS, v.Device = a.Browser, a.Version, a.OS, a.Device
+	}
+	if v.RefererHost == "" && v.RefererPath == "" {
+		v.RefererHost, v.RefererPath = referer.Host(v.Referer), referer.Path(v.Referer)
+	}
+	if v.Channel == "" {
+		v.Channel = referer.Channel(v.Referer)
+	}
+}
+
+// visitColumns are the columns of a recorded visit in the order of the
+// values of visitValues.
+const visitColumns = `alias, ip, ua, referer, variant, country, bot, browser, browser_version, os, device, referer_host, referer_path, channel, created_at`
+
+func visitValues(v *Visit) []interface{} {
+	return []interface{}{
+		v.Alias, v.IP, v.UA, v.Referer, v.Variant, v.Country, v.Bot,
+		v.Browser, v.BrowserVersion, v.OS, v.Device,
+		v.RefererHost, v.RefererPath, v.Channel, v.Time,
+	}
+}
+
+// visitPlaceholders are the placeholders of the values of a visit.
+var visitPlaceholders = `(?` + strings.Repeat(`, ?`, strings.Count(visitColumns, ",")) + `)`
+
 // RecordVisit record a given visit data
 func (db Store) RecordVisit(ctx context.Context, v *Visit) error {
+	return db.RecordVisits(ctx, []*Visit{v})
+}
+
+// visitBatchRows is the maximum number of visits inserted by one
+// statement, so that the number of placeholders stays below the default
+// limit of 999 of SQLite.
+var visitBatchRows = 999 / (strings.Count(visitColumns, ",") + 1)
+
+// RecordVisits records the given visits in one transaction with
+// multi-row inserts, and adds them to the sketches of unique visitors.
+func (db Store) RecordVisits(ctx context.Context, vs []*Visit) error {
+	if len(vs) == 0 {
+		return nil
+	}
+	tx, err := db.sqlxDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(vs); i += visitBatchRows {
+		batch := vs[i:]
+		if len(batch) > visitBatchRows {
+			batch = batch[:visitBatchRows]
+		}
+		b := strings.Builder{}
+		b.WriteString(`INSERT INTO visit (` + visitColumns + `) VALUES`)
+		args := []interface{}{}
+		for j, v := range batch {
+			if j > 0 {
+				b.WriteString(",")
+			}
+			v.parse()
+			b.WriteString(` ` + visitPlaceholders)
+			args = append(args, visitValues(v)...)
+		}
+		_, err = tx.ExecContext(ctx, tx.Rebind(b.String()), args...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// the sketches are read after the visits are inserted, so that the
+	// transaction already holds the write lock while it reads them.
+	err = addSketches(ctx, tx, vs)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sketchKey identifies the sketch of the unique visitors of an alias on
+// a day, or on all days if the day is zero.
+type sketchKey struct {
+	alias string
+	day   time.Time
+	bot   bool
+}
+
+// addSketches adds the IPs of the given visits to the daily and total
+// sketches of their aliases. Adding a visit again does not change the
+// sketches.
+func addSketches(ctx context.Context, tx *sqlx.Tx, vs []*Visit) error {
+	ips := map[sketchKey][]string{}
+	for _, v := range vs {
+		for _, k := range []sketchKey{{v.Alias, day(v.Time), v.Bot}, {v.Alias, time.Time{}, v.Bot}} {
+			ips[k] = append(ips[k], v.IP)
+		}
+	}
+	for k, ips := range ips {
+		table, cols, where := `visit_hll`, `alias, day, bot`, `alias=? AND day=? AND bot=?`
+		args := []interface{}{k.alias, k.day, k.bot}
+		if k.day.IsZero() {
+			table, cols, where = `visit_hll_total`, `alias, bot`, `alias=? AND bot=?`
+			args = []interface{}{k.alias, k.bot}
+		}
+		bs := [][]byte{}
+		err := tx.SelectContext(ctx, &bs, tx.Rebind(`SELECT sketch FROM `+table+` WHERE `+where), args...)
+		if err != nil {
+			return err
+		}
+		s := hll.New()
+		if len(bs) > 0 {
+			err = s.UnmarshalBinary(bs[0])
+			if err != nil {
+				return err
+			}
+		}
+		for _, ip := range ips {
+			s.Add(ip)
+		}
+		b, err := s.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, tx.Rebind(`REPLACE INTO `+table+` (`+cols+`, sketch) VALUES (?`+strings.Repeat(`, ?`, len(args))+`)`), append(args, b)...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeSketches merges the encoded sketches into a sketch.
+func mergeSketches(bs [][]byte) (*hll.Sketch, error) {
+	s := hll.New()
+	for _, b := range bs {
+		o := hll.New()
+		err := o.UnmarshalBinary(b)
+		if err != nil {
+			return nil, err
+		}
+		s.Merge(o)
+	}
+	return s, nil
+}
+
+// exactRange is the longest time range whose UV is counted exactly from
+// the raw visits rather than estimated from the sketches.
+const exactRange = 24 * time.Hour
+
+// estimateUV estimates the UV of a given alias from start to end. It
+// merges the daily sketches of the complete days in between, and adds the
+// IPs of the raw visits of the incomplete days at both ends. The rolled-up
+// days without sketches add the sum of their UV.
+func (db Store) estimateUV(ctx context.Context, a string, start, end time.Time, f Filter) (int64, error) {
+	// the days from first to before last are complete.
+	first, last := day(start), day(end)
+	if first.Before(start) {
+		first = first.AddDate(0, 0, 1)
+	}
+	if !first.Before(last) {
+		first, last = end, end
+	}
+
 	query, args, err := sqlx.In(`
-INSERT INTO visit (alias, ip, ua, referer, created_at)
-VALUES(?, ?, ?, ?, ?)
-`, v.Alias, v.IP, v.UA, v.Referer, v.Time)
+SELECT sketch
+FROM visit_hll
+WHERE alias=?
+  AND day >= ? AND day < ?`+f.rolledWhere()+`
+`, a, first, last)
+	if err != nil {
+		return 0, err
+	}
+	bs := [][]byte{}
+	err = db.sqlxDB.SelectContext(ctx, &bs, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	s, err := mergeSketches(bs)
+	if err != nil {
+		return 0, err
+	}
+
+	cond, cargs := f.where()
+	query, args, err = sqlx.In(`
+SELECT DISTINCT ip
+FROM visit
+WHERE alias=?
+  AND ip IS NOT NULL
+  AND (created_at >= ? AND created_at < ? OR created_at >= ? AND created_at <= ?)`+cond+`
+`, append([]interface{}{a, start, first, last, end}, cargs...)...)
+	if err != nil {
+		return 0, err
+	}
+	ips := []string{}
+	err = db.sqlxDB.SelectContext(ctx, &ips, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	for _, ip := range ips {
+		s.Add(ip)
+	}
+
+	query, args, err = sqlx.In(`
+SELECT IFNULL(SUM(uv), 0)
+FROM visit_daily d
+WHERE alias=?
+  AND day >= ? AND day < ?`+f.rolledWhere()+`
+  AND NOT EXISTS (
+    SELECT 1 FROM visit_hll h WHERE h.alias=d.alias AND h.day=d.day AND h.bot=d.bot
+  )
+`, a, first, last)
+	if err != nil {
+		return 0, err
+	}
+	var uv int64
+	err = db.sqlxDB.GetContext(ctx, &uv, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return int64(s.Estimate()) + uv, nil
+}
+
+// totalUV estimates the UV of all visits of each alias, or of a given
+// alias if a is not empty, from the total sketches. The rolled-up days
+// without sketches add the sum of their UV.
+func (db Store) totalUV(ctx context.Context, a string, f Filter) (map[string]int64, error) {
+	cond, args := f.rolledWhere(), []interface{}{}
+	if a != "" {
+		cond += `
+  AND alias=?`
+		args = append(args, a)
+	}
+	query, qargs, err := sqlx.In(`
+SELECT alias, sketch
+FROM visit_hll_total
+WHERE 1=1`+cond+`
+`, args...)
+	if err != nil {
+		return nil, err
+	}
+	rows := []struct {
+		Alias  string `db:"alias"`
+		Sketch []byte `db:"sketch"`
+	}{}
+	err = db.sqlxDB.SelectContext(ctx, &rows, query, qargs...)
+	if err != nil {
+		return nil, err
+	}
+	sketches := map[string][][]byte{}
+	for _, r := range rows {
+		sketches[r.Alias] = append(sketches[r.Alias], r.Sketch)
+	}
+	uvs := map[string]int64{}
+	for alias, bs := range sketches {
+		s, err := mergeSketches(bs)
+		if err != nil {
+			return nil, err
+		}
+		uvs[alias] = int64(s.Estimate())
+	}
+
+	query, qargs, err = sqlx.In(`
+SELECT alias, SUM(uv) uv
+FROM visit_daily d
+WHERE NOT EXISTS (
+    SELECT 1 FROM visit_hll h WHERE h.alias=d.alias AND h.day=d.day AND h.bot=d.bot
+)`+cond+`
+GROUP BY alias
+`, args...)
+	if err != nil {
+		return nil, err
+	}
+	rs := []Record{}
+	err = db.sqlxDB.SelectContext(ctx, &rs, query, qargs...)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rs {
+		uvs[r.Alias] += r.UV
+	}
+	return uvs, nil
+}
+
+// DeleteVisits deletes the visits before the given time, and returns the
+// number of deleted visits.
+func (db Store) DeleteVisits(ctx context.Context, before time.Time) (int64, error) {
+	query, args, err := sqlx.In(`DELETE FROM visit WHERE created_at < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.sqlxDB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// anonymizeBatch is the number of visits that are anonymized in one
+// transaction.
+const anonymizeBatch = 500
+
+// AnonymizeVisits replaces the IPs of the visits before the given time
+// by the given anonymize function, and clears their user agents. It
+// returns the number of anonymized visits.
+func (db Store) AnonymizeVisits(ctx context.Context, before time.Time, anonymize func(ip string) string) (int64, error) {
+	var total int64
+	for {
+		query, args, err := sqlx.In(`
+SELECT id, IFNULL(ip, '') AS ip
+FROM visit
+WHERE anonymized=0
+  AND created_at < ?
+LIMIT ?
+`, before, anonymizeBatch)
+		if err != nil {
+			return total, err
+		}
+		rows := []struct {
+			ID int64  `db:"id"`
+			IP string `db:"ip"`
+		}{}
+		err = db.sqlxDB.SelectContext(ctx, &rows, query, args...)
+		if err != nil {
+			return total, err
+		}
+		if len(rows) == 0 {
+			return total, nil
+		}
+
+		tx, err := db.sqlxDB.BeginTxx(ctx, nil)
+		if err != nil {
+			return total, err
+		}
+		for _, r := range rows {
+			_, err = tx.ExecContext(ctx, `UPDATE visit SET ip=?, ua='', anonymized=1 WHERE id=?`, anonymize(r.IP), r.ID)
+			if err != nil {
+				tx.Rollback()
+				return total, err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return total, err
+		}
+		total += int64(len(rows))
+	}
+}
+
+// FetchSalt returns the salt of the given day. If the day has no salt
+// yet, the given salt is stored and returned, unless another salt was
+// stored concurrently.
+func (db Store) FetchSalt(ctx context.Context, day string, salt string) (string, error) {
+	s, err := db.fetchSalt(ctx, day)
+	if err != nil || s != "" {
+		return s, err
+	}
+	query, args, err := sqlx.In(`INSERT INTO salt (day, salt) VALUES(?, ?)`, day, salt)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.sqlxDB.ExecContext(ctx, query, args...)
+	if err != nil {
+		// the salt may be stored concurrently, read it again.
+		s, err2 := db.fetchSalt(ctx, day)
+		if err2 != nil || s == "" {
+			return "", err
+		}
+		return s, nil
+	}
+	return salt, nil
+}
+
+func (db Store) fetchSalt(ctx context.Context, day string) (string, error) {
+	query, args, err := sqlx.In(`SELECT salt FROM salt WHERE day=?`, day)
+	if err != nil {
+		return "", err
+	}
+	s := []string{}
+	err = db.sqlxDB.SelectContext(ctx, &s, query, args...)
+	if err != nil || len(s) == 0 {
+		return "", err
+	}
+	return s[0], nil
+}
+
+// DeleteSalts deletes the salts of the days before the given day, so
+// that the hashed IPs of these days can no longer be linked to any IP.
+func (db Store) DeleteSalts(ctx context.Context, before string) error {
+	query, args, err := sqlx.In(`DELETE FROM salt WHERE day < ?`, before)
 	if err != nil {
 		return err
 	}
@@ -198,16 +1024,31 @@ VALUES(?, ?, ?, ?, ?)
 	return nil
 }
 
-// CountVisit count visit by AliasKind
-func (db Store) CountVisit(ctx context.Context) ([]Record, error) {
+// CountVisit count visit by AliasKind. The UV is estimated from the
+// sketches of unique visitors unless the filter requires the raw visits.
+func (db Store) CountVisit(ctx context.Context, f Filter) ([]Record, error) {
+	until, err := db.rawSince(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	cond, cargs := f.where()
 	query, args, err := sqlx.In(`
-SELECT alias,
-       COUNT(*) pv,
-       COUNT(DISTINCT ip) uv
-FROM visit
+SELECT alias, SUM(pv) pv, SUM(uv) uv
+FROM (
+    SELECT alias, pv, uv
+    FROM visit_daily
+    WHERE day < ?`+f.rolledWhere()+`
+    UNION ALL
+    SELECT alias,
+           COUNT(*) pv,
+           COUNT(DISTINCT ip) uv
+    FROM visit
+    WHERE created_at >= ?`+cond+`
+    GROUP BY alias
+) t
 GROUP BY alias
 ORDER BY pv DESC
-`)
+`, append([]interface{}{until, until}, cargs...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -216,5 +1057,782 @@ ORDER BY pv DESC
 	if err != nil {
 		return nil, err
 	}
+	if f.raw() {
+		return rs, nil
+	}
+	uvs, err := db.totalUV(ctx, "", f)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rs {
+		rs[i].UV = uvs[rs[i].Alias]
+	}
 	return rs, nil
 }
+
+// CountAliasVisit counts the visits of a given alias. The UV is estimated
+// from the sketches of unique visitors unless the filter requires the raw
+// visits.
+func (db Store) CountAliasVisit(ctx context.Context, a string, f Filter) (*Record, error) {
+	until, err := db.rawSince(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	cond, cargs := f.where()
+	query, args, err := sqlx.In(`
+SELECT ? AS alias,
+       IFNULL(SUM(pv), 0) pv,
+       IFNULL(SUM(uv), 0) uv
+FROM (
+    SELECT pv, uv
+    FROM visit_daily
+    WHERE alias=?
+      AND day < ?`+f.rolledWhere()+`
+    UNION ALL
+    SELECT COUNT(*) pv,
+           COUNT(DISTINCT ip) uv
+    FROM visit
+    WHERE alias=?
+      AND created_at >= ?`+cond+`
+) t
+`, append([]interface{}{a, a, until, a, until}, cargs...)...)
+	if err != nil {
+		return nil, err
+	}
+	r := &Record{}
+	err = db.sqlxDB.GetContext(ctx, r, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if f.raw() {
+		return r, nil
+	}
+	uvs, err := db.totalUV(ctx, a, f)
+	if err != nil {
+		return nil, err
+	}
+	r.UV = uvs[a]
+	return r, nil
+}
+
+// CountAliasRange counts the PV and UV of a given alias from start to
+// end, and finds its first and last visits in between. The UV is counted
+// exactly for a raw range up to exactRange or if the filter requires the
+// raw visits, and is estimated from the sketches of unique visitors
+// otherwise. The visits of the rolled-up days are only known to the day,
+// thus a first or last visit in a rolled-up day is the start of the day.
+func (db Store) CountAliasRange(ctx context.Context, a string, start, end time.Time, f Filter) (*Rangestat, error) {
+	rawStart, rolled, err := db.splitRange(ctx, start, end, f)
+	if err != nil {
+		return nil, err
+	}
+
+	// edge finds the time of the first row of the given query, which
+	// selects a single time column.
+	edge := func(query string, args ...interface{}) (*time.Time, error) {
+		query, args, err := sqlx.In(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		ts := []time.Time{}
+		err = db.sqlxDB.SelectContext(ctx, &ts, query, args...)
+		if err != nil || len(ts) == 0 {
+			return nil, err
+		}
+		t := ts[0].UTC()
+		return &t, nil
+	}
+
+	r := &Rangestat{}
+	if rolled != nil {
+		query, args, err := sqlx.In(`
+SELECT IFNULL(SUM(pv), 0) pv, IFNULL(SUM(uv), 0) uv
+FROM visit_daily
+WHERE alias=?
+  AND day >= ? AND day <= ? AND day < ?`+f.rolledWhere()+`
+`, a, rolled.start, end, rolled.end)
+		if err != nil {
+			return nil, err
+		}
+		err = db.sqlxDB.GetContext(ctx, r, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		days := `
+SELECT day
+FROM visit_daily
+WHERE alias=?
+  AND day >= ? AND day <= ? AND day < ?` + f.rolledWhere() + `
+ORDER BY day `
+		r.First, err = edge(days+`LIMIT 1`, a, rolled.start, end, rolled.end)
+		if err != nil {
+			return nil, err
+		}
+		r.Last, err = edge(days+`DESC LIMIT 1`, a, rolled.start, end, rolled.end)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cond, cargs := f.where()
+	args := append([]interface{}{a, rawStart, end}, cargs...)
+	query, qargs, err := sqlx.In(`
+SELECT COUNT(*) pv, COUNT(DISTINCT ip) uv
+FROM visit
+WHERE alias=?
+  AND created_at BETWEEN ? AND ?`+cond+`
+`, args...)
+	if err != nil {
+		return nil, err
+	}
+	raw := Rangestat{}
+	err = db.sqlxDB.GetContext(ctx, &raw, query, qargs...)
+	if err != nil {
+		return nil, err
+	}
+	r.PV += raw.PV
+	r.UV += raw.UV
+	if !f.raw() && (rolled != nil || end.Sub(start) > exactRange) {
+		r.UV, err = db.estimateUV(ctx, a, start, end, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if raw.PV == 0 {
+		return r, nil
+	}
+
+	visits := `
+SELECT created_at
+FROM visit
+WHERE alias=?
+  AND created_at BETWEEN ? AND ?` + cond + `
+ORDER BY created_at `
+	if r.First == nil {
+		r.First, err = edge(visits+`LIMIT 1`, args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.Last, err = edge(visits+`DESC LIMIT 1`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// streamPage is the number of visits that are read at once while
+// streaming visits, so that no read is held on the data store for long.
+const streamPage = 1000
+
+// StreamVisits calls fn with the visits of a given alias, or of all
+// aliases if alias is empty, from start to end in the order they are
+// recorded. The visits are read page by page. It stops at the first
+// error of fn and returns it.
+func (db Store) StreamVisits(ctx context.Context, a string, start, end time.Time, f Filter, fn func(*Visit) error) error {
+	cond, cargs := f.where()
+	if a != "" {
+		cond += `
+  AND alias=?`
+		cargs = append(cargs, a)
+	}
+	type row struct {
+		ID int64 `db:"id"`
+		Visit
+	}
+	last := int64(0)
+	for {
+		query, args, err := sqlx.In(`
+SELECT id, alias, IFNULL(ip, '') AS ip, IFNULL(ua, '') AS ua, IFNULL(referer, '') AS referer,
+       variant, country, bot, browser, browser_version, os, device,
+       referer_host, referer_path, channel, created_at AS time
+FROM visit
+WHERE id > ?
+  AND created_at BETWEEN ? AND ?`+cond+`
+ORDER BY id
+LIMIT ?
+`, append(append([]interface{}{last, start, end}, cargs...), streamPage)...)
+		if err != nil {
+			return err
+		}
+		rows := []row{}
+		err = db.sqlxDB.SelectContext(ctx, &rows, query, args...)
+		if err != nil {
+			return err
+		}
+		for i := range rows {
+			err = fn(&rows[i].Visit)
+			if err != nil {
+				return err
+			}
+		}
+		if len(rows) < streamPage {
+			return nil
+		}
+		last = rows[len(rows)-1].ID
+	}
+}
+
+// StreamDaily calls fn with the PV and UV of each day of a given alias,
+// or of all aliases if alias is empty, from start to end, ordered by
+// alias and day. The UV of the rolled-up days is the sum of the UV of
+// each day.
+func (db Store) StreamDaily(ctx context.Context, a string, start, end time.Time, f Filter, fn func(*Daystat) error) error {
+	rawStart, rolled, err := db.splitRange(ctx, start, end, f)
+	if err != nil {
+		return err
+	}
+	// an empty rolled range if the range does not reach the rollups.
+	rolledStart, rolledEnd := start, start
+	if rolled != nil {
+		rolledStart, rolledEnd = rolled.start, rolled.end
+	}
+	rcond, cond, cargs := f.rolledWhere(), "", []interface{}{}
+	raw, rawArgs := f.where()
+	if a != "" {
+		rcond += `
+      AND alias=?`
+		cond += `
+      AND alias=?`
+		cargs = append(cargs, a)
+	}
+
+	args := []interface{}{rolledStart, end, rolledEnd}
+	args = append(args, cargs...)
+	args = append(args, rawStart, end)
+	args = append(args, rawArgs...)
+	args = append(args, cargs...)
+	query, args, err := sqlx.In(`
+SELECT alias, day, SUM(pv) pv, SUM(uv) uv
+FROM (
+    SELECT alias, DATE(day) AS day, pv, uv
+    FROM visit_daily
+    WHERE day >= ? AND day <= ? AND day < ?`+rcond+`
+    UNION ALL
+    SELECT alias,
+           DATE(created_at) AS day,
+           COUNT(*) pv,
+           COUNT(DISTINCT ip) uv
+    FROM visit
+    WHERE created_at BETWEEN ? AND ?`+raw+cond+`
+    GROUP BY alias, DATE(created_at)
+) t
+GROUP BY alias, day
+ORDER BY alias, day
+`, args...)
+	if err != nil {
+		return err
+	}
+	rows, err := db.sqlxDB.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d := &Daystat{}
+		err = rows.StructScan(d)
+		if err != nil {
+			return err
+		}
+		err = fn(d)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// rolledRange is the part of a stat range that is read from the daily
+// rollups, i.e. the days in [start, end).
+type rolledRange struct {
+	start, end time.Time
+}
+
+// splitRange splits the stat range from start to end into the rolled-up
+// days and the raw visits since rawStart. The rolled range is nil if the
+// range does not reach the rolled-up days, or if the filter requires the
+// raw visits.
+func (db Store) splitRange(ctx context.Context, start, end time.Time, f Filter) (rawStart time.Time, rolled *rolledRange, err error) {
+	if f.raw() {
+		return start, nil, nil
+	}
+	until, err := db.RolledUntil(ctx)
+	if err != nil {
+		return start, nil, err
+	}
+	if !start.Before(until) {
+		return start, nil, nil
+	}
+	return until, &rolledRange{start: day(start), end: until}, nil
+}
+
+// rawSince returns the time since when the visits are counted from the
+// raw visits rather than the daily rollups, which is the zero time if the
+// filter requires the raw visits.
+func (db Store) rawSince(ctx context.Context, f Filter) (time.Time, error) {
+	if f.raw() {
+		return time.Time{}, nil
+	}
+	return db.RolledUntil(ctx)
+}
+
+func day(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// RolledUntil returns the end of the days that have been rolled up into
+// the daily tables, or the zero time if no day is rolled up. The days
+// rolled up before they were marked in visit_rolled are found by their
+// rollups in visit_daily.
+func (db Store) RolledUntil(ctx context.Context) (time.Time, error) {
+	until := time.Time{}
+	for _, table := range []string{"visit_rolled", "visit_daily"} {
+		days := []time.Time{}
+		err := db.sqlxDB.SelectContext(ctx, &days, `SELECT day FROM `+table+` ORDER BY day DESC LIMIT 1`)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(days) > 0 && !day(days[0]).Before(until) {
+			until = day(days[0]).AddDate(0, 0, 1)
+		}
+	}
+	return until, nil
+}
+
+// RollupVisits rolls up the raw visits of the complete days before now
+// that are not rolled up yet into the daily tables, with at most top
+// referers, user agent families, referer hosts and referer paths of each
+// alias and day. It returns the number of rolled-up days.
+func (db Store) RollupVisits(ctx context.Context, now time.Time, top int) (int, error) {
+	from, err := db.RolledUntil(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if from.IsZero() {
+		first := []time.Time{}
+		err = db.sqlxDB.SelectContext(ctx, &first, `SELECT created_at FROM visit ORDER BY created_at LIMIT 1`)
+		if err != nil || len(first) == 0 {
+			return 0, err
+		}
+		from = day(first[0])
+	}
+
+	n := 0
+	for d, today := from, day(now); d.Before(today); d = d.AddDate(0, 0, 1) {
+		err = db.rollupDay(ctx, d, top)
+		if err != nil {
+			return n, fmt.Errorf("cannot roll up %s: %w", d.Format("2006-01-02"), err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// othersKey is the key that sums up the referers and user agent families
+// beyond the top ones of a day.
+const othersKey = "(others)"
+
+func (db Store) rollupDay(ctx context.Context, d time.Time, top int) error {
+	next := d.AddDate(0, 0, 1)
+	query, args, err := sqlx.In(`
+SELECT alias,
+       bot,
+       COUNT(*) pv,
+       COUNT(DISTINCT ip) uv
+FROM visit
+WHERE created_at >= ? AND created_at < ?
+GROUP BY alias, bot
+`, d, next)
+	if err != nil {
+		return err
+	}
+	rs := []struct {
+		Record
+		Bot bool `db:"bot"`
+	}{}
+	err = db.sqlxDB.SelectContext(ctx, &rs, query, args...)
+	if err != nil {
+		return err
+	}
+
+	type count struct {
+		Alias string `db:"alias"`
+		Bot   bool   `db:"bot"`
+		Key   string `db:"k"`
+		Count int64  `db:"count"`
+	}
+	query, args, err = sqlx.In(`
+SELECT alias, bot, IFNULL(referer, 'NULL') AS k, COUNT(*) AS count
+FROM visit
+WHERE created_at >= ? AND created_at < ?
+GROUP BY alias, bot, referer
+`, d, next)
+	if err != nil {
+		return err
+	}
+	refs := []count{}
+	err = db.sqlxDB.SelectContext(ctx, &refs, query, args...)
+	if err != nil {
+		return err
+	}
+	query, args, err = sqlx.In(`
+SELECT alias, bot, IFNULL(ua, '') AS k, COUNT(*) AS count
+FROM visit
+WHERE created_at >= ? AND created_at < ?
+GROUP BY alias, bot, ua
+`, d, next)
+	if err != nil {
+		return err
+	}
+	uas := []count{}
+	err = db.sqlxDB.SelectContext(ctx, &uas, query, args...)
+	if err != nil {
+		return err
+	}
+	dims := map[string][]dimCount{}
+	for dim, key := range dimensions {
+		query, args, err = sqlx.In(`
+SELECT alias, bot, `+key+` AS k, COUNT(*) AS count, COUNT(DISTINCT ip) AS uv
+FROM visit
+WHERE created_at >= ? AND created_at < ?
+GROUP BY alias, bot, k
+`, d, next)
+		if err != nil {
+			return err
+		}
+		cs := []dimCount{}
+		err = db.sqlxDB.SelectContext(ctx, &cs, query, args...)
+		if err != nil {
+			return err
+		}
+		dims[dim] = cs
+	}
+	// the IPs of the day are added to the sketches of unique visitors
+	// again, which only changes them for the visits recorded before the
+	// sketches were maintained.
+	query, args, err = sqlx.In(`
+SELECT DISTINCT alias, bot, ip
+FROM visit
+WHERE created_at >= ? AND created_at < ?
+  AND ip IS NOT NULL
+`, d, next)
+	if err != nil {
+		return err
+	}
+	ips := []*Visit{}
+	err = db.sqlxDB.SelectContext(ctx, &ips, query, args...)
+	if err != nil {
+		return err
+	}
+	for _, v := range ips {
+		v.Time = d
+	}
+
+	// topN groups the counts by alias and whether the visits are from
+	// bots, and keeps the top n keys of each group, the other keys are
+	// summed up as othersKey.
+	type group struct {
+		alias string
+		bot   bool
+	}
+	topN := func(cs []count, key func(string) string) map[group]map[string]int64 {
+		m := map[group]map[string]int64{}
+		for _, c := range cs {
+			g := group{c.Alias, c.Bot}
+			if m[g] == nil {
+				m[g] = map[string]int64{}
+			}
+			m[g][key(c.Key)] += c.Count
+		}
+		for _, keys := range m {
+			if len(keys) <= top {
+				continue
+			}
+			sorted := make([]count, 0, len(keys))
+			for k, v := range keys {
+				sorted = append(sorted, count{Key: k, Count: v})
+			}
+			sort.Slice(sorted, func(i, j int) bool {
+				if sorted[i].Count != sorted[j].Count {
+					return sorted[i].Count > sorted[j].Count
+				}
+				return sorted[i].Key < sorted[j].Key
+			})
+			for _, c := range sorted[top:] {
+				delete(keys, c.Key)
+				keys[othersKey] += c.Count
+			}
+		}
+		return m
+	}
+	topRefs := topN(refs, func(k string) string { return k })
+	topUAs := topN(uas, ua.Family)
+	for dim := range topDimensions {
+		cs := make([]count, 0, len(dims[dim]))
+		for _, c := range dims[dim] {
+			cs = append(cs, count{Alias: c.Alias, Bot: c.Bot, Key: c.Key, Count: c.Count})
+		}
+		dims[dim] = dims[dim][:0]
+		for g, keys := range topN(cs, func(k string) string { return k }) {
+			for k, v := range keys {
+				dims[dim] = append(dims[dim], dimCount{Alias: g.alias, Bot: g.bot, Key: k, Count: v})
+			}
+		}
+	}
+
+	tx, err := db.sqlxDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		for _, table := range []string{"visit_rolled", "visit_daily", "visit_daily_referer", "visit_daily_ua", "visit_daily_dim"} {
+			_, err := tx.ExecContext(ctx, tx.Rebind(`DELETE FROM `+table+` WHERE day=?`), d)
+			if err != nil {
+				return err
+			}
+		}
+		// the day is marked as rolled up even if it has no visits.
+		_, err := tx.ExecContext(ctx, tx.Rebind(`INSERT INTO visit_rolled (day) VALUES(?)`), d)
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			_, err := tx.ExecContext(ctx, tx.Rebind(`INSERT INTO visit_daily (alias, day, bot, pv, uv) VALUES(?, ?, ?, ?, ?)`), r.Alias, d, r.Bot, r.PV, r.UV)
+			if err != nil {
+				return err
+			}
+		}
+		for g, keys := range topRefs {
+			for k, v := range keys {
+				_, err := tx.ExecContext(ctx, tx.Rebind(`INSERT INTO visit_daily_referer (alias, day, bot, referer, count) VALUES(?, ?, ?, ?, ?)`), g.alias, d, g.bot, k, v)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for g, keys := range topUAs {
+			for k, v := range keys {
+				_, err := tx.ExecContext(ctx, tx.Rebind(`INSERT INTO visit_daily_ua (alias, day, bot, family, count) VALUES(?, ?, ?, ?, ?)`), g.alias, d, g.bot, k, v)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for dim, cs := range dims {
+			for _, c := range cs {
+				_, err := tx.ExecContext(ctx, tx.Rebind(`INSERT INTO visit_daily_dim (alias, day, bot, dim, k, count, uv) VALUES(?, ?, ?, ?, ?, ?, ?)`), c.Alias, d, c.Bot, dim, c.Key, c.Count, c.UV)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return addSketches(ctx, tx, ips)
+	}()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteRolledVisits deletes the raw visits before the given time that
+// have been rolled up, and returns the number of deleted visits.
+func (db Store) DeleteRolledVisits(ctx context.Context, before time.Time) (int64, error) {
+	until, err := db.RolledUntil(ctx)
+	if err != nil || until.IsZero() {
+		return 0, err
+	}
+	if before.After(until) {
+		before = until
+	}
+	return db.DeleteVisits(ctx, before)
+}
+
+// EnqueueWebhooks adds the given webhooks to the outbox as pending, due
+// at their NextAt, and sets their IDs.
+func (db Store) EnqueueWebhooks(ctx context.Context, ws []*Webhook) error {
+	if len(ws) == 0 {
+		return nil
+	}
+	tx, err := db.sqlxDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, w := range ws {
+		w.State, w.Attempts, w.CreatedAt = WebhookPending, 0, now
+		if w.NextAt.IsZero() {
+			w.NextAt = now
+		}
+		w.NextAt = w.NextAt.UTC()
+		res, err := tx.ExecContext(ctx, tx.Rebind(`
+INSERT INTO webhook_outbox (event, alias, url, payload, state, attempts, next_at, created_at)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+`), w.Event, w.Alias, w.URL, w.Payload, w.State, w.Attempts, w.NextAt, w.CreatedAt)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		w.ID, err = res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// FetchDueWebhooks reads at most limit pending webhooks that are due at
+// the given time, the oldest first.
+func (db Store) FetchDueWebhooks(ctx context.Context, now time.Time, limit int) ([]*Webhook, error) {
+	query, args, err := sqlx.In(`
+SELECT id, event, alias, url, payload, state, attempts, next_at, created_at
+FROM webhook_outbox
+WHERE state = ?
+  AND next_at <= ?
+ORDER BY next_at, id
+LIMIT ?
+`, WebhookPending, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	ws := []*Webhook{}
+	err = db.sqlxDB.SelectContext(ctx, &ws, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// RecordDelivery appends an attempt to the delivery log, and updates the
+// state, the attempts and the next attempt of the webhook in the outbox.
+func (db Store) RecordDelivery(ctx context.Context, w *Webhook, d *Delivery) error {
+	tx, err := db.sqlxDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, tx.Rebind(`
+UPDATE webhook_outbox
+SET state=?, attempts=?, next_at=?
+WHERE id=?
+`), w.State, w.Attempts, w.NextAt.UTC(), w.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	d.WebhookID, d.Event, d.Alias, d.URL = w.ID, w.Event, w.Alias, w.URL
+	res, err := tx.ExecContext(ctx, tx.Rebind(`
+INSERT INTO webhook_delivery (webhook_id, event, alias, url, attempt, status, error, latency, created_at)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)
+`), d.WebhookID, d.Event, d.Alias, d.URL, d.Attempt, d.Status, d.Error, d.Latency, d.CreatedAt.UTC())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	d.ID, err = res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// FetchDeliveries reads the latest limit attempts of the delivery log,
+// the latest first.
+func (db Store) FetchDeliveries(ctx context.Context, limit int) ([]Delivery, error) {
+	query, args, err := sqlx.In(`
+SELECT id, webhook_id, event, alias, url, attempt, status, error, latency, created_at
+FROM webhook_delivery
+ORDER BY id DESC
+LIMIT ?
+`, limit)
+	if err != nil {
+		return nil, err
+	}
+	ds := []Delivery{}
+	err = db.sqlxDB.SelectContext(ctx, &ds, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// ReachMilestones records that an alias has reached the given visit
+// milestones, and returns those that are reached for the first time.
+func (db Store) ReachMilestones(ctx context.Context, a string, milestones []int64) ([]int64, error) {
+	tx, err := db.sqlxDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	reached := []int64{}
+	for _, m := range milestones {
+		res, err := tx.ExecContext(ctx, tx.Rebind(`
+INSERT OR IGNORE INTO webhook_milestone (alias, milestone, created_at)
+VALUES(?, ?, ?)
+`), a, m, now)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if n > 0 {
+			reached = append(reached, m)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return reached, nil
+}
+
+// CountPV counts all visits of each of the given aliases. It is cheaper
+// than CountAliasVisit since it does not count the unique visitors.
+func (db Store) CountPV(ctx context.Context, aliases []string, f Filter) (map[string]int64, error) {
+	pvs := map[string]int64{}
+	if len(aliases) == 0 {
+		return pvs, nil
+	}
+	until, err := db.rawSince(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	cond, cargs := f.where()
+	query, args, err := sqlx.In(`
+SELECT alias, IFNULL(SUM(pv), 0) pv
+FROM (
+    SELECT alias, pv
+    FROM visit_daily
+    WHERE alias IN (?)
+      AND day < ?`+f.rolledWhere()+`
+    UNION ALL
+    SELECT alias, COUNT(*) pv
+    FROM visit
+    WHERE alias IN (?)
+      AND created_at >= ?`+cond+`
+    GROUP BY alias
+) t
+GROUP BY alias
+`, append([]interface{}{aliases, until, aliases, until}, cargs...)...)
+	if err != nil {
+		return nil, err
+	}
+	rows := []struct {
+		Alias string `db:"alias"`
+		PV    int64  `db:"pv"`
+	}{}
+	err = db.sqlxDB.SelectContext(ctx, &rows, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		pvs[r.Alias] = r.PV
+	}
+	return pvs, nil
+}
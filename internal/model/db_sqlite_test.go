@@ -8,9 +8,17 @@ package model
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -65,6 +73,101 @@ func TestStoreAlias(t *testing.T) {
 	}
 }
 
+func TestAliasDetails(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+	red := &Redirect{
+		Alias:        "T2",
+		URL:          "https://golang.design",
+		Owner:        "changkun",
+		Description:  "the golang.design initiative",
+		Interstitial: 3,
+		Rules: Rules{
+			{Platform: "ios", URL: "https://apps.apple.com"},
+			{Language: "zh", Referer: "*.google.com", URL: "https://golang.design/zh"},
+		},
+	}
+	err = db.StoreAlias(ctx, red)
+	if err != nil {
+		t.Fatalf("StoreAlias with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, red.Alias)
+
+	ret, err := db.FetchAlias(ctx, red.Alias)
+	if err != nil {
+		t.Fatalf("FetchAlias with err: %v", err)
+	}
+	if ret.Owner != red.Owner || ret.Description != red.Description || ret.Interstitial != red.Interstitial {
+		t.Fatalf("FetchAlias want %+v, got %+v", red, ret)
+	}
+	if !reflect.DeepEqual(ret.Rules, red.Rules) {
+		t.Fatalf("FetchAlias want rules %+v, got %+v", red.Rules, ret.Rules)
+	}
+	if ret.CreatedAt.IsZero() {
+		t.Fatalf("FetchAlias returns alias without creation time")
+	}
+
+	err = db.RecordVisit(ctx, &Visit{Alias: "T2", IP: "192.168.0.1", UA: "ua", Time: time.Now().UTC()})
+	if err != nil {
+		t.Fatalf("RecordVisit with err: %v", err)
+	}
+	rec, err := db.CountAliasVisit(ctx, red.Alias, Filter{})
+	if err != nil {
+		t.Fatalf("CountAliasVisit with err: %v", err)
+	}
+	if rec.Alias != red.Alias || rec.PV != 1 || rec.UV != 1 {
+		t.Fatalf("CountAliasVisit want 1 pv and 1 uv, got %+v", rec)
+	}
+}
+
+func TestConsumeVisit(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+	red := &Redirect{Alias: "T3", URL: "https://golang.design", MaxVisits: 5}
+	err = db.StoreAlias(ctx, red)
+	if err != nil {
+		t.Fatalf("StoreAlias with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, red.Alias)
+
+	var (
+		consumed int64
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := db.ConsumeVisit(ctx, red.Alias)
+			if err != nil {
+				t.Errorf("ConsumeVisit with err: %v", err)
+				return
+			}
+			if ok {
+				atomic.AddInt64(&consumed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if consumed != red.MaxVisits {
+		t.Fatalf("ConsumeVisit want %d consumed visits, got %d", red.MaxVisits, consumed)
+	}
+
+	ret, err := db.FetchAlias(ctx, red.Alias)
+	if err != nil {
+		t.Fatalf("FetchAlias with err: %v", err)
+	}
+	if ret.Visits != red.MaxVisits || ret.Remaining() != 0 {
+		t.Fatalf("FetchAlias want exhausted alias, got %+v", ret)
+	}
+}
+
 func TestVisit(t *testing.T) {
 	db, err := NewDB(dsn)
 	if err != nil {
@@ -74,12 +177,12 @@ func TestVisit(t *testing.T) {
 
 	now := time.Now()
 	visits := []*Visit{
-		{"t1", "192.168.0.1", "ua1", "https://example1.com", now.Add(-12 * time.Second)},
-		{"t1", "192.168.0.2", "ua2", "https://example2.com", now.Add(-10 * time.Second)},
-		{"t2", "192.168.0.3", "ua2", "https://example3.com", now},
-		{"t3", "192.168.0.2", "ua3", "https://example4.com", now},
-		{"t3", "192.168.0.3", "ua4", "https://example5.com", now},
-		{"t3", "192.168.0.4", "ua5", "https://example6.com", now},
+		{Alias: "t1", IP: "192.168.0.1", UA: "ua1", Referer: "https://example1.com", Time: now.Add(-12 * time.Second)},
+		{Alias: "t1", IP: "192.168.0.2", UA: "ua2", Referer: "https://example2.com", Time: now.Add(-10 * time.Second)},
+		{Alias: "t2", IP: "192.168.0.3", UA: "ua2", Referer: "https://example3.com", Time: now},
+		{Alias: "t3", IP: "192.168.0.2", UA: "ua3", Referer: "https://example4.com", Time: now},
+		{Alias: "t3", IP: "192.168.0.3", UA: "ua4", Referer: "https://example5.com", Time: now},
+		{Alias: "t3", IP: "192.168.0.4", UA: "ua5", Referer: "https://example6.com", Time: now},
 	}
 
 	for _, v := range visits {
@@ -88,7 +191,7 @@ func TestVisit(t *testing.T) {
 			t.Fatalf("RecordVisit with err: %v", err)
 		}
 	}
-	ret, err := db.CountReferer(ctx, "t2", now.Add(-1*time.Second), now.Add(1*time.Second))
+	ret, err := db.CountReferer(ctx, "t2", now.Add(-1*time.Second), now.Add(1*time.Second), Filter{})
 	if err != nil {
 		t.Fatalf("CountReferer with err: %v", err)
 	}
@@ -96,7 +199,7 @@ func TestVisit(t *testing.T) {
 		t.Fatalf("CountReferer len is 1, but got: %d", len(ret))
 	}
 
-	uast, err := db.CountUA(ctx, "t2", now.Add(-1*time.Second), now.Add(1*time.Second))
+	uast, err := db.CountUA(ctx, "t2", now.Add(-1*time.Second), now.Add(1*time.Second), Filter{})
 	if err != nil {
 		t.Fatalf("CountUA with err: %v", err)
 	}
@@ -104,7 +207,7 @@ func TestVisit(t *testing.T) {
 		t.Fatalf("CountUA result is not equal 1, got: %v", len(uast))
 	}
 
-	cvhst, err := db.CountVisitHist(ctx, "t2", now.Add(-10*time.Second), now.Add(1*time.Second))
+	cvhst, err := db.CountVisitHist(ctx, "t2", now.Add(-10*time.Second), now.Add(1*time.Second), Filter{})
 	if err != nil {
 		t.Fatalf("CountVisitHist with err: %v", err)
 	}
@@ -115,7 +218,7 @@ func TestVisit(t *testing.T) {
 		t.Fatalf("CountUA result want 1, got: %v", cvhst[0].Count)
 	}
 
-	cvhst, err = db.CountVisitHist(ctx, "t3", now.Add(-10*time.Second), now.Add(1*time.Second))
+	cvhst, err = db.CountVisitHist(ctx, "t3", now.Add(-10*time.Second), now.Add(1*time.Second), Filter{})
 	if err != nil {
 		t.Fatalf("CountVisitHist with err: %v", err)
 	}
@@ -126,3 +229,1029 @@ func TestVisit(t *testing.T) {
 		t.Fatalf("CountVisitHist result want 3, got: %v", cvhst[0].Count)
 	}
 }
+
+func TestRecordVisits(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+	alias := "batch-visits"
+	defer db.DeleteAlias(ctx, alias)
+
+	now := time.Now().UTC()
+	n := 2*visitBatchRows + 3
+	visits := make([]*Visit, 0, n)
+	for i := 0; i < n; i++ {
+		visits = append(visits, &Visit{Alias: alias, IP: fmt.Sprintf("10.0.%d.%d", i/256, i%256), UA: "ua", Time: now})
+	}
+	err = db.RecordVisits(ctx, visits)
+	if err != nil {
+		t.Fatalf("RecordVisits with err: %v", err)
+	}
+	rec, err := db.CountAliasVisit(ctx, alias, Filter{})
+	if err != nil {
+		t.Fatalf("CountAliasVisit with err: %v", err)
+	}
+	if rec.PV != int64(n) || rec.UV != int64(n) {
+		t.Fatalf("CountAliasVisit want %d pv and uv, got %+v", n, rec)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	for _, r := range []*Redirect{
+		{Alias: "h1", URL: "https://golang.design"},
+		{Alias: "h2", URL: "https://golang.design/404"},
+		{Alias: "h3", URL: "https://golang.design/secret", Password: "hash"},
+		{Alias: "h4", URL: "https://golang.design/signed", Signed: true},
+	} {
+		err = db.StoreAlias(ctx, r)
+		if err != nil {
+			t.Fatalf("StoreAlias with err: %v", err)
+		}
+		defer db.DeleteAlias(ctx, r.Alias)
+	}
+
+	rs, err := db.FetchAliases(ctx)
+	if err != nil {
+		t.Fatalf("FetchAliases with err: %v", err)
+	}
+	if len(rs) < 2 {
+		t.Fatalf("FetchAliases want at least 2 aliases, got %v", len(rs))
+	}
+
+	now := time.Now().UTC()
+	hs := []*Health{
+		{Alias: "h1", Status: 200, Latency: 10, CheckedAt: now},
+		{Alias: "h2", Status: 200, Latency: 10, CheckedAt: now},
+		// the broken link of h2 is one of its variants.
+		{Alias: "h2", URL: "https://golang.design/variant", Status: 404, Latency: 20, CheckedAt: now},
+		{Alias: "h3", Status: 404, Latency: 20, CheckedAt: now},
+		{Alias: "h4", Status: 404, Latency: 20, CheckedAt: now},
+	}
+	for _, h := range hs {
+		err = db.RecordHealth(ctx, h)
+		if err != nil {
+			t.Fatalf("RecordHealth with err: %v", err)
+		}
+	}
+
+	broken, err := db.FetchBrokenLinks(ctx)
+	if err != nil {
+		t.Fatalf("FetchBrokenLinks with err: %v", err)
+	}
+	if len(broken) != 1 {
+		t.Fatalf("FetchBrokenLinks want 1 link, got %+v", broken)
+	}
+	if broken[0].Alias != "h2" || broken[0].Status != 404 || broken[0].URL != "https://golang.design/variant" {
+		t.Fatalf("FetchBrokenLinks returns wrong link: %+v", broken[0])
+	}
+}
+
+func TestVariant(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	r := &Redirect{
+		Alias: "ab",
+		URL:   "https://golang.design",
+		Variants: Variants{
+			{Name: "a", URL: "https://golang.design/a", Weight: 1},
+			{Name: "b", URL: "https://golang.design/b", Weight: 3},
+		},
+		Sticky: true,
+	}
+	err = db.StoreAlias(ctx, r)
+	if err != nil {
+		t.Fatalf("StoreAlias with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, r.Alias)
+
+	got, err := db.FetchAlias(ctx, r.Alias)
+	if err != nil {
+		t.Fatalf("FetchAlias with err: %v", err)
+	}
+	if !got.Sticky || !reflect.DeepEqual(got.Variants, r.Variants) {
+		t.Fatalf("FetchAlias want variants %+v, got %+v", r.Variants, got.Variants)
+	}
+
+	now := time.Now().UTC()
+	for _, v := range []*Visit{
+		{Alias: "ab", IP: "1.1.1.1", Variant: "a", Time: now},
+		{Alias: "ab", IP: "1.1.1.1", Variant: "a", Time: now},
+		{Alias: "ab", IP: "2.2.2.2", Variant: "b", Time: now},
+	} {
+		err = db.RecordVisit(ctx, v)
+		if err != nil {
+			t.Fatalf("RecordVisit with err: %v", err)
+		}
+	}
+
+	vs, err := db.CountVariant(ctx, "ab", now.Add(-time.Second), now.Add(time.Second), Filter{})
+	if err != nil {
+		t.Fatalf("CountVariant with err: %v", err)
+	}
+	want := []Variantstat{{Variant: "a", PV: 2, UV: 1}, {Variant: "b", PV: 1, UV: 1}}
+	if !reflect.DeepEqual(vs, want) {
+		t.Fatalf("CountVariant want %+v, got %+v", want, vs)
+	}
+
+	refs, err := db.CountReferer(ctx, "ab", now.Add(-time.Second), now.Add(time.Second), Filter{Variant: "a"})
+	if err != nil {
+		t.Fatalf("CountReferer with err: %v", err)
+	}
+	if len(refs) != 1 || refs[0].Count != 2 {
+		t.Fatalf("CountReferer of variant a want 2 visits, got %+v", refs)
+	}
+}
+
+func TestCountCountry(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	for _, v := range []*Visit{
+		{Alias: "geo", IP: "1.0.0.1", Country: "CN", Time: now},
+		{Alias: "geo", IP: "1.0.0.2", Country: "CN", Time: now},
+		{Alias: "geo", IP: "8.8.8.8", Country: "US", Time: now},
+		{Alias: "geo", IP: "192.168.0.1", Time: now},
+	} {
+		err = db.RecordVisit(ctx, v)
+		if err != nil {
+			t.Fatalf("RecordVisit with err: %v", err)
+		}
+	}
+
+	cs, err := db.CountCountry(ctx, "geo", now.Add(-time.Second), now.Add(time.Second), Filter{})
+	if err != nil {
+		t.Fatalf("CountCountry with err: %v", err)
+	}
+	want := []Countrystat{{Country: "CN", Count: 2}, {Country: "", Count: 1}, {Country: "US", Count: 1}}
+	if !reflect.DeepEqual(cs, want) {
+		t.Fatalf("CountCountry want %+v, got %+v", want, cs)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, v := range []*Visit{
+		{Alias: "old", IP: "192.168.1.1", UA: "ua", Time: old},
+		{Alias: "old", IP: "192.168.1.2", UA: "ua", Time: old.Add(time.Hour)},
+		{Alias: "old", IP: "192.168.1.3", UA: "ua", Time: old.Add(48 * time.Hour)},
+	} {
+		err = db.RecordVisit(ctx, v)
+		if err != nil {
+			t.Fatalf("RecordVisit with err: %v", err)
+		}
+	}
+	defer db.DeleteVisits(ctx, old.Add(72*time.Hour))
+
+	n, err := db.AnonymizeVisits(ctx, old.Add(24*time.Hour), func(ip string) string { return "x" + ip })
+	if err != nil {
+		t.Fatalf("AnonymizeVisits with err: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("AnonymizeVisits want 2 visits, got %d", n)
+	}
+	// anonymized visits are not anonymized again.
+	n, err = db.AnonymizeVisits(ctx, old.Add(24*time.Hour), func(ip string) string { return "x" + ip })
+	if err != nil || n != 0 {
+		t.Fatalf("AnonymizeVisits again want 0 visits, got %d, %v", n, err)
+	}
+	refs, err := db.CountUA(ctx, "old", old, old.Add(time.Hour), Filter{})
+	if err != nil {
+		t.Fatalf("CountUA with err: %v", err)
+	}
+	if len(refs) != 1 || refs[0].UA != "Unknown" || refs[0].Count != 2 {
+		t.Fatalf("CountUA of anonymized visits want 2 unknown user agents, got %+v", refs)
+	}
+
+	n, err = db.DeleteVisits(ctx, old.Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("DeleteVisits with err: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("DeleteVisits want 2 visits, got %d", n)
+	}
+}
+
+func TestSalt(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+	defer db.DeleteSalts(ctx, "2000-12-31")
+
+	s, err := db.FetchSalt(ctx, "2000-01-01", "a")
+	if err != nil || s != "a" {
+		t.Fatalf("FetchSalt want a, got %q, %v", s, err)
+	}
+	s, err = db.FetchSalt(ctx, "2000-01-01", "b")
+	if err != nil || s != "a" {
+		t.Fatalf("FetchSalt want the existing salt a, got %q, %v", s, err)
+	}
+	err = db.DeleteSalts(ctx, "2000-01-02")
+	if err != nil {
+		t.Fatalf("DeleteSalts with err: %v", err)
+	}
+	s, err = db.FetchSalt(ctx, "2000-01-01", "c")
+	if err != nil || s != "c" {
+		t.Fatalf("FetchSalt after deletion want c, got %q, %v", s, err)
+	}
+}
+
+// unroll deletes the marks of the rolled-up days, whose rollups are
+// deleted together with the aliases of a test.
+func unroll(db *Store) {
+	db.sqlxDB.Exec(`DELETE FROM visit_rolled`)
+}
+
+func TestRollup(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	day1 := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	day2, day3 := day1.AddDate(0, 0, 1), day1.AddDate(0, 0, 2)
+	chrome := "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Safari/537.36"
+	firefox := "Mozilla/5.0 (X11; Linux x86_64; rv:94.0) Gecko/20100101 Firefox/94.0"
+	for _, v := range []*Visit{
+		{Alias: "roll", IP: "1.1.1.1", UA: chrome, Referer: "https://a.com", Time: day1.Add(time.Hour)},
+		{Alias: "roll", IP: "1.1.1.1", UA: chrome, Referer: "https://a.com", Time: day1.Add(2 * time.Hour)},
+		{Alias: "roll", IP: "1.1.1.2", UA: firefox, Referer: "https://b.com", Time: day1.Add(3 * time.Hour)},
+		{Alias: "roll", IP: "1.1.1.1", UA: chrome, Referer: "https://c.com", Time: day2.Add(time.Hour)},
+		{Alias: "roll", IP: "1.1.1.3", UA: firefox, Referer: "https://a.com", Time: day3.Add(time.Hour)},
+	} {
+		err = db.RecordVisit(ctx, v)
+		if err != nil {
+			t.Fatalf("RecordVisit with err: %v", err)
+		}
+	}
+	defer db.DeleteAlias(ctx, "roll")
+
+	defer unroll(db)
+	n, err := db.RollupVisits(ctx, day3.Add(12*time.Hour), 1)
+	if err != nil {
+		t.Fatalf("RollupVisits with err: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("RollupVisits want 2 days, got %d", n)
+	}
+	until, err := db.RolledUntil(ctx)
+	if err != nil || !until.Equal(day3) {
+		t.Fatalf("RolledUntil want %v, got %v, %v", day3, until, err)
+	}
+	// rolling up again does nothing.
+	n, err = db.RollupVisits(ctx, day3.Add(12*time.Hour), 1)
+	if err != nil || n != 0 {
+		t.Fatalf("RollupVisits again want 0 days, got %d, %v", n, err)
+	}
+
+	check := func() {
+		rec, err := db.CountAliasVisit(ctx, "roll", Filter{})
+		if err != nil {
+			t.Fatalf("CountAliasVisit with err: %v", err)
+		}
+		// the sketches count the 3 IPs once across the days.
+		if rec.PV != 5 || rec.UV != 3 {
+			t.Fatalf("CountAliasVisit want 5 pv and 3 uv, got %+v", rec)
+		}
+
+		refs, err := db.CountReferer(ctx, "roll", day1, day3.Add(23*time.Hour), Filter{})
+		if err != nil {
+			t.Fatalf("CountReferer with err: %v", err)
+		}
+		wantRefs := []Refstat{
+			{Referer: "https://a.com", Count: 3},
+			{Referer: "(others)", Count: 1},
+			{Referer: "https://c.com", Count: 1},
+		}
+		if !reflect.DeepEqual(refs, wantRefs) {
+			t.Fatalf("CountReferer want %+v, got %+v", wantRefs, refs)
+		}
+
+		uas, err := db.CountUA(ctx, "roll", day1, day2.Add(23*time.Hour), Filter{})
+		if err != nil {
+			t.Fatalf("CountUA with err: %v", err)
+		}
+		wantUAs := []UAstat{{UA: "Chrome", Count: 3}, {UA: "(others)", Count: 1}}
+		if !reflect.DeepEqual(uas, wantUAs) {
+			t.Fatalf("CountUA want %+v, got %+v", wantUAs, uas)
+		}
+		// the raw visits after RolledUntil are counted by their families.
+		uas, err = db.CountUA(ctx, "roll", day1, day3.Add(23*time.Hour), Filter{})
+		if err != nil {
+			t.Fatalf("CountUA with err: %v", err)
+		}
+		wantUAs = []UAstat{{UA: "Chrome", Count: 3}, {UA: "(others)", Count: 1}, {UA: "Firefox", Count: 1}}
+		if !reflect.DeepEqual(uas, wantUAs) {
+			t.Fatalf("CountUA across RolledUntil want %+v, got %+v", wantUAs, uas)
+		}
+
+		hist, err := db.CountVisitHist(ctx, "roll", day1, day3.Add(23*time.Hour), Filter{})
+		if err != nil {
+			t.Fatalf("CountVisitHist with err: %v", err)
+		}
+		if len(hist) != 3 || hist[0].Count != 3 || !hist[0].Time.Equal(day1) || hist[1].Count != 1 || hist[2].Count != 1 {
+			t.Fatalf("CountVisitHist want 3, 1 and 1 visits, got %+v", hist)
+		}
+
+		hosts, err := db.CountRefererHost(ctx, "roll", day1, day3.Add(23*time.Hour), false, Filter{})
+		if err != nil {
+			t.Fatalf("CountRefererHost with err: %v", err)
+		}
+		wantHosts := []Refstat{{Referer: "a.com", Count: 3}, {Referer: "(others)", Count: 1}, {Referer: "c.com", Count: 1}}
+		if !reflect.DeepEqual(hosts, wantHosts) {
+			t.Fatalf("CountRefererHost want %+v, got %+v", wantHosts, hosts)
+		}
+		browsers, err := db.CountBrowser(ctx, "roll", day1, day3.Add(23*time.Hour), Filter{})
+		if err != nil {
+			t.Fatalf("CountBrowser with err: %v", err)
+		}
+		wantBrowsers := []Browserstat{{Browser: "Chrome", Version: "96", Count: 3}, {Browser: "Firefox", Version: "94", Count: 2}}
+		if !reflect.DeepEqual(browsers, wantBrowsers) {
+			t.Fatalf("CountBrowser want %+v, got %+v", wantBrowsers, browsers)
+		}
+		vs, err := db.CountVariant(ctx, "roll", day1, day3.Add(23*time.Hour), Filter{})
+		if err != nil {
+			t.Fatalf("CountVariant with err: %v", err)
+		}
+		// the UV of the rolled-up days is summed up across the days.
+		wantVariants := []Variantstat{{Variant: "", PV: 5, UV: 4}}
+		if !reflect.DeepEqual(vs, wantVariants) {
+			t.Fatalf("CountVariant want %+v, got %+v", wantVariants, vs)
+		}
+	}
+	check()
+
+	n64, err := db.DeleteRolledVisits(ctx, day3.Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("DeleteRolledVisits with err: %v", err)
+	}
+	if n64 != 4 {
+		t.Fatalf("DeleteRolledVisits want 4 visits, got %d", n64)
+	}
+	// the stats are the same without the raw visits of rolled-up days.
+	check()
+
+	// the days without visits are rolled up too.
+	n, err = db.RollupVisits(ctx, day3.AddDate(0, 0, 2), 1)
+	if err != nil || n != 2 {
+		t.Fatalf("RollupVisits want 2 days, got %d, %v", n, err)
+	}
+	until, err = db.RolledUntil(ctx)
+	if want := day3.AddDate(0, 0, 2); err != nil || !until.Equal(want) {
+		t.Fatalf("RolledUntil after an empty day want %v, got %v, %v", want, until, err)
+	}
+}
+
+func TestBots(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	day1 := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	err = db.RecordVisits(ctx, []*Visit{
+		{Alias: "bots", IP: "1.1.1.1", UA: "ua", Time: day1.Add(time.Hour)},
+		{Alias: "bots", IP: "1.1.1.2", UA: "ua", Time: day1.Add(2 * time.Hour)},
+		{Alias: "bots", IP: "2.2.2.2", UA: "Twitterbot/1.0", Bot: true, Time: day1.Add(3 * time.Hour)},
+		{Alias: "bots", IP: "1.1.1.1", UA: "ua", Time: day2.Add(time.Hour)},
+		{Alias: "bots", IP: "2.2.2.3", UA: "Slackbot 1.0", Bot: true, Time: day2.Add(2 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("RecordVisits with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "bots")
+
+	check := func(f Filter, pv, uv int64) {
+		rec, err := db.CountAliasVisit(ctx, "bots", f)
+		if err != nil {
+			t.Fatalf("CountAliasVisit with err: %v", err)
+		}
+		if rec.PV != pv || rec.UV != uv {
+			t.Fatalf("CountAliasVisit with %+v want %d pv and %d uv, got %+v", f, pv, uv, rec)
+		}
+
+		rs, err := db.CountVisit(ctx, f)
+		if err != nil {
+			t.Fatalf("CountVisit with err: %v", err)
+		}
+		found := false
+		for _, r := range rs {
+			if r.Alias == "bots" {
+				found = true
+				if r.PV != pv || r.UV != uv {
+					t.Fatalf("CountVisit with %+v want %d pv and %d uv, got %+v", f, pv, uv, r)
+				}
+			}
+		}
+		if !found {
+			t.Fatalf("CountVisit with %+v does not count the alias", f)
+		}
+
+		hist, err := db.CountVisitHist(ctx, "bots", day1, day2.Add(23*time.Hour), f)
+		if err != nil {
+			t.Fatalf("CountVisitHist with err: %v", err)
+		}
+		sum := 0
+		for _, h := range hist {
+			sum += h.Count
+		}
+		if int64(sum) != pv {
+			t.Fatalf("CountVisitHist with %+v want %d visits, got %+v", f, pv, hist)
+		}
+	}
+	check(Filter{}, 3, 2)
+	check(Filter{Bots: true}, 5, 4)
+
+	defer unroll(db)
+	_, err = db.RollupVisits(ctx, day2.Add(12*time.Hour), 10)
+	if err != nil {
+		t.Fatalf("RollupVisits with err: %v", err)
+	}
+	// the UV of rolled-up days is merged from their sketches.
+	check(Filter{}, 3, 2)
+	check(Filter{Bots: true}, 5, 4)
+}
+
+func TestCountVisitHist(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	base := time.Now().UTC().Truncate(time.Minute).Add(-time.Hour)
+	err = db.RecordVisits(ctx, []*Visit{
+		{Alias: "hist", IP: "1.1.1.1", Time: base.Add(time.Second)},
+		{Alias: "hist", IP: "1.1.1.2", Time: base.Add(30*time.Second + 500*time.Millisecond)},
+		{Alias: "hist", IP: "1.1.1.3", Time: base.Add(time.Minute + 2*time.Second)},
+	})
+	if err != nil {
+		t.Fatalf("RecordVisits with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "hist")
+
+	// the visits are counted in each minute.
+	hist, err := db.CountVisitHist(ctx, "hist", base, base.Add(time.Hour), Filter{})
+	if err != nil {
+		t.Fatalf("CountVisitHist with err: %v", err)
+	}
+	want := []Timehist{{Time: base, Count: 2}, {Time: base.Add(time.Minute), Count: 1}}
+	if !reflect.DeepEqual(hist, want) {
+		t.Fatalf("CountVisitHist want %+v, got %+v", want, hist)
+	}
+}
+
+func TestCountAgent(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	chrome := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Safari/537.36"
+	chrome95 := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/95.0.4638.69 Safari/537.36"
+	iphone := "Mozilla/5.0 (iPhone; CPU iPhone OS 15_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Mobile/15E148 Safari/604.1"
+	err = db.RecordVisits(ctx, []*Visit{
+		{Alias: "agent", IP: "1.1.1.1", UA: chrome, Time: now},
+		{Alias: "agent", IP: "1.1.1.2", UA: chrome, Time: now},
+		{Alias: "agent", IP: "1.1.1.3", UA: chrome95, Time: now},
+	})
+	if err != nil {
+		t.Fatalf("RecordVisits with err: %v", err)
+	}
+	err = db.RecordVisit(ctx, &Visit{Alias: "agent", IP: "1.1.1.4", UA: iphone, Time: now})
+	if err != nil {
+		t.Fatalf("RecordVisit with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "agent")
+
+	start, end := now.Add(-time.Second), now.Add(time.Second)
+	bs, err := db.CountBrowser(ctx, "agent", start, end, Filter{})
+	if err != nil {
+		t.Fatalf("CountBrowser with err: %v", err)
+	}
+	wantBs := []Browserstat{{"Chrome", "96", 2}, {"Chrome", "95", 1}, {"Safari", "15", 1}}
+	if !reflect.DeepEqual(bs, wantBs) {
+		t.Fatalf("CountBrowser want %+v, got %+v", wantBs, bs)
+	}
+
+	oss, err := db.CountOS(ctx, "agent", start, end, Filter{})
+	if err != nil {
+		t.Fatalf("CountOS with err: %v", err)
+	}
+	wantOSs := []OSstat{{"Windows", 3}, {"iOS", 1}}
+	if !reflect.DeepEqual(oss, wantOSs) {
+		t.Fatalf("CountOS want %+v, got %+v", wantOSs, oss)
+	}
+
+	ds, err := db.CountDevice(ctx, "agent", start, end, Filter{})
+	if err != nil {
+		t.Fatalf("CountDevice with err: %v", err)
+	}
+	wantDs := []Devicestat{{"Desktop", 3}, {"Mobile", 1}}
+	if !reflect.DeepEqual(ds, wantDs) {
+		t.Fatalf("CountDevice want %+v, got %+v", wantDs, ds)
+	}
+}
+
+func TestCountRefererHost(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	err = db.RecordVisits(ctx, []*Visit{
+		{Alias: "refhost", Referer: "https://twitter.com/a/status/1", Time: now},
+		{Alias: "refhost", Referer: "https://twitter.com/b/status/2", Time: now},
+		{Alias: "refhost", Referer: "https://www.google.com/search?q=redir", Time: now},
+		{Alias: "refhost", Referer: "https://www.google.com/search?q=go", Time: now},
+		{Alias: "refhost", Referer: "https://www.google.com/search?q=s", Time: now},
+		{Alias: "refhost", Referer: "", Time: now},
+		{Alias: "refhost", Referer: "https://golang.design/", Channel: "internal", Time: now},
+	})
+	if err != nil {
+		t.Fatalf("RecordVisits with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "refhost")
+
+	start, end := now.Add(-time.Second), now.Add(time.Second)
+	hosts, err := db.CountRefererHost(ctx, "refhost", start, end, false, Filter{})
+	if err != nil {
+		t.Fatalf("CountRefererHost with err: %v", err)
+	}
+	wantHosts := []Refstat{{"google.com", 3}, {"twitter.com", 2}, {"", 1}, {"golang.design", 1}}
+	if !reflect.DeepEqual(hosts, wantHosts) {
+		t.Fatalf("CountRefererHost want %+v, got %+v", wantHosts, hosts)
+	}
+
+	paths, err := db.CountRefererHost(ctx, "refhost", start, end, true, Filter{})
+	if err != nil {
+		t.Fatalf("CountRefererHost with path with err: %v", err)
+	}
+	wantPaths := []Refstat{{"google.com/search", 3}, {"", 1}, {"golang.design", 1}, {"twitter.com/a/status/1", 1}, {"twitter.com/b/status/2", 1}}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Fatalf("CountRefererHost with path want %+v, got %+v", wantPaths, paths)
+	}
+
+	cs, err := db.CountChannel(ctx, "refhost", start, end, Filter{})
+	if err != nil {
+		t.Fatalf("CountChannel with err: %v", err)
+	}
+	wantCs := []Channelstat{{"search", 3}, {"social", 2}, {"direct", 1}, {"internal", 1}}
+	if !reflect.DeepEqual(cs, wantCs) {
+		t.Fatalf("CountChannel want %+v, got %+v", wantCs, cs)
+	}
+}
+
+func TestStreamVisits(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	// more visits than a page, so that they are read in two pages.
+	now := time.Now().UTC().Truncate(time.Second)
+	vs := []*Visit{}
+	for i := 0; i < streamPage+5; i++ {
+		vs = append(vs, &Visit{Alias: "stream", IP: "1.1.1.1", Time: now.Add(time.Duration(i) * time.Millisecond)})
+	}
+	vs = append(vs, &Visit{Alias: "stream", IP: "1.1.1.2", UA: "Googlebot/2.1", Bot: true, Time: now})
+	err = db.RecordVisits(ctx, vs)
+	if err != nil {
+		t.Fatalf("RecordVisits with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "stream")
+
+	start, end := now.Add(-time.Second), now.Add(2*time.Second)
+	check := func(f Filter, want int) {
+		n := 0
+		err := db.StreamVisits(ctx, "stream", start, end, f, func(v *Visit) error {
+			if v.Alias != "stream" || v.Time.IsZero() {
+				t.Fatalf("StreamVisits gives a wrong visit: %+v", v)
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("StreamVisits with err: %v", err)
+		}
+		if n != want {
+			t.Fatalf("StreamVisits with %+v want %d visits, got %d", f, want, n)
+		}
+	}
+	check(Filter{}, streamPage+5)
+	check(Filter{Bots: true}, streamPage+6)
+
+	stop := errors.New("stop")
+	n := 0
+	err = db.StreamVisits(ctx, "stream", start, end, Filter{}, func(v *Visit) error {
+		n++
+		return stop
+	})
+	if !errors.Is(err, stop) || n != 1 {
+		t.Fatalf("StreamVisits does not stop at the error of fn, got %d visits, %v", n, err)
+	}
+}
+
+func TestStreamDaily(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	day1 := time.Date(2001, 2, 1, 0, 0, 0, 0, time.UTC)
+	day2, day3 := day1.AddDate(0, 0, 1), day1.AddDate(0, 0, 2)
+	err = db.RecordVisits(ctx, []*Visit{
+		{Alias: "daily", IP: "1.1.1.1", Time: day1.Add(time.Hour)},
+		{Alias: "daily", IP: "1.1.1.1", Time: day1.Add(2 * time.Hour)},
+		{Alias: "daily", IP: "1.1.1.2", Time: day1.Add(3 * time.Hour)},
+		{Alias: "daily", IP: "1.1.1.1", Time: day2.Add(time.Hour)},
+		{Alias: "daily", IP: "1.1.1.3", UA: "Googlebot/2.1", Bot: true, Time: day2.Add(time.Hour)},
+		{Alias: "daily", IP: "1.1.1.3", Time: day3.Add(time.Hour)},
+		{Alias: "daily2", IP: "1.1.1.3", Time: day3.Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("RecordVisits with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "daily")
+	defer db.DeleteAlias(ctx, "daily2")
+
+	check := func(alias string, want []Daystat) {
+		got := []Daystat{}
+		err := db.StreamDaily(ctx, alias, day1, day3.Add(23*time.Hour), Filter{}, func(d *Daystat) error {
+			got = append(got, *d)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("StreamDaily with err: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("StreamDaily of %q want %+v, got %+v", alias, want, got)
+		}
+	}
+	want := []Daystat{
+		{"daily", "2001-02-01", 3, 2},
+		{"daily", "2001-02-02", 1, 1},
+		{"daily", "2001-02-03", 1, 1},
+	}
+	check("daily", want)
+	check("", append(want, Daystat{"daily2", "2001-02-03", 1, 1}))
+
+	// the rolled-up days and the raw days are the same.
+	defer unroll(db)
+	_, err = db.RollupVisits(ctx, day2.Add(12*time.Hour), 10)
+	if err != nil {
+		t.Fatalf("RollupVisits with err: %v", err)
+	}
+	check("daily", want)
+}
+
+func TestCountAliasRange(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	day1 := time.Date(2001, 3, 1, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	err = db.RecordVisits(ctx, []*Visit{
+		{Alias: "range", IP: "1.1.1.1", Time: day1.Add(time.Hour)},
+		{Alias: "range", IP: "1.1.1.2", Time: day1.Add(2 * time.Hour)},
+		{Alias: "range", IP: "1.1.1.1", Time: day2.Add(time.Hour)},
+		{Alias: "range", IP: "1.1.1.1", Time: day2.Add(3 * time.Hour)},
+		{Alias: "range", IP: "1.1.1.3", UA: "Googlebot/2.1", Bot: true, Time: day2.Add(4 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("RecordVisits with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "range")
+
+	check := func(start, end time.Time, f Filter, pv, uv int64, first, last time.Time) {
+		r, err := db.CountAliasRange(ctx, "range", start, end, f)
+		if err != nil {
+			t.Fatalf("CountAliasRange with err: %v", err)
+		}
+		if r.PV != pv || r.UV != uv {
+			t.Fatalf("CountAliasRange with %+v want %d pv and %d uv, got %+v", f, pv, uv, r)
+		}
+		if r.First == nil || !r.First.Equal(first) || r.Last == nil || !r.Last.Equal(last) {
+			t.Fatalf("CountAliasRange with %+v want visits from %v to %v, got %v to %v", f, first, last, r.First, r.Last)
+		}
+	}
+	end := day2.Add(23 * time.Hour)
+	check(day1, end, Filter{}, 4, 2, day1.Add(time.Hour), day2.Add(3*time.Hour))
+	check(day1, end, Filter{Bots: true}, 5, 3, day1.Add(time.Hour), day2.Add(4*time.Hour))
+	check(day2, end, Filter{}, 2, 1, day2.Add(time.Hour), day2.Add(3*time.Hour))
+
+	r, err := db.CountAliasRange(ctx, "range", day1.AddDate(0, 0, -7), day1, Filter{})
+	if err != nil || r.PV != 0 || r.First != nil || r.Last != nil {
+		t.Fatalf("CountAliasRange without visits want nothing, got %+v, %v", r, err)
+	}
+
+	// the first visit of a rolled-up day is the start of the day.
+	defer unroll(db)
+	_, err = db.RollupVisits(ctx, day2.Add(12*time.Hour), 10)
+	if err != nil {
+		t.Fatalf("RollupVisits with err: %v", err)
+	}
+	check(day1, end, Filter{}, 4, 2, day1, day2.Add(3*time.Hour))
+}
+
+func TestUniqueVisitors(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	// 3000 visitors visit on each of three days, and 1000 of them visit
+	// every day.
+	day1 := time.Date(2001, 4, 1, 0, 0, 0, 0, time.UTC)
+	vs := []*Visit{}
+	for d := 0; d < 3; d++ {
+		for i := 0; i < 3000; i++ {
+			ip := fmt.Sprintf("10.%d.%d.%d", d, i/256, i%256)
+			if i < 1000 {
+				ip = fmt.Sprintf("10.9.%d.%d", i/256, i%256)
+			}
+			vs = append(vs, &Visit{Alias: "hll", IP: ip, Time: day1.AddDate(0, 0, d).Add(time.Duration(i) * time.Second)})
+		}
+	}
+	err = db.RecordVisits(ctx, vs)
+	if err != nil {
+		t.Fatalf("RecordVisits with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "hll")
+
+	within := func(got, want int64) bool {
+		// three times the standard error of the sketches.
+		return math.Abs(float64(got-want)) <= 3*0.0081*float64(want)
+	}
+	end := day1.AddDate(0, 0, 3).Add(-time.Second)
+	r, err := db.CountAliasRange(ctx, "hll", day1, end, Filter{})
+	if err != nil {
+		t.Fatalf("CountAliasRange with err: %v", err)
+	}
+	if r.PV != 9000 || !within(r.UV, 7000) {
+		t.Fatalf("CountAliasRange want 9000 pv and about 7000 uv, got %+v", r)
+	}
+	rec, err := db.CountAliasVisit(ctx, "hll", Filter{})
+	if err != nil || !within(rec.UV, 7000) {
+		t.Fatalf("CountAliasVisit want about 7000 uv, got %+v, %v", rec, err)
+	}
+	// a range of a day is counted exactly, which only contains the
+	// visits of the second day.
+	r, err = db.CountAliasRange(ctx, "hll", day1.Add(time.Hour), day1.Add(25*time.Hour), Filter{})
+	if err != nil {
+		t.Fatalf("CountAliasRange with err: %v", err)
+	}
+	if r.UV != 3000 {
+		t.Fatalf("CountAliasRange of a day want 3000 uv, got %+v", r)
+	}
+
+	// the visits recorded without sketches are added when they are
+	// rolled up.
+	_, err = db.sqlxDB.ExecContext(ctx, `DELETE FROM visit_hll WHERE alias='hll'`)
+	if err != nil {
+		t.Fatalf("cannot delete sketches: %v", err)
+	}
+	_, err = db.sqlxDB.ExecContext(ctx, `DELETE FROM visit_hll_total WHERE alias='hll'`)
+	if err != nil {
+		t.Fatalf("cannot delete sketches: %v", err)
+	}
+	defer unroll(db)
+	_, err = db.RollupVisits(ctx, day1.AddDate(0, 0, 3), 10)
+	if err != nil {
+		t.Fatalf("RollupVisits with err: %v", err)
+	}
+	rec, err = db.CountAliasVisit(ctx, "hll", Filter{})
+	if err != nil || !within(rec.UV, 7000) {
+		t.Fatalf("CountAliasVisit after rollup want about 7000 uv, got %+v, %v", rec, err)
+	}
+
+	// the rolled-up days without sketches add their daily UV.
+	_, err = db.sqlxDB.ExecContext(ctx, `DELETE FROM visit_hll WHERE alias='hll' AND day=?`, day1)
+	if err != nil {
+		t.Fatalf("cannot delete sketch: %v", err)
+	}
+	r, err = db.CountAliasRange(ctx, "hll", day1, end, Filter{})
+	if err != nil {
+		t.Fatalf("CountAliasRange with err: %v", err)
+	}
+	if !within(r.UV, 3000+5000) {
+		t.Fatalf("CountAliasRange without a sketch want about 8000 uv, got %+v", r)
+	}
+}
+
+func TestWebhookOutbox(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	// the webhooks are due far in the future, so that they are not
+	// delivered by the other tests.
+	due := time.Date(2101, 1, 1, 0, 0, 0, 0, time.UTC)
+	ws := []*Webhook{
+		{Event: "alias.created", Alias: "hook", URL: "http://127.0.0.1/a", Payload: `{"n":1}`, NextAt: due},
+		{Event: "alias.created", Alias: "hook", URL: "http://127.0.0.1/b", Payload: `{"n":2}`, NextAt: due.Add(time.Hour)},
+	}
+	err = db.EnqueueWebhooks(ctx, ws)
+	if err != nil {
+		t.Fatalf("EnqueueWebhooks with err: %v", err)
+	}
+	if ws[0].ID == 0 || ws[1].ID <= ws[0].ID || ws[0].State != WebhookPending {
+		t.Fatalf("EnqueueWebhooks sets wrong ids or states: %+v, %+v", ws[0], ws[1])
+	}
+
+	fetch := func(now time.Time) map[int64]*Webhook {
+		got, err := db.FetchDueWebhooks(ctx, now, 1000)
+		if err != nil {
+			t.Fatalf("FetchDueWebhooks with err: %v", err)
+		}
+		m := map[int64]*Webhook{}
+		for _, w := range got {
+			if w.ID == ws[0].ID || w.ID == ws[1].ID {
+				m[w.ID] = w
+			}
+		}
+		return m
+	}
+	got := fetch(due)
+	if len(got) != 1 || got[ws[0].ID] == nil || got[ws[0].ID].Payload != `{"n":1}` || !got[ws[0].ID].NextAt.Equal(due) {
+		t.Fatalf("FetchDueWebhooks want the first webhook, got %v", got)
+	}
+
+	// a failed attempt is retried later, a successful one is not.
+	w := got[ws[0].ID]
+	w.Attempts, w.NextAt = 1, due.Add(2*time.Hour)
+	err = db.RecordDelivery(ctx, w, &Delivery{Attempt: 1, Status: 500, Error: "500 Internal Server Error", CreatedAt: due})
+	if err != nil {
+		t.Fatalf("RecordDelivery with err: %v", err)
+	}
+	if got := fetch(due.Add(time.Hour)); len(got) != 1 || got[ws[1].ID] == nil {
+		t.Fatalf("FetchDueWebhooks want the second webhook, got %v", got)
+	}
+	w.Attempts, w.State = 2, WebhookDelivered
+	err = db.RecordDelivery(ctx, w, &Delivery{Attempt: 2, Status: 204, CreatedAt: due})
+	if err != nil {
+		t.Fatalf("RecordDelivery with err: %v", err)
+	}
+	if got := fetch(due.Add(3 * time.Hour)); len(got) != 1 || got[ws[1].ID] == nil {
+		t.Fatalf("FetchDueWebhooks returns a delivered webhook: %v", got)
+	}
+
+	ds, err := db.FetchDeliveries(ctx, 1000)
+	if err != nil {
+		t.Fatalf("FetchDeliveries with err: %v", err)
+	}
+	attempts := []int{}
+	for _, d := range ds {
+		if d.WebhookID == w.ID {
+			if d.Alias != "hook" || d.URL != w.URL || d.Event != w.Event {
+				t.Fatalf("FetchDeliveries returns a wrong delivery: %+v", d)
+			}
+			attempts = append(attempts, d.Attempt)
+		}
+	}
+	if !reflect.DeepEqual(attempts, []int{2, 1}) {
+		t.Fatalf("FetchDeliveries want attempts [2 1], got %v", attempts)
+	}
+}
+
+func TestMilestones(t *testing.T) {
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	err = db.RecordVisits(ctx, []*Visit{
+		{Alias: "milestone", IP: "1.1.1.1", Time: now},
+		{Alias: "milestone", IP: "1.1.1.2", Time: now},
+		{Alias: "milestone", IP: "1.1.1.3", UA: "Googlebot/2.1", Bot: true, Time: now},
+		{Alias: "milestone2", IP: "1.1.1.1", Time: now},
+	})
+	if err != nil {
+		t.Fatalf("RecordVisits with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "milestone")
+	defer db.DeleteAlias(ctx, "milestone2")
+
+	pvs, err := db.CountPV(ctx, []string{"milestone", "milestone2", "milestone3"}, Filter{})
+	if err != nil {
+		t.Fatalf("CountPV with err: %v", err)
+	}
+	if !reflect.DeepEqual(pvs, map[string]int64{"milestone": 2, "milestone2": 1}) {
+		t.Fatalf("CountPV want 2 and 1 visits, got %v", pvs)
+	}
+	pvs, err = db.CountPV(ctx, []string{"milestone"}, Filter{Bots: true})
+	if err != nil || pvs["milestone"] != 3 {
+		t.Fatalf("CountPV with bots want 3 visits, got %v, %v", pvs, err)
+	}
+
+	reached, err := db.ReachMilestones(ctx, "milestone", []int64{1, 2})
+	if err != nil || !reflect.DeepEqual(reached, []int64{1, 2}) {
+		t.Fatalf("ReachMilestones want [1 2], got %v, %v", reached, err)
+	}
+	reached, err = db.ReachMilestones(ctx, "milestone", []int64{1, 2, 10})
+	if err != nil || !reflect.DeepEqual(reached, []int64{10}) {
+		t.Fatalf("ReachMilestones want [10], got %v, %v", reached, err)
+	}
+
+	// the milestones are reached again once the alias is recreated.
+	err = db.DeleteAlias(ctx, "milestone")
+	if err != nil {
+		t.Fatalf("DeleteAlias with err: %v", err)
+	}
+	reached, err = db.ReachMilestones(ctx, "milestone", []int64{1})
+	if err != nil || !reflect.DeepEqual(reached, []int64{1}) {
+		t.Fatalf("ReachMilestones after deletion want [1], got %v, %v", reached, err)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	old := filepath.Join(t.TempDir(), "redir.db")
+	sdb, err := sqlx.Open("sqlite3", old)
+	if err != nil {
+		t.Fatalf("Open with err: %v", err)
+	}
+	_, err = sdb.Exec(`
+CREATE TABLE collink (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  alias varchar(50) NOT NULL DEFAULT '' UNIQUE,
+  url varchar(1024) NOT NULL DEFAULT '',
+  created_at datetime DEFAULT NULL,
+  updated_at datetime DEFAULT NULL
+);
+CREATE TABLE visit (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  alias varchar(50) NOT NULL DEFAULT '',
+  ip varchar(50) DEFAULT NULL,
+  ua varchar(1000) DEFAULT NULL,
+  referer varchar(500) DEFAULT NULL,
+  created_at datetime NOT NULL
+);
+INSERT INTO collink (alias, url, created_at, updated_at)
+VALUES ('old', 'https://golang.design', '2021-01-01 00:00:00', '2021-01-01 00:00:00');
+`)
+	sdb.Close()
+	if err != nil {
+		t.Fatalf("creating the old schema with err: %v", err)
+	}
+
+	// an upgraded database is upgraded again without errors.
+	for i := 0; i < 2; i++ {
+		db, err := NewDB(old)
+		if err != nil {
+			t.Fatalf("NewDB with err: %v", err)
+		}
+		ctx := context.Background()
+		r, err := db.FetchAlias(ctx, "old")
+		if err != nil {
+			t.Fatalf("FetchAlias of an upgraded database with err: %v", err)
+		}
+		if r.URL != "https://golang.design" || r.Password != "" || r.MaxVisits != 0 {
+			t.Fatalf("FetchAlias of an upgraded database got %+v", r)
+		}
+		err = db.RecordVisits(ctx, []*Visit{{Alias: "old", IP: "1.1.1.1", Time: time.Now().UTC()}})
+		if err != nil {
+			t.Fatalf("RecordVisits of an upgraded database with err: %v", err)
+		}
+		db.Close()
+	}
+}
@@ -8,6 +8,16 @@ CREATE TABLE `collink` (
     `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
     `alias` varchar(50) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
     `url` varchar(1024) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `owner` varchar(50) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `description` varchar(500) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `interstitial` int(11) NOT NULL DEFAULT 0,
+    `password` varchar(100) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `max_visits` int(11) NOT NULL DEFAULT 0,
+    `visits` int(11) NOT NULL DEFAULT 0,
+    `signed` tinyint(1) NOT NULL DEFAULT 0,
+    `variants` text COLLATE utf8mb4_unicode_ci,
+    `sticky` tinyint(1) NOT NULL DEFAULT 0,
+    `rules` text COLLATE utf8mb4_unicode_ci,
     `created_at` datetime DEFAULT NULL,
     `updated_at` datetime DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP,
     PRIMARY KEY (`id`),
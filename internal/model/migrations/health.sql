@@ -0,0 +1,12 @@
+-- Copyright 2021 The golang.design Initiative Authors.
+-- All rights reserved. Use of this source code is governed
+-- by a MIT license that can be found in the LICENSE file.
+
+CREATE TABLE `health` (
+    `alias` varchar(50) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `url` varchar(1024) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `status` int(11) NOT NULL DEFAULT 0,
+    `latency` int(11) NOT NULL DEFAULT 0,
+    `checked_at` datetime NOT NULL,
+    PRIMARY KEY (`alias`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
\ No newline at end of file
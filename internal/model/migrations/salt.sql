@@ -0,0 +1,9 @@
+-- Copyright 2021 The golang.design Initiative Authors.
+-- All rights reserved. Use of this source code is governed
+-- by a MIT license that can be found in the LICENSE file.
+
+CREATE TABLE `salt` (
+    `day` char(10) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `salt` varchar(64) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    PRIMARY KEY (`day`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -10,6 +10,17 @@ CREATE TABLE `visit` (
     `ip` varchar(50) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
     `ua` varchar(1000) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
     `referer` varchar(500) COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+    `variant` varchar(50) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `country` char(2) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `anonymized` tinyint(1) NOT NULL DEFAULT 0,
+    `bot` tinyint(1) NOT NULL DEFAULT 0,
+    `browser` varchar(50) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `browser_version` varchar(20) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `os` varchar(50) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `device` varchar(20) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `referer_host` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `referer_path` varchar(500) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `channel` varchar(20) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
     `created_at` datetime NOT NULL,
     PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
\ No newline at end of file
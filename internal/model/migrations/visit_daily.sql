@@ -0,0 +1,13 @@
+-- Copyright 2021 The golang.design Initiative Authors.
+-- All rights reserved. Use of this source code is governed
+-- by a MIT license that can be found in the LICENSE file.
+
+CREATE TABLE `visit_daily` (
+    `alias` varchar(50) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `day` datetime NOT NULL,
+    `bot` tinyint(1) NOT NULL DEFAULT 0,
+    `pv` int(11) NOT NULL DEFAULT 0,
+    `uv` int(11) NOT NULL DEFAULT 0,
+    PRIMARY KEY (`alias`, `day`, `bot`),
+    KEY `idx_day` (`day`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
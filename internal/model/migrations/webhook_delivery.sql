@@ -0,0 +1,17 @@
+-- Copyright 2021 The golang.design Initiative Authors.
+-- All rights reserved. Use of this source code is governed
+-- by a MIT license that can be found in the LICENSE file.
+
+CREATE TABLE `webhook_delivery` (
+    `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+    `webhook_id` int(11) unsigned NOT NULL,
+    `event` varchar(50) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `alias` varchar(50) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `url` varchar(1024) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `attempt` int(11) NOT NULL DEFAULT 0,
+    `status` int(11) NOT NULL DEFAULT 0,
+    `error` varchar(500) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `latency` int(11) NOT NULL DEFAULT 0,
+    `created_at` datetime NOT NULL,
+    PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,17 @@
+-- Copyright 2021 The golang.design Initiative Authors.
+-- All rights reserved. Use of this source code is governed
+-- by a MIT license that can be found in the LICENSE file.
+
+CREATE TABLE `webhook_outbox` (
+    `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+    `event` varchar(50) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `alias` varchar(50) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `url` varchar(1024) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+    `payload` text COLLATE utf8mb4_unicode_ci NOT NULL,
+    `state` varchar(20) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'pending',
+    `attempts` int(11) NOT NULL DEFAULT 0,
+    `next_at` datetime NOT NULL,
+    `created_at` datetime NOT NULL,
+    PRIMARY KEY (`id`),
+    KEY `idx_state_next_at` (`state`, `next_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,183 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"fmt"
+)
+
+// column is a column that was added to a table after the table was
+// first released.
+type column struct {
+	table string
+	name  string
+	def   string
+}
+
+// addedColumns are the columns that are missing in a database created
+// from an earlier schema, in the order they were added. Each of them
+// has a default so that it can be added to a table with rows.
+var addedColumns = []column{
+	{"collink", "owner", "varchar(50) NOT NULL DEFAULT ''"},
+	{"collink", "description", "varchar(500) NOT NULL DEFAULT ''"},
+	{"collink", "interstitial", "int NOT NULL DEFAULT 0"},
+	{"collink", "password", "varchar(100) NOT NULL DEFAULT ''"},
+	{"collink", "max_visits", "int NOT NULL DEFAULT 0"},
+	{"collink", "visits", "int NOT NULL DEFAULT 0"},
+	{"collink", "signed", "tinyint(1) NOT NULL DEFAULT 0"},
+	{"collink", "variants", "text"},
+	{"collink", "sticky", "tinyint(1) NOT NULL DEFAULT 0"},
+	{"collink", "rules", "text"},
+	{"visit", "variant", "varchar(50) NOT NULL DEFAULT ''"},
+	{"visit", "country", "char(2) NOT NULL DEFAULT ''"},
+	{"visit", "anonymized", "tinyint(1) NOT NULL DEFAULT 0"},
+	{"visit", "bot", "tinyint(1) NOT NULL DEFAULT 0"},
+	{"visit", "browser", "varchar(50) NOT NULL DEFAULT ''"},
+	{"visit", "browser_version", "varchar(20) NOT NULL DEFAULT ''"},
+	{"visit", "os", "varchar(50) NOT NULL DEFAULT ''"},
+	{"visit", "device", "varchar(20) NOT NULL DEFAULT ''"},
+	{"visit", "referer_host", "varchar(255) NOT NULL DEFAULT ''"},
+	{"visit", "referer_path", "varchar(500) NOT NULL DEFAULT ''"},
+	{"visit", "channel", "varchar(20) NOT NULL DEFAULT ''"},
+	{"health", "url", "varchar(1024) NOT NULL DEFAULT ''"},
+}
+
+// addedTables create the tables that are missing in a database
+// created from an earlier schema.
+var addedTables = []string{
+	`CREATE TABLE IF NOT EXISTS health (
+  alias varchar(50) NOT NULL DEFAULT '' PRIMARY KEY,
+  url varchar(1024) NOT NULL DEFAULT '',
+  status int NOT NULL DEFAULT 0,
+  latency int NOT NULL DEFAULT 0,
+  checked_at datetime NOT NULL
+)`,
+	`CREATE TABLE IF NOT EXISTS salt (
+  day char(10) NOT NULL DEFAULT '' PRIMARY KEY,
+  salt varchar(64) NOT NULL DEFAULT ''
+)`,
+	`CREATE TABLE IF NOT EXISTS visit_daily (
+  alias varchar(50) NOT NULL DEFAULT '',
+  day datetime NOT NULL,
+  bot tinyint(1) NOT NULL DEFAULT 0,
+  pv int NOT NULL DEFAULT 0,
+  uv int NOT NULL DEFAULT 0,
+  PRIMARY KEY (alias, day, bot)
+)`,
+	`CREATE TABLE IF NOT EXISTS visit_daily_referer (
+  alias varchar(50) NOT NULL DEFAULT '',
+  day datetime NOT NULL,
+  bot tinyint(1) NOT NULL DEFAULT 0,
+  referer varchar(500) NOT NULL DEFAULT '',
+  count int NOT NULL DEFAULT 0,
+  PRIMARY KEY (alias, day, bot, referer)
+)`,
+	`CREATE TABLE IF NOT EXISTS visit_daily_ua (
+  alias varchar(50) NOT NULL DEFAULT '',
+  day datetime NOT NULL,
+  bot tinyint(1) NOT NULL DEFAULT 0,
+  family varchar(50) NOT NULL DEFAULT '',
+  count int NOT NULL DEFAULT 0,
+  PRIMARY KEY (alias, day, bot, family)
+)`,
+	`CREATE TABLE IF NOT EXISTS visit_daily_dim (
+  alias varchar(50) NOT NULL DEFAULT '',
+  day datetime NOT NULL,
+  bot tinyint(1) NOT NULL DEFAULT 0,
+  dim varchar(20) NOT NULL DEFAULT '',
+  k varchar(500) NOT NULL DEFAULT '',
+  count int NOT NULL DEFAULT 0,
+  uv int NOT NULL DEFAULT 0,
+  PRIMARY KEY (alias, day, bot, dim, k)
+)`,
+	`CREATE TABLE IF NOT EXISTS visit_rolled (
+  day datetime NOT NULL PRIMARY KEY
+)`,
+	`CREATE TABLE IF NOT EXISTS visit_hll (
+  alias varchar(50) NOT NULL DEFAULT '',
+  day datetime NOT NULL,
+  bot tinyint(1) NOT NULL DEFAULT 0,
+  sketch blob NOT NULL,
+  PRIMARY KEY (alias, day, bot)
+)`,
+	`CREATE TABLE IF NOT EXISTS visit_hll_total (
+  alias varchar(50) NOT NULL DEFAULT '',
+  bot tinyint(1) NOT NULL DEFAULT 0,
+  sketch blob NOT NULL,
+  PRIMARY KEY (alias, bot)
+)`,
+	`CREATE TABLE IF NOT EXISTS webhook_outbox (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  event varchar(50) NOT NULL DEFAULT '',
+  alias varchar(50) NOT NULL DEFAULT '',
+  url varchar(1024) NOT NULL DEFAULT '',
+  payload text NOT NULL,
+  state varchar(20) NOT NULL DEFAULT 'pending',
+  attempts int NOT NULL DEFAULT 0,
+  next_at datetime NOT NULL,
+  created_at datetime NOT NULL
+)`,
+	`CREATE INDEX IF NOT EXISTS webhook_outbox_state_next_at ON webhook_outbox (state, next_at)`,
+	`CREATE TABLE IF NOT EXISTS webhook_delivery (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  webhook_id int NOT NULL,
+  event varchar(50) NOT NULL DEFAULT '',
+  alias varchar(50) NOT NULL DEFAULT '',
+  url varchar(1024) NOT NULL DEFAULT '',
+  attempt int NOT NULL DEFAULT 0,
+  status int NOT NULL DEFAULT 0,
+  error varchar(500) NOT NULL DEFAULT '',
+  latency int NOT NULL DEFAULT 0,
+  created_at datetime NOT NULL
+)`,
+	`CREATE TABLE IF NOT EXISTS webhook_milestone (
+  alias varchar(50) NOT NULL DEFAULT '',
+  milestone bigint NOT NULL,
+  created_at datetime NOT NULL,
+  PRIMARY KEY (alias, milestone)
+)`,
+}
+
+// upgrade adds the missing tables and columns to an existing database.
+// An empty database is left to the migrations.
+func (db Store) upgrade() error {
+	n := 0
+	err := db.sqlxDB.Get(&n, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'collink'`)
+	if err != nil || n == 0 {
+		return err
+	}
+	for _, t := range addedTables {
+		_, err := db.sqlxDB.Exec(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	existing := map[string]map[string]bool{}
+	for _, c := range addedColumns {
+		cols, ok := existing[c.table]
+		if !ok {
+			names := []string{}
+			err := db.sqlxDB.Select(&names, `SELECT name FROM pragma_table_info(?)`, c.table)
+			if err != nil {
+				return err
+			}
+			cols = map[string]bool{}
+			for _, name := range names {
+				cols[name] = true
+			}
+			existing[c.table] = cols
+		}
+		if cols[c.name] {
+			continue
+		}
+		_, err := db.sqlxDB.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, c.table, c.name, c.def))
+		if err != nil {
+			return fmt.Errorf("failed to add %s.%s: %w", c.table, c.name, err)
+		}
+		cols[c.name] = true
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+// Package referer normalizes referers and classifies them into the
+// channels that bring visitors.
+package referer
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// The channels of referers.
+const (
+	Direct   = "direct"   // no referer
+	Search   = "search"   // search engines
+	Social   = "social"   // social networks and communities
+	Email    = "email"    // web and app mail clients
+	Internal = "internal" // the pages of the site itself
+	Referral = "referral" // any other site
+)
+
+// The domains of each channel. A domain matches itself and its
+// subdomains, and a domain ending with ".*" matches any top-level
+// domain, e.g. "google.*" matches google.com and www.google.co.uk. The
+// names of Android apps are matched as they are the hosts of
+// android-app:// referers.
+var (
+	searchDomains = []string{
+		"google.*", "bing.com", "duckduckgo.com", "baidu.com", "yandex.*",
+		"search.yahoo.com", "search.yahoo.co.jp", "sogou.com", "so.com",
+		"ecosia.org", "search.brave.com", "naver.com", "startpage.com",
+		"qwant.com", "ask.com", "com.google.android.googlequicksearchbox",
+	}
+	socialDomains = []string{
+		"twitter.com", "t.co", "x.com", "facebook.com", "fb.me",
+		"instagram.com", "linkedin.com", "lnkd.in", "reddit.com",
+		"news.ycombinator.com", "youtube.com", "youtu.be", "discord.com",
+		"discordapp.com", "slack.com", "t.me", "telegram.org",
+		"mastodon.social", "pinterest.com", "tiktok.com", "tumblr.com",
+		"quora.com", "weibo.com", "weibo.cn", "zhihu.com", "douban.com",
+		"bilibili.com", "v2ex.com", "medium.com", "com.twitter.android",
+		"com.facebook.katana", "com.linkedin.android", "com.reddit.frontpage",
+	}
+	emailDomains = []string{
+		"mail.google.com", "inbox.google.com", "outlook.live.com",
+		"outlook.office.com", "outlook.office365.com", "mail.yahoo.com",
+		"mail.yahoo.co.jp", "mail.qq.com", "exmail.qq.com", "mail.163.com",
+		"mail.126.com", "mail.proton.me", "mail.protonmail.com",
+		"mail.zoho.com", "mail.aol.com", "com.google.android.gm",
+		"com.microsoft.office.outlook",
+	}
+)
+
+// Host returns the normalized host of the given referer, i.e. the host
+// in lower case without the port and the "www." prefix, or an empty
+// string if the referer has no host.
+func Host(ref string) string {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return normalizeHost(u.Host)
+}
+
+// Path returns the normalized host of the given referer followed by its
+// path without the query, the fragment and the trailing slash, e.g.
+// "news.ycombinator.com/item" of "https://news.ycombinator.com/item?id=1",
+// or an empty string if the referer has no host.
+func Path(ref string) string {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return normalizeHost(u.Host) + strings.TrimRight(u.EscapedPath(), "/")
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return strings.TrimPrefix(host, "www.")
+}
+
+// Channel classifies the given referer into a channel. The referers
+// from the given internal hosts, such as the host of the site itself,
+// are Internal.
+func Channel(ref string, internal ...string) string {
+	if strings.TrimSpace(ref) == "" {
+		return Direct
+	}
+	host := Host(ref)
+	if host == "" {
+		return Referral
+	}
+	for _, h := range internal {
+		if h != "" && host == normalizeHost(h) {
+			return Internal
+		}
+	}
+	switch {
+	case matchAny(host, emailDomains):
+		return Email
+	case matchAny(host, searchDomains):
+		return Search
+	case matchAny(host, socialDomains):
+		return Social
+	}
+	return Referral
+}
+
+func matchAny(host string, domains []string) bool {
+	for _, d := range domains {
+		if match(host, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// secondLevels are the labels of the second-level domains under which
+// the country code top-level domains register names, e.g. "co" of
+// "co.uk" and "com" of "com.au".
+var secondLevels = map[string]bool{
+	"co": true, "com": true, "net": true, "org": true, "ac": true,
+	"gov": true, "edu": true, "ne": true, "or": true, "go": true,
+}
+
+// match reports whether the host is the domain or its subdomain. A
+// domain ending with ".*" matches the name followed by a top-level
+// domain, either a single label or a second-level domain of a country
+// code, e.g. "co.uk", but not any other domain, e.g. "evil.com".
+func match(host, domain string) bool {
+	if !strings.HasSuffix(domain, ".*") {
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}
+	name := strings.TrimSuffix(domain, "*")
+	labels := strings.Split(host, ".")
+	for i := range labels {
+		rest := strings.Join(labels[i:], ".")
+		if !strings.HasPrefix(rest, name) {
+			continue
+		}
+		return topLevel(strings.Split(strings.TrimPrefix(rest, name), "."))
+	}
+	return false
+}
+
+// topLevel reports whether the labels form a top-level domain.
+func topLevel(labels []string) bool {
+	switch len(labels) {
+	case 1:
+		return labels[0] != ""
+	case 2:
+		return secondLevels[labels[0]] && len(labels[1]) == 2
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package referer
+
+import "testing"
+
+func TestHostPath(t *testing.T) {
+	tests := []struct {
+		ref  string
+		host string
+		path string
+	}{
+		{"", "", ""},
+		{"not a url", "", ""},
+		{"https://www.Google.com/search?q=redir", "google.com", "google.com/search"},
+		{"https://news.ycombinator.com:443/item?id=1#c", "news.ycombinator.com", "news.ycombinator.com/item"},
+		{"https://golang.design/", "golang.design", "golang.design"},
+		{"android-app://com.google.android.gm/", "com.google.android.gm", "com.google.android.gm"},
+	}
+	for _, tt := range tests {
+		if got := Host(tt.ref); got != tt.host {
+			t.Fatalf("Host(%q) want %q, got %q", tt.ref, tt.host, got)
+		}
+		if got := Path(tt.ref); got != tt.path {
+			t.Fatalf("Path(%q) want %q, got %q", tt.ref, tt.path, got)
+		}
+	}
+}
+
+func TestChannel(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"", Direct},
+		{"https://www.google.com/", Search},
+		{"https://www.google.co.uk/", Search},
+		{"https://google.com.hk/search?q=go", Search},
+		{"https://www.bing.com/search?q=go", Search},
+		{"https://duckduckgo.com/", Search},
+		{"https://googleusercontent.com/", Referral},
+		{"https://google.example.evil.com/", Referral},
+		{"https://google.evil.com/", Referral},
+		{"https://google.co.com/", Referral},
+		{"https://yandex.evil.com/", Referral},
+		{"https://yandex.ru/search/?text=go", Search},
+		{"https://www.google.co.jp/", Search},
+		{"https://t.co/abc", Social},
+		{"https://m.facebook.com/", Social},
+		{"https://news.ycombinator.com/item?id=1", Social},
+		{"https://mail.google.com/mail/u/0/", Email},
+		{"android-app://com.google.android.gm/", Email},
+		{"https://outlook.live.com/", Email},
+		{"https://golang.design/s/", Internal},
+		{"https://www.golang.design/", Internal},
+		{"https://changkun.de/blog", Referral},
+		{"garbage", Referral},
+	}
+	for _, tt := range tests {
+		if got := Channel(tt.ref, "golang.design"); got != tt.want {
+			t.Fatalf("Channel(%q) want %q, got %q", tt.ref, tt.want, got)
+		}
+	}
+}
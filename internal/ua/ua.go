@@ -0,0 +1,208 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+// Package ua classifies user agents.
+package ua
+
+import "strings"
+
+// families are the user agent families and the tokens that identify
+// them. The tokens are checked in order since most browsers claim to be
+// other browsers as well, e.g. Edge user agents contain "Chrome/" and
+// "Safari/".
+var families = []struct {
+	name   string
+	tokens []string
+}{
+	{"curl", []string{"curl/"}},
+	{"Wget", []string{"wget/"}},
+	{"Go", []string{"go-http-client/"}},
+	{"Edge", []string{"edg/", "edge/", "edga/", "edgios/"}},
+	{"Opera", []string{"opr/", "opera"}},
+	{"Samsung Internet", []string{"samsungbrowser/"}},
+	{"Firefox", []string{"firefox/", "fxios/"}},
+	{"Chrome", []string{"chrome/", "crios/", "chromium/"}},
+	{"Safari", []string{"safari/"}},
+	{"IE", []string{"msie ", "trident/"}},
+}
+
+// Family returns the family of the given user agent, e.g. Chrome or
+// Firefox, "Unknown" if the user agent is empty, or "Other" if the
+// family is not recognized.
+func Family(ua string) string {
+	name, _ := family(ua)
+	return name
+}
+
+// family returns the family of the given user agent and the token that
+// identifies it.
+func family(ua string) (name, token string) {
+	if strings.TrimSpace(ua) == "" {
+		return "Unknown", ""
+	}
+	if IsBot(ua) {
+		return "Bot", ""
+	}
+	ua = strings.ToLower(ua)
+	for _, f := range families {
+		for _, t := range f.tokens {
+			if strings.Contains(ua, t) {
+				return f.name, t
+			}
+		}
+	}
+	return "Other", ""
+}
+
+// Agent is a parsed user agent.
+type Agent struct {
+	Browser string // the family of the browser, e.g. Chrome
+	Version string // the major version of the browser, e.g. 96
+	OS      string // e.g. Windows, macOS, iOS, Android or Linux
+	Device  string // Desktop, Mobile, Tablet, Bot, Unknown or Other
+}
+
+// oses are the operating systems and the tokens that identify them, in
+// the order to be checked, e.g. iOS user agents contain "Mac OS X", and
+// Windows Phone user agents contain "Android".
+var oses = []struct {
+	name   string
+	tokens []string
+}{
+	{"Windows Phone", []string{"windows phone"}},
+	{"Windows", []string{"windows"}},
+	{"iOS", []string{"iphone", "ipad", "ipod"}},
+	{"Android", []string{"android"}},
+	{"Chrome OS", []string{"cros "}}, // not "microsoft"
+	{"macOS", []string{"macintosh", "mac os x"}},
+	{"Linux", []string{"linux", "x11"}},
+}
+
+// Parse parses the browser, its major version, the operating system and
+// the device type of the given user agent.
+func Parse(ua string) Agent {
+	a := Agent{}
+	var token string
+	a.Browser, token = family(ua)
+	if a.Browser == "Unknown" {
+		a.OS, a.Device = "Unknown", "Unknown"
+		return a
+	}
+
+	lower := strings.ToLower(ua)
+	a.Version = version(lower, a.Browser, token)
+	a.OS = "Other"
+	for _, o := range oses {
+		if containsAny(lower, o.tokens) {
+			a.OS = o.name
+			break
+		}
+	}
+
+	switch {
+	case a.Browser == "Bot":
+		a.Device = "Bot"
+	case containsAny(lower, []string{"ipad", "tablet"}) ||
+		a.OS == "Android" && !strings.Contains(lower, "mobile"):
+		a.Device = "Tablet"
+	case containsAny(lower, []string{"mobi", "iphone", "ipod", "windows phone"}):
+		a.Device = "Mobile"
+	case a.OS == "Windows" || a.OS == "macOS" || a.OS == "Linux" || a.OS == "Chrome OS":
+		a.Device = "Desktop"
+	default:
+		a.Device = "Other"
+	}
+	return a
+}
+
+// version returns the major version of the browser that follows its
+// token in the lower-cased user agent, e.g. 96 of "chrome/96.0.4664.45".
+func version(ua, browser, token string) string {
+	switch {
+	case browser == "Safari":
+		token = "version/"
+	case token == "trident/":
+		token = "rv:"
+	}
+	if token == "" {
+		return ""
+	}
+	i := strings.Index(ua, token)
+	if i < 0 {
+		return ""
+	}
+	v := ua[i+len(token):]
+	n := 0
+	for n < len(v) && v[n] >= '0' && v[n] <= '9' {
+		n++
+	}
+	return v[:n]
+}
+
+func containsAny(s string, tokens []string) bool {
+	for _, t := range tokens {
+		if strings.Contains(s, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// BotPatterns are the lower-cased substrings of the user agents of the
+// well-known bots, crawlers and link unfurlers. They are specific enough
+// not to match devices such as CUBOT phones, or the in-app browsers of
+// apps such as Pinterest, Snapchat, Tumblr and Mastodon.
+var BotPatterns = []string{
+	// generic tokens of most crawlers, e.g. Googlebot/2.1 and the
+	// "+http://..." link to the documentation of a crawler.
+	"bot/", "+http", "crawler", "spider", "scraper", "slurp",
+	// bots whose user agents may have no generic token.
+	"googlebot", "bingbot", "slackbot", "twitterbot", "discordbot",
+	"linkedinbot", "telegrambot", "applebot", "duckduckbot", "yandexbot",
+	"redditbot", "bitlybot", "pinterestbot", "petalbot", "ahrefsbot",
+	"semrushbot", "mj12bot",
+	// link unfurlers and fetchers without a bot token.
+	"facebookexternalhit", "facebookcatalog", "whatsapp/", "skypeuripreview",
+	"slack-imgproxy", "embedly", "iframely", "vkshare", "tumblr/14.",
+	"http.rb/", "snap url preview", "google-inspectiontool", "googleother",
+	"feedfetcher", "mediapartners-google", "ia_archiver", "archive.org_bot",
+	"headlesschrome", "phantomjs", "lighthouse", "pingdom", "uptimerobot",
+}
+
+// Bots classifies user agents as bots by case-insensitive substrings.
+type Bots struct {
+	patterns []string
+}
+
+// NewBots returns a classifier that matches the default BotPatterns and
+// the given extra patterns.
+func NewBots(extra ...string) *Bots {
+	b := &Bots{patterns: append([]string(nil), BotPatterns...)}
+	for _, p := range extra {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p != "" {
+			b.patterns = append(b.patterns, p)
+		}
+	}
+	return b
+}
+
+// Match reports whether the given user agent is a bot.
+func (b *Bots) Match(ua string) bool {
+	ua = strings.ToLower(ua)
+	for _, p := range b.patterns {
+		if strings.Contains(ua, p) {
+			return true
+		}
+	}
+	return false
+}
+
+var defaultBots = NewBots()
+
+// IsBot reports whether the given user agent matches the default
+// BotPatterns.
+func IsBot(ua string) bool {
+	return defaultBots.Match(ua)
+}
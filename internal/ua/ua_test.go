@@ -0,0 +1,101 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package ua
+
+import "testing"
+
+func TestFamily(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want string
+	}{
+		{"", "Unknown"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Safari/537.36", "Chrome"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Safari/537.36 Edg/96.0.1054.29", "Edge"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Safari/605.1.15", "Safari"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:94.0) Gecko/20100101 Firefox/94.0", "Firefox"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 15_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/96.0.4664.53 Mobile/15E148 Safari/604.1", "Chrome"},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "Bot"},
+		{"curl/7.79.1", "curl"},
+		{"Go-http-client/1.1", "Go"},
+		{"something", "Other"},
+	}
+	for _, tt := range tests {
+		if got := Family(tt.ua); got != tt.want {
+			t.Fatalf("Family(%q) want %q, got %q", tt.ua, tt.want, got)
+		}
+	}
+}
+
+func TestBots(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want bool
+	}{
+		{"", false},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:94.0) Gecko/20100101 Firefox/94.0", false},
+		{"curl/7.79.1", false},
+		{"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", true},
+		{"Twitterbot/1.0", true},
+		{"Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)", true},
+		{"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", true},
+		{"WhatsApp/2.21.12.21 A", true},
+		{"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", true},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/96.0.4664.45 Safari/537.36", true},
+		{"MyInternalChecker/1.0", false},
+		{"Pinterest/0.2 (+http://www.pinterest.com/bot.html)", true},
+		{"Mozilla/5.0 (compatible; Pinterestbot/1.0; +http://www.pinterest.com/bot.html)", true},
+		{"Tumblr/14.0.835.186", true},
+		{"http.rb/5.1.1 (Mastodon/4.2.1; +https://mastodon.social/)", true},
+		{"Mozilla/5.0 (Linux; Android 10; Snap URL Preview Service; bot; snapchat; https://developers.snap.com/robots)", true},
+		// devices and in-app browsers are not bots.
+		{"Mozilla/5.0 (Linux; Android 11; CUBOT KingKong 5 Pro) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Mobile Safari/537.36", false},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 15_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 [Pinterest/iOS]", false},
+		{"Mozilla/5.0 (Linux; Android 12; Pixel 6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Mobile Safari/537.36 [Pinterest/Android]", false},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 15_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 Snapchat/11.57.0.35 (like Safari/8612.2.9.0.10, panda)", false},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 15_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 Tumblr/iOS/20.1", false},
+		{"Mastodon/2022.11.1 CFNetwork/1390 Darwin/22.0.0", false},
+	}
+	for _, tt := range tests {
+		if got := IsBot(tt.ua); got != tt.want {
+			t.Fatalf("IsBot(%q) want %v, got %v", tt.ua, tt.want, got)
+		}
+	}
+
+	b := NewBots(" MyInternalChecker ")
+	if !b.Match("MyInternalChecker/1.0") {
+		t.Fatalf("Bots does not match an extra pattern")
+	}
+	if !b.Match("Twitterbot/1.0") {
+		t.Fatalf("Bots does not match a default pattern")
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want Agent
+	}{
+		{"", Agent{"Unknown", "", "Unknown", "Unknown"}},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Safari/537.36", Agent{"Chrome", "96", "Windows", "Desktop"}},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Safari/537.36 Edg/96.0.1054.29", Agent{"Edge", "96", "Windows", "Desktop"}},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Safari/605.1.15", Agent{"Safari", "15", "macOS", "Desktop"}},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:94.0) Gecko/20100101 Firefox/94.0", Agent{"Firefox", "94", "Linux", "Desktop"}},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 15_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/96.0.4664.53 Mobile/15E148 Safari/604.1", Agent{"Chrome", "96", "iOS", "Mobile"}},
+		{"Mozilla/5.0 (iPad; CPU OS 15_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Mobile/15E148 Safari/604.1", Agent{"Safari", "15", "iOS", "Tablet"}},
+		{"Mozilla/5.0 (Linux; Android 12; Pixel 6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.104 Mobile Safari/537.36", Agent{"Chrome", "96", "Android", "Mobile"}},
+		{"Mozilla/5.0 (Linux; Android 11; SM-T870) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/15.0 Chrome/90.0.4430.210 Safari/537.36", Agent{"Samsung Internet", "15", "Android", "Tablet"}},
+		{"Mozilla/5.0 (X11; CrOS x86_64 14268.67.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.111 Safari/537.36", Agent{"Chrome", "96", "Chrome OS", "Desktop"}},
+		{"Microsoft Office/16.0 (Macintosh; Mac OS X 10_15_7; Microsoft Outlook 16.55.1111; Pro)", Agent{"Other", "", "macOS", "Desktop"}},
+		{"Mozilla/5.0 (Windows NT 10.0; WOW64; Trident/7.0; rv:11.0) like Gecko", Agent{"IE", "11", "Windows", "Desktop"}},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", Agent{"Bot", "", "Other", "Bot"}},
+		{"curl/7.79.1", Agent{"curl", "7", "Other", "Other"}},
+	}
+	for _, tt := range tests {
+		if got := Parse(tt.ua); got != tt.want {
+			t.Fatalf("Parse(%q) want %+v, got %+v", tt.ua, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+	"golang.design/x/redir/internal/ua"
+)
+
+const (
+	// liveBuffer is the number of events buffered for a subscriber, the
+	// events beyond it are dropped for the subscriber.
+	liveBuffer = 64
+	// liveMaxSubscribers bounds the number of concurrent subscribers.
+	liveMaxSubscribers = 100
+	// liveHeartbeat is the interval of the comments that keep an idle
+	// stream open through proxies.
+	liveHeartbeat = 15 * time.Second
+)
+
+// liveEvent is a recorded visit that is streamed to the subscribers. It
+// does not contain the IP and the full user agent of the visitor.
+type liveEvent struct {
+	Alias   string    `json:"alias"`
+	Time    time.Time `json:"time"`
+	Referer string    `json:"referer"` // the referer host, empty if direct
+	UA      string    `json:"ua"`      // the user agent family
+	Country string    `json:"country"`
+	Bot     bool      `json:"bot"`
+}
+
+// subscriber receives the events of an alias, or of all aliases if the
+// alias is empty.
+type subscriber struct {
+	dropped uint64 // events dropped because the buffer is full, first for 64-bit alignment
+	alias   string
+	bots    bool // whether the visits of bots are received
+	events  chan liveEvent
+}
+
+// broker fans out the recorded visits to the subscribers of the live
+// stream. Publishing never blocks, so that a slow subscriber can neither
+// delay the recording of visits nor the other subscribers.
+type broker struct {
+	mu     sync.Mutex
+	subs   map[*subscriber]struct{}
+	closed bool
+}
+
+func newBroker() *broker {
+	return &broker{subs: map[*subscriber]struct{}{}}
+}
+
+// subscribe adds a subscriber. It returns nil if the broker is closed or
+// has too many subscribers.
+func (b *broker) subscribe(alias string, bots bool) *subscriber {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || len(b.subs) >= liveMaxSubscribers {
+		return nil
+	}
+	s := &subscriber{alias: alias, bots: bots, events: make(chan liveEvent, liveBuffer)}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// unsubscribe removes a subscriber and closes its events.
+func (b *broker) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+	delete(b.subs, s)
+	close(s.events)
+}
+
+// subscribers returns the number of subscribers.
+func (b *broker) subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// publish sends the visits to the subscribers of their aliases.
+func (b *broker) publish(vs []*model.Visit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subs) == 0 {
+		return
+	}
+	for _, v := range vs {
+		e := liveEvent{
+			Alias:   v.Alias,
+			Time:    v.Time.UTC(),
+			Referer: v.RefererHost,
+			UA:      ua.Family(v.UA),
+			Country: v.Country,
+			Bot:     v.Bot,
+		}
+		for s := range b.subs {
+			if s.alias != "" && s.alias != e.Alias || e.Bot && !s.bots {
+				continue
+			}
+			select {
+			case s.events <- e:
+			default:
+				atomic.AddUint64(&s.dropped, 1)
+			}
+		}
+	}
+}
+
+// close closes the events of all subscribers, which ends their streams,
+// and stops accepting subscribers.
+func (b *broker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.events)
+	}
+}
+
+// liveWriter writes visits to the data store, and publishes them to the
+// broker once they are written.
+type liveWriter struct {
+	visitWriter
+	live *broker
+}
+
+func (w *liveWriter) RecordVisits(ctx context.Context, vs []*model.Visit) error {
+	err := w.visitWriter.RecordVisits(ctx, vs)
+	if err != nil {
+		return err
+	}
+	w.live.publish(vs)
+	return nil
+}
+
+// liveStream streams the recorded visits of the alias of the a parameter,
+// or of all aliases, as server-sent events. It requires the API token.
+func (s *server) liveStream(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if !authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "a valid API token is required", http.StatusUnauthorized)
+		return nil
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return nil
+	}
+	params := r.URL.Query()
+	bots := false
+	if v := params.Get("bots"); v != "" {
+		var err error
+		bots, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid bots parameter: %v", err), http.StatusBadRequest)
+			return nil
+		}
+	}
+	sub := s.live.subscribe(params.Get("a"), bots)
+	if sub == nil {
+		http.Error(w, "too many live streams", http.StatusServiceUnavailable)
+		return nil
+	}
+	defer s.live.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disables the buffering of nginx
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	f.Flush()
+
+	t := time.NewTicker(liveHeartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			_, err := fmt.Fprintf(w, ": dropped %d\n\n", atomic.LoadUint64(&sub.dropped))
+			if err != nil {
+				return nil
+			}
+		case e, ok := <-sub.events:
+			if !ok {
+				return nil
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("cannot encode live event: %v\n", err)
+				return nil
+			}
+			_, err = fmt.Fprintf(w, "event: visit\ndata: %s\n\n", b)
+			if err != nil {
+				return nil
+			}
+		}
+		f.Flush()
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+func TestBroker(t *testing.T) {
+	b := newBroker()
+	all := b.subscribe("", false)
+	one := b.subscribe("a", true)
+
+	b.publish([]*model.Visit{
+		{Alias: "a", RefererHost: "t.co", UA: "Mozilla/5.0 (X11; Linux x86_64; rv:94.0) Gecko/20100101 Firefox/94.0", Country: "DE"},
+		{Alias: "b"},
+		{Alias: "a", UA: "Googlebot/2.1", Bot: true},
+	})
+	if len(all.events) != 2 || len(one.events) != 2 {
+		t.Fatalf("broker sends %d and %d events, want 2 and 2", len(all.events), len(one.events))
+	}
+	e := <-one.events
+	if e.Alias != "a" || e.Referer != "t.co" || e.UA != "Firefox" || e.Country != "DE" {
+		t.Fatalf("broker sends a wrong event: %+v", e)
+	}
+	if e = <-one.events; !e.Bot {
+		t.Fatalf("broker does not send the visits of bots to the subscriber of bots: %+v", e)
+	}
+
+	// a full subscriber drops events rather than blocking the others.
+	for i := 0; i < liveBuffer+10; i++ {
+		b.publish([]*model.Visit{{Alias: "a"}})
+	}
+	if all.dropped != 12 || len(one.events) != liveBuffer {
+		t.Fatalf("broker drops %d events and buffers %d events, want 12 and %d", all.dropped, len(one.events), liveBuffer)
+	}
+
+	b.unsubscribe(one)
+	b.close()
+	if _, ok := <-all.events; !ok {
+		t.Fatalf("closed broker loses buffered events")
+	}
+	if b.subscribe("", false) != nil {
+		t.Fatalf("closed broker accepts subscribers")
+	}
+}
+
+func TestLiveStream(t *testing.T) {
+	conf.APIToken = "token"
+	defer func() { conf.APIToken = "" }()
+
+	s := &server{live: newBroker()}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.stats(r.Context(), w, r); err != nil {
+			t.Errorf("stats with err: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/s/?live=1&token=wrong")
+	if err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("live stream with a wrong token want status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/s/?live=1&a=a", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("live stream want an event stream, got %d %v", resp.StatusCode, resp.Header)
+	}
+	r := bufio.NewReader(resp.Body)
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, ":") {
+		t.Fatalf("live stream does not start with a comment: %q, %v", line, err)
+	}
+
+	// the visits are published once they are written.
+	w := &liveWriter{&fakeVisitWriter{}, s.live}
+	w.RecordVisits(ctx, []*model.Visit{{Alias: "b"}, {Alias: "a", Country: "US"}})
+	var data string
+	for data == "" {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("cannot read the live stream: %v", err)
+		}
+		if strings.HasPrefix(line, "event:") && line != "event: visit\n" {
+			t.Fatalf("live stream sends a wrong event: %q", line)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			data = strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+		}
+	}
+	e := liveEvent{}
+	if err := json.Unmarshal([]byte(data), &e); err != nil || e.Alias != "a" || e.Country != "US" {
+		t.Fatalf("live stream sends a wrong visit: %s, %v", data, err)
+	}
+
+	// closing the broker ends the stream.
+	s.live.close()
+	for {
+		if _, err := r.ReadString('\n'); err != nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,424 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+// maxAliasLabels bounds the number of aliases that are labeled in the
+// metrics, the redirects of any other alias are labeled otherLabel.
+const maxAliasLabels = 200
+
+// The labels of the redirects of aliases without their own label.
+const (
+	otherLabel     = "(other)"     // beyond maxAliasLabels
+	unknownLabel   = "(unknown)"   // the alias is not found
+	protectedLabel = "(protected)" // the alias is password protected or signed
+)
+
+// lookupBuckets are the upper bounds of the buckets of the lookup
+// latencies in seconds.
+var lookupBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// metrics collects the metrics of the server and writes them in the
+// Prometheus text format.
+type metrics struct {
+	redirects *counterVec   // by alias and status
+	lookups   *histogramVec // by the source of the redirect
+	cache     *counterVec   // by hit or miss
+	vcs       *counterVec   // by the result of the request
+	dbErrors  *counterVec
+	funcs     []*funcMetric // read from the other parts of the server
+
+	mu      sync.Mutex
+	aliases map[string]struct{} // the labeled aliases
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		redirects: newCounterVec("redir_redirects_total", "Requests of short links by alias and status code.", "alias", "status"),
+		lookups:   newHistogramVec("redir_lookup_duration_seconds", "Latency of alias lookups by the source of the redirect.", "source", lookupBuckets),
+		cache:     newCounterVec("redir_cache_requests_total", "Alias cache lookups by result.", "result"),
+		vcs:       newCounterVec("redir_vcs_requests_total", "Outbound requests to the VCS for unknown aliases by result.", "result"),
+		dbErrors:  newCounterVec("redir_db_errors_total", "Errors of the data store."),
+		aliases:   map[string]struct{}{},
+	}
+}
+
+// redirect counts a request of a short link of the given alias, which is
+// empty if the alias is not found.
+func (m *metrics) redirect(alias string, status int) {
+	switch {
+	case alias == "":
+		alias = unknownLabel
+	default:
+		m.mu.Lock()
+		if _, ok := m.aliases[alias]; !ok {
+			if len(m.aliases) < maxAliasLabels {
+				m.aliases[alias] = struct{}{}
+			} else {
+				alias = otherLabel
+			}
+		}
+		m.mu.Unlock()
+	}
+	m.redirects.inc(alias, strconv.Itoa(status))
+}
+
+// dbError counts an error of the data store if err is not nil, and
+// returns err.
+func (m *metrics) dbError(err error) error {
+	if err != nil {
+		m.dbErrors.inc()
+	}
+	return err
+}
+
+// register adds a metric whose samples are read when the metrics are
+// written.
+func (m *metrics) register(f *funcMetric) {
+	m.funcs = append(m.funcs, f)
+}
+
+func (m *metrics) write(w io.Writer) error {
+	b := bytes.Buffer{}
+	m.redirects.write(&b)
+	m.lookups.write(&b)
+	m.cache.write(&b)
+	m.vcs.write(&b)
+	m.dbErrors.write(&b)
+	for _, f := range m.funcs {
+		f.write(&b)
+	}
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// handler serves the metrics. It requires the API token.
+func (m *metrics) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "a valid API token is required", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.write(w)
+	})
+}
+
+// registerMetrics registers the metrics of the visit recorder and of the
+// live stream.
+func (s *server) registerMetrics() {
+	s.metrics.register(&funcMetric{
+		name: "redir_visit_queue_depth", help: "Visits waiting in the queue to be recorded.", typ: "gauge",
+		samples: func() map[string]float64 {
+			return map[string]float64{"": float64(s.visits.depth())}
+		},
+	})
+	s.metrics.register(&funcMetric{
+		name: "redir_visits_total", help: "Visits by what happened to them in the recorder.", typ: "counter",
+		label: "result",
+		samples: func() map[string]float64 {
+			c := s.visits.counters()
+			return map[string]float64{
+				"queued":   float64(c.Queued),
+				"recorded": float64(c.Recorded),
+				"dropped":  float64(c.Dropped),
+				"sampled":  float64(c.Sampled),
+				"failed":   float64(c.Failed),
+			}
+		},
+	})
+	s.metrics.register(&funcMetric{
+		name: "redir_live_subscribers", help: "Open live streams of visits.", typ: "gauge",
+		samples: func() map[string]float64 {
+			return map[string]float64{"": float64(s.live.subscribers())}
+		},
+	})
+}
+
+// metricsWriter writes visits to the data store, and counts the errors.
+type metricsWriter struct {
+	visitWriter
+	metrics *metrics
+}
+
+func (w *metricsWriter) RecordVisits(ctx context.Context, vs []*model.Visit) error {
+	return w.metrics.dbError(w.visitWriter.RecordVisits(ctx, vs))
+}
+
+// instrument counts the requests of short links by their aliases and
+// status codes. The aliases that are password protected or signed are
+// not labeled by their names.
+func (m *metrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		r, rt := withRoute(r)
+		next.ServeHTTP(sw, r)
+		// the stats page is not a short link.
+		if strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, conf.S.Prefix), "/") == "" {
+			return
+		}
+		alias := rt.alias
+		if rt.protected {
+			alias = protectedLabel
+		}
+		m.redirect(alias, sw.code())
+	})
+}
+
+// statusWriter records the status code and the size of a response. It
+// is a Flusher if the underlying writer is.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// code returns the status code of the response, which is 200 if nothing
+// is written.
+func (w *statusWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// route is what a handler resolves from a request.
+type route struct {
+	alias     string
+	protected bool   // the alias is password protected or signed
+	target    string // where the visitor is sent
+}
+
+type routeKey struct{}
+
+// withRoute returns the request with an empty route in its context.
+func withRoute(r *http.Request) (*http.Request, *route) {
+	if rt, ok := r.Context().Value(routeKey{}).(*route); ok {
+		return r, rt
+	}
+	rt := &route{}
+	return r.WithContext(context.WithValue(r.Context(), routeKey{}, rt)), rt
+}
+
+// resolved records the resolved redirect in the route of the request
+// context, if any.
+func resolved(ctx context.Context, red *model.Redirect) {
+	if rt, ok := ctx.Value(routeKey{}).(*route); ok {
+		rt.alias = red.Alias
+		rt.protected = red.Password != "" || red.Signed
+	}
+}
+
+// resolvedTarget records where the visitor is sent in the route of the
+// request context, if any.
+func resolvedTarget(ctx context.Context, target string) {
+	if rt, ok := ctx.Value(routeKey{}).(*route); ok {
+		rt.target = target
+	}
+}
+
+// counterVec is a counter with labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]uint64 // by the formatted labels
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]uint64{}}
+}
+
+// inc increments the counter of the given label values.
+func (c *counterVec) inc(values ...string) {
+	l := formatLabels(c.labels, values)
+	c.mu.Lock()
+	c.values[l]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+	for _, l := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, l, c.values[l])
+	}
+}
+
+// histogramVec is a histogram with a label.
+type histogramVec struct {
+	name, help string
+	label      string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram // by the label value
+}
+
+type histogram struct {
+	counts []uint64 // of each bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, series: map[string]*histogram{}}
+}
+
+// observe records a duration of the given label value.
+func (h *histogramVec) observe(value string, d time.Duration) {
+	s := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.series[value]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[value] = hist
+	}
+	if i := sort.SearchFloat64s(h.buckets, s); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += s
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, v := range sortedKeys(h.series) {
+		hist := h.series[v]
+		var n uint64
+		for i, b := range h.buckets {
+			n += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels([]string{h.label, "le"}, []string{v, formatFloat(b)}), n)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels([]string{h.label, "le"}, []string{v, "+Inf"}), hist.count)
+		l := formatLabels([]string{h.label}, []string{v})
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, l, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, l, hist.count)
+	}
+}
+
+// funcMetric is a counter or a gauge whose samples are read from a
+// function, such as the counters of the visit recorder.
+type funcMetric struct {
+	name, help, typ string
+	label           string // empty if the samples have no label
+	samples         func() map[string]float64
+}
+
+func (f *funcMetric) write(w io.Writer) {
+	writeHeader(w, f.name, f.help, f.typ)
+	samples := f.samples()
+	for _, v := range sortedKeys(samples) {
+		l := ""
+		if f.label != "" {
+			l = formatLabels([]string{f.label}, []string{v})
+		}
+		fmt.Fprintf(w, "%s%s %s\n", f.name, l, formatFloat(samples[v]))
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// formatLabels formats the label pairs, e.g. {alias="a",status="307"}.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	b := strings.Builder{}
+	b.WriteString("{")
+	for i, n := range names {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		b.WriteString(n + `="` + labelEscaper.Replace(v) + `"`)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[string]uint64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
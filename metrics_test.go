@@ -0,0 +1,194 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+	"golang.design/x/redir/internal/ua"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	m := newMetrics()
+	m.redirect("a", http.StatusTemporaryRedirect)
+	m.redirect("a", http.StatusTemporaryRedirect)
+	m.redirect(`b"\`, http.StatusGone)
+	m.redirect("", http.StatusTemporaryRedirect)
+	m.lookups.observe("db", 2*time.Millisecond)
+	m.lookups.observe("db", time.Minute)
+
+	b := strings.Builder{}
+	if err := m.write(&b); err != nil {
+		t.Fatalf("write with err: %v", err)
+	}
+	got := b.String()
+	for _, want := range []string{
+		"# TYPE redir_redirects_total counter\n",
+		`redir_redirects_total{alias="a",status="307"} 2` + "\n",
+		`redir_redirects_total{alias="b\"\\",status="410"} 1` + "\n",
+		`redir_redirects_total{alias="(unknown)",status="307"} 1` + "\n",
+		"# TYPE redir_lookup_duration_seconds histogram\n",
+		`redir_lookup_duration_seconds_bucket{source="db",le="0.001"} 0` + "\n",
+		`redir_lookup_duration_seconds_bucket{source="db",le="0.0025"} 1` + "\n",
+		`redir_lookup_duration_seconds_bucket{source="db",le="5"} 1` + "\n",
+		`redir_lookup_duration_seconds_bucket{source="db",le="+Inf"} 2` + "\n",
+		`redir_lookup_duration_seconds_sum{source="db"} 60.002` + "\n",
+		`redir_lookup_duration_seconds_count{source="db"} 2` + "\n",
+		"redir_db_errors_total 0\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("metrics do not contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestMetricsAliasCap(t *testing.T) {
+	m := newMetrics()
+	for i := 0; i < maxAliasLabels+10; i++ {
+		m.redirect(fmt.Sprintf("a%d", i), http.StatusTemporaryRedirect)
+	}
+	// the labeled aliases keep their labels.
+	m.redirect("a0", http.StatusTemporaryRedirect)
+
+	if n := len(m.redirects.values); n != maxAliasLabels+1 {
+		t.Fatalf("redirects want %d series, got %d", maxAliasLabels+1, n)
+	}
+	if n := m.redirects.values[`{alias="(other)",status="307"}`]; n != 10 {
+		t.Fatalf("redirects of other aliases want 10, got %d", n)
+	}
+	if n := m.redirects.values[`{alias="a0",status="307"}`]; n != 2 {
+		t.Fatalf("redirects of a0 want 2, got %d", n)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	conf.parse()
+	db, err := model.NewDB(conf.Store)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	err = db.StoreAlias(ctx, &model.Redirect{Alias: "metrics", URL: "https://example.com", CreatedAt: time.Now().UTC()})
+	if err != nil {
+		t.Fatalf("StoreAlias with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "metrics")
+	err = db.StoreAlias(ctx, &model.Redirect{Alias: "metrics-signed", URL: "https://example.com", Signed: true, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		t.Fatalf("StoreAlias with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "metrics-signed")
+	token := conf.APIToken
+	conf.APIToken = "secret"
+	defer func() { conf.APIToken = token }()
+
+	// the VCS does not know any alias.
+	vcs := httptest.NewServer(http.NotFoundHandler())
+	defer vcs.Close()
+	repoPath := conf.X.RepoPath
+	conf.X.RepoPath = vcs.URL
+	defer func() { conf.X.RepoPath = repoPath }()
+
+	s := &server{
+		db:      db,
+		cache:   newLRU(true),
+		live:    newBroker(),
+		bots:    ua.NewBots(),
+		metrics: newMetrics(),
+	}
+	s.visits = newRecorder(&fakeVisitWriter{}, nil, recorderConfig{Workers: 1, Batch: 10, Interval: time.Hour})
+	defer s.visits.close()
+	s.registerMetrics()
+	noticeTmpl = template.Must(template.ParseFiles("public/notice.html"))
+
+	mux := http.NewServeMux()
+	mux.Handle(conf.S.Prefix, s.metrics.instrument(s.shortHandler()))
+	mux.Handle("/metrics", s.metrics.handler())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for _, path := range []string{"metrics", "metrics", "metrics-unknown", "metrics-signed"} {
+		resp, err := client.Get(ts.URL + conf.S.Prefix + path)
+		if err != nil {
+			t.Fatalf("cannot get %s: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("cannot scrape metrics: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("metrics without the API token want 401, got %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("cannot scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("metrics have a wrong content type: %s", resp.Header.Get("Content-Type"))
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("cannot read metrics: %v", err)
+	}
+
+	samples := map[string]string{}
+	sc := bufio.NewScanner(strings.NewReader(string(b)))
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			t.Fatalf("invalid sample: %q", line)
+		}
+		samples[line[:i]] = line[i+1:]
+	}
+	for name, want := range map[string]string{
+		`redir_redirects_total{alias="metrics",status="307"}`:     "2",
+		`redir_redirects_total{alias="(unknown)",status="307"}`:   "1",
+		`redir_redirects_total{alias="(protected)",status="403"}`: "1",
+		`redir_cache_requests_total{result="hit"}`:                "1",
+		`redir_cache_requests_total{result="miss"}`:               "3",
+		`redir_vcs_requests_total{result="not_found"}`:            "1",
+		`redir_lookup_duration_seconds_count{source="cache"}`:     "1",
+		`redir_lookup_duration_seconds_count{source="db"}`:        "2",
+		`redir_lookup_duration_seconds_count{source="none"}`:      "1",
+		`redir_visits_total{result="queued"}`:                     "2",
+		`redir_db_errors_total`:                                   "0",
+	} {
+		if got := samples[name]; got != want {
+			t.Fatalf("%s want %s, got %q:\n%s", name, want, got, b)
+		}
+	}
+	if strings.Contains(string(b), "metrics-signed") {
+		t.Fatalf("metrics label a signed alias:\n%s", b)
+	}
+	if _, ok := samples["redir_visit_queue_depth"]; !ok {
+		t.Fatalf("metrics do not contain the visit queue depth:\n%s", b)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// unlockCookieAge is the lifetime of the cookie that is set after a
+	// visitor entered the correct password of a protected alias.
+	unlockCookieAge = 24 * time.Hour
+	// maxPasswordAttempts is the number of failed password attempts that
+	// are allowed from the same IP for the same alias within attemptWindow.
+	maxPasswordAttempts = 5
+	attemptWindow       = 15 * time.Minute
+)
+
+// hashPassword returns the bcrypt hash of a given password.
+func hashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// samePassword reports whether the given bcrypt hash is of the given
+// password, so that the password is not hashed again with a new salt,
+// which would invalidate the cookies of the unlocked visitors.
+func samePassword(hash, password string) bool {
+	return hash != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+var (
+	secretOnce sync.Once
+	secret     []byte
+)
+
+// serverSecret returns the secret key from the configuration to sign
+// cookies. If no secret is configured, a random key is generated and
+// all cookies become invalid after the server restarts.
+func serverSecret() []byte {
+	secretOnce.Do(func() {
+		if conf.Secret != "" {
+			secret = []byte(conf.Secret)
+			return
+		}
+		log.Println("no secret is configured, use a random secret instead")
+		secret = make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			log.Fatalf("cannot generate secret: %v\n", err)
+		}
+	})
+	return secret
+}
+
+// unlockCookieName returns the cookie name for a given alias.
+func unlockCookieName(alias string) string {
+	return "redir_" + base64.RawURLEncoding.EncodeToString([]byte(alias))
+}
+
+// signUnlock signs the alias, the password hash of the alias, and an
+// expiration time. The password hash is included so that changing the
+// password invalidates all issued cookies.
+func signUnlock(red *model.Redirect, exp int64) string {
+	mac := hmac.New(sha256.New, serverSecret())
+	mac.Write([]byte(red.Alias + "\n" + red.Password + "\n" + strconv.FormatInt(exp, 10)))
+	return strconv.FormatInt(exp, 10) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// unlocked reports whether the request carries a valid cookie for the
+// given password protected redirect.
+func unlocked(r *http.Request, red *model.Redirect) bool {
+	c, err := r.Cookie(unlockCookieName(red.Alias))
+	if err != nil {
+		return false
+	}
+	i := strings.Index(c.Value, ".")
+	if i < 0 {
+		return false
+	}
+	exp, err := strconv.ParseInt(c.Value[:i], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(c.Value), []byte(signUnlock(red, exp)))
+}
+
+// unlock serves the password form of a protected redirect. If the
+// submitted password is correct, it sets a signed cookie and redirects
+// the visitor to the short link again.
+func (s *server) unlock(w http.ResponseWriter, r *http.Request, red *model.Redirect) error {
+	if r.Method != http.MethodPost {
+		return s.passwordForm(w, red, http.StatusOK, "")
+	}
+
+	key := readIP(r) + "\n" + red.Alias
+	if !s.attempts.allow(key) {
+		return s.passwordForm(w, red, http.StatusTooManyRequests,
+			"Too many failed attempts, please try again later.")
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(red.Password), []byte(r.PostFormValue("password")))
+	if err != nil {
+		s.attempts.fail(key)
+		return s.passwordForm(w, red, http.StatusUnauthorized, "Incorrect password.")
+	}
+	s.attempts.reset(key)
+
+	exp := time.Now().Add(unlockCookieAge)
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookieName(red.Alias),
+		Value:    signUnlock(red, exp.Unix()),
+		Path:     conf.S.Prefix,
+		Expires:  exp,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(conf.Host, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+	return nil
+}
+
+func (s *server) passwordForm(w http.ResponseWriter, red *model.Redirect, code int, msg string) error {
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	return passwordTmpl.Execute(w, &struct {
+		Title           string
+		Prefix          string
+		Alias           string
+		Error           string
+		GoogleAnalytics string
+	}{
+		Title:           conf.Title,
+		Prefix:          conf.S.Prefix,
+		Alias:           red.Alias,
+		Error:           msg,
+		GoogleAnalytics: conf.GoogleAnalytics,
+	})
+}
+
+// attempts counts failed password attempts by key to throttle brute
+// force attacks.
+type attempts struct {
+	max    int
+	window time.Duration
+
+	mu    sync.Mutex
+	fails map[string]*failure
+}
+
+type failure struct {
+	count int
+	since time.Time
+}
+
+func newAttempts(max int, window time.Duration) *attempts {
+	return &attempts{max: max, window: window, fails: map[string]*failure{}}
+}
+
+// allow reports whether another attempt is allowed for the given key.
+func (a *attempts) allow(key string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, ok := a.fails[key]
+	if !ok {
+		return true
+	}
+	if time.Since(f.since) > a.window {
+		delete(a.fails, key)
+		return true
+	}
+	return f.count < a.max
+}
+
+// fail records a failed attempt for the given key.
+func (a *attempts) fail(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	// drop expired records to bound the memory usage.
+	for k, f := range a.fails {
+		if now.Sub(f.since) > a.window {
+			delete(a.fails, k)
+		}
+	}
+	f, ok := a.fails[key]
+	if !ok {
+		f = &failure{since: now}
+		a.fails[key] = f
+	}
+	f.count++
+}
+
+// reset clears the failed attempts of the given key.
+func (a *attempts) reset(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.fails, key)
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+func TestUnlockCookie(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatalf("hashPassword with err: %v", err)
+	}
+	red := &model.Redirect{Alias: "protected", Password: hash}
+
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{unlockCookieName(red.Alias), signUnlock(red, time.Now().Add(time.Hour).Unix()), true},
+		{unlockCookieName(red.Alias), signUnlock(red, time.Now().Add(-time.Hour).Unix()), false},
+		{unlockCookieName("other"), signUnlock(red, time.Now().Add(time.Hour).Unix()), false},
+		{unlockCookieName(red.Alias), strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + ".forged", false},
+		{unlockCookieName(red.Alias), "garbage", false},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/s/protected", nil)
+		r.AddCookie(&http.Cookie{Name: tt.name, Value: tt.value})
+		if unlocked(r, red) != tt.ok {
+			t.Fatalf("#%d: want unlocked %v, got %v", i, tt.ok, !tt.ok)
+		}
+	}
+
+	// Changing the password invalidates issued cookies.
+	r := httptest.NewRequest(http.MethodGet, "/s/protected", nil)
+	r.AddCookie(&http.Cookie{
+		Name:  unlockCookieName(red.Alias),
+		Value: signUnlock(red, time.Now().Add(time.Hour).Unix()),
+	})
+	red.Password, _ = hashPassword("another secret")
+	if unlocked(r, red) {
+		t.Fatalf("cookie should be invalid after changing the password")
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	a := newAttempts(3, 50*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if !a.allow("k") {
+			t.Fatalf("attempt %d should be allowed", i)
+		}
+		a.fail("k")
+	}
+	if a.allow("k") {
+		t.Fatalf("attempt should be throttled after 3 failures")
+	}
+	if !a.allow("other") {
+		t.Fatalf("attempt of another key should be allowed")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !a.allow("k") {
+		t.Fatalf("attempt should be allowed after the window")
+	}
+
+	a.fail("k")
+	a.reset("k")
+	if len(a.fails) != 0 {
+		t.Fatalf("reset does not clear failures: %v", a.fails)
+	}
+}
+
+func TestLockedAlias(t *testing.T) {
+	passwordTmpl = template.Must(template.ParseFiles("public/password.html"))
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatalf("hashPassword with err: %v", err)
+	}
+	s := &server{cache: newLRU(false), metrics: newMetrics()}
+	s.cache.Put("locked", &model.Redirect{
+		Alias:    "locked",
+		URL:      "https://locked.example.com/destination",
+		Password: hash,
+		Rules:    []model.Rule{{URL: "https://rule.example.com"}},
+	})
+
+	// the destination of a locked alias is not revealed, even if its
+	// domain is no longer allowed.
+	deny := conf.Policy.Deny
+	conf.Policy.Deny = []string{"*.example.com"}
+	defer func() { conf.Policy.Deny = deny }()
+
+	w := httptest.NewRecorder()
+	s.shortHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, conf.S.Prefix+"locked", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "example.com") {
+		t.Fatalf("locked alias reveals its destination: %d %s", w.Code, w.Body.String())
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Fatalf("locked alias sets cookies: %v", w.Result().Cookies())
+	}
+}
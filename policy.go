@@ -0,0 +1,94 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var errBlockedDomain = errors.New("domain is not allowed")
+
+// domainPolicy decides whether a redirect target is allowed.
+//
+// Each pattern is matched against the host of a target link, either as
+// an exact host name (e.g. example.com) or a wildcard pattern (e.g.
+// *.example.com). A denied host is always rejected. If the allow list
+// is not empty, a host must also match one of the allowed patterns.
+type domainPolicy struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	File  string   `yaml:"file"`
+}
+
+// load merges the allow and deny lists from the policy file, if any.
+func (p *domainPolicy) load() {
+	if p.File == "" {
+		return
+	}
+	b, err := os.ReadFile(p.File)
+	if err != nil {
+		log.Fatalf("cannot read domain policy file: %v\n", err)
+	}
+	var f domainPolicy
+	err = yaml.Unmarshal(b, &f)
+	if err != nil {
+		log.Fatalf("cannot parse domain policy file: %v\n", err)
+	}
+	p.Allow = append(p.Allow, f.Allow...)
+	p.Deny = append(p.Deny, f.Deny...)
+}
+
+// check returns an error if the given link points to a domain that is
+// not permitted by the policy. Only relative links and the links of
+// http(s) and protocol-relative hosts are permitted.
+func (p *domainPolicy) check(link string) error {
+	u, err := url.Parse(link)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBlockedDomain, err)
+	}
+	if u.Scheme == "" && u.Host == "" {
+		// A relative link stays on our own domain, unless browsers
+		// read it as a protocol-relative link, e.g. /\evil.com.
+		if strings.HasPrefix(strings.ReplaceAll(link, `\`, "/"), "//") {
+			return fmt.Errorf("%w: %s is not a relative link", errBlockedDomain, link)
+		}
+		return nil
+	}
+	if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: unsupported scheme %s", errBlockedDomain, u.Scheme)
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return fmt.Errorf("%w: %s has no host", errBlockedDomain, link)
+	}
+	if matchDomain(p.Deny, host) {
+		return fmt.Errorf("%w: %s is denied", errBlockedDomain, host)
+	}
+	if len(p.Allow) > 0 && !matchDomain(p.Allow, host) {
+		return fmt.Errorf("%w: %s is not in the allow list", errBlockedDomain, host)
+	}
+	return nil
+}
+
+func matchDomain(patterns []string, host string) bool {
+	for _, p := range patterns {
+		p = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(p)), ".")
+		if p == "" {
+			continue
+		}
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDomainPolicy(t *testing.T) {
+	tests := []struct {
+		allow, deny []string
+		link        string
+		ok          bool
+	}{
+		{link: "https://example.com", ok: true},
+		{link: "example.com", ok: true},
+		{allow: []string{"golang.design"}, link: "/s/redir", ok: true},
+		{deny: []string{"evil.com"}, link: "https://evil.com/login", ok: false},
+		{deny: []string{"evil.com"}, link: "https://EVIL.com./login", ok: false},
+		{deny: []string{"evil.com"}, link: "https://sub.evil.com", ok: true},
+		{deny: []string{"*.evil.com"}, link: "https://a.b.evil.com", ok: false},
+		{deny: []string{"*.evil.com"}, link: "https://evil.com", ok: true},
+		{allow: []string{"golang.design", "*.golang.design"}, link: "https://golang.design/s", ok: true},
+		{allow: []string{"golang.design", "*.golang.design"}, link: "https://blog.golang.design", ok: true},
+		{allow: []string{"golang.design"}, link: "https://changkun.de", ok: false},
+		{allow: []string{"*"}, deny: []string{"evil.com"}, link: "https://evil.com", ok: false},
+		{allow: []string{"*"}, deny: []string{"evil.com"}, link: "https://changkun.de:8080", ok: true},
+		{allow: []string{"golang.design"}, link: "javascript:alert(1)", ok: false},
+		{allow: []string{"golang.design"}, link: "JavaScript:alert(1)", ok: false},
+		{allow: []string{"golang.design"}, link: "data:text/html,<script>alert(1)</script>", ok: false},
+		{allow: []string{"golang.design"}, link: `https:/\evil.com`, ok: false},
+		{allow: []string{"golang.design"}, link: "https:evil.com", ok: false},
+		{allow: []string{"golang.design"}, link: `/\evil.com`, ok: false},
+		{allow: []string{"golang.design"}, link: "//evil.com", ok: false},
+		{link: "ftp://example.com", ok: false},
+		{link: "mailto:someone@example.com", ok: false},
+	}
+	for _, tt := range tests {
+		p := &domainPolicy{Allow: tt.allow, Deny: tt.deny}
+		err := p.check(tt.link)
+		if tt.ok && err != nil {
+			t.Fatalf("%+v: unexpected error: %v", tt, err)
+		}
+		if !tt.ok && !errors.Is(err, errBlockedDomain) {
+			t.Fatalf("%+v: want %v, got %v", tt, errBlockedDomain, err)
+		}
+	}
+}
+
+func TestDomainPolicyFile(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "policy.yml")
+	err := os.WriteFile(f, []byte("deny:\n  - \"*.evil.com\"\n"), 0644)
+	if err != nil {
+		t.Fatalf("cannot write policy file: %v", err)
+	}
+
+	p := &domainPolicy{Deny: []string{"bad.com"}, File: f}
+	p.load()
+	for _, link := range []string{"https://bad.com", "https://x.evil.com"} {
+		if err := p.check(link); err == nil {
+			t.Fatalf("%s should be denied", link)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+// The modes to store visitor IPs.
+const (
+	ipKeep     = "keep"     // store the IP as it is
+	ipTruncate = "truncate" // store the /24 network of IPv4 or /48 of IPv6
+	ipHash     = "hash"     // store a hash of the IP with a daily salt
+)
+
+// The actions of the retention job on old visits.
+const (
+	retainAnonymize = "anonymize"
+	retainDelete    = "delete"
+)
+
+// privacyPolicy configures how visitors are identified and how long
+// their visits are kept.
+type privacyPolicy struct {
+	IP        string        `yaml:"ip"`
+	DNT       *bool         `yaml:"dnt"` // honored unless set to false
+	Retention time.Duration `yaml:"retention"`
+	Action    string        `yaml:"action"`
+	Interval  time.Duration `yaml:"interval"`
+}
+
+func (p *privacyPolicy) validate() error {
+	switch p.IP {
+	case "", ipKeep, ipTruncate, ipHash:
+	default:
+		return fmt.Errorf("unsupported privacy ip mode: %s", p.IP)
+	}
+	switch p.Action {
+	case "", retainAnonymize, retainDelete:
+	default:
+		return fmt.Errorf("unsupported privacy retention action: %s", p.Action)
+	}
+	return nil
+}
+
+// honorDNT reports whether the visits that ask not to be tracked are
+// left unrecorded, which is the default.
+func (p *privacyPolicy) honorDNT() bool {
+	return p.DNT == nil || *p.DNT
+}
+
+// doNotTrack reports whether the visitor asks not to be tracked by the
+// Do Not Track or the Global Privacy Control header.
+func doNotTrack(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+// truncateIP returns the /24 network of an IPv4 or the /48 network of an
+// IPv6, or an empty string if ip is not an IP.
+func truncateIP(ip string) string {
+	v := net.ParseIP(ip)
+	if v == nil {
+		return ""
+	}
+	if v4 := v.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return v.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// anonymizeIP truncates an IP, and keeps a hashed IP as it is since its
+// salt is deleted after the day.
+func anonymizeIP(ip string) string {
+	if net.ParseIP(ip) == nil {
+		return ip
+	}
+	return truncateIP(ip)
+}
+
+// visitorIP returns the given IP of a visitor to be stored according to
+// the privacy policy.
+func (s *server) visitorIP(ctx context.Context, ip string, now time.Time) string {
+	switch conf.Privacy.IP {
+	case ipTruncate:
+		return truncateIP(ip)
+	case ipHash:
+		h, err := s.hasher.hash(ctx, ip, now)
+		if err != nil {
+			log.Printf("cannot hash visitor ip: %v\n", err)
+			return ""
+		}
+		return h
+	default:
+		return ip
+	}
+}
+
+// ipHasher hashes IPs with a salt that rotates daily. The salt of a day
+// is shared by all servers through the data store, and is deleted once
+// the day is over so that the hashes cannot be linked to any IP again.
+type ipHasher struct {
+	db *model.Store
+
+	mu   sync.Mutex
+	day  string
+	salt []byte
+}
+
+func (h *ipHasher) hash(ctx context.Context, ip string, now time.Time) (string, error) {
+	salt, err := h.saltOf(ctx, now.UTC().Format("2006-01-02"))
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+}
+
+func (h *ipHasher) saltOf(ctx context.Context, day string) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.day == day {
+		return h.salt, nil
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := h.db.FetchSalt(ctx, day, hex.EncodeToString(b))
+	if err != nil {
+		return nil, err
+	}
+	err = h.db.DeleteSalts(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+	h.day, h.salt = day, []byte(salt)
+	return h.salt, nil
+}
+
+// runRetention anonymizes or deletes the visits that are older than the
+// retention of the privacy policy every interval, until ctx is done.
+func runRetention(ctx context.Context, db *model.Store, p privacyPolicy) {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		n, err := retain(ctx, db, p, time.Now().UTC())
+		if err != nil {
+			log.Printf("cannot apply visit retention: %v\n", err)
+		} else if n > 0 {
+			log.Printf("visit retention: %d visits have been %sd\n", n, retentionAction(p))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// retain anonymizes or deletes the visits that are older than the
+// retention of the privacy policy at the given time. The visits are
+// rolled up before they are deleted, so that they are still counted.
+func retain(ctx context.Context, db *model.Store, p privacyPolicy, now time.Time) (int64, error) {
+	before := now.Add(-p.Retention)
+	if retentionAction(p) == retainDelete {
+		_, err := db.RollupVisits(ctx, now.Add(-rollupGrace(conf.Visits)), rollupTop(conf.Rollup.Top))
+		if err != nil {
+			return 0, err
+		}
+		return db.DeleteRolledVisits(ctx, before)
+	}
+	return db.AnonymizeVisits(ctx, before, anonymizeIP)
+}
+
+func retentionAction(p privacyPolicy) string {
+	if p.Action == "" {
+		return retainAnonymize
+	}
+	return p.Action
+}
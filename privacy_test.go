@@ -0,0 +1,110 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+func TestTruncateIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.168.1.123", "192.168.1.0"},
+		{"2001:db8:cafe:1::17", "2001:db8:cafe::"},
+		{"unknown", ""},
+	}
+	for _, tt := range tests {
+		if got := truncateIP(tt.ip); got != tt.want {
+			t.Fatalf("truncateIP(%s) want %q, got %q", tt.ip, tt.want, got)
+		}
+	}
+	if got := anonymizeIP("9f86d081884c7d659a2feaa0c55ad015"); got != "9f86d081884c7d659a2feaa0c55ad015" {
+		t.Fatalf("anonymizeIP changes a hashed ip: %s", got)
+	}
+}
+
+func TestDoNotTrack(t *testing.T) {
+	tests := []struct {
+		header, value string
+		want          bool
+	}{
+		{"DNT", "1", true},
+		{"DNT", "0", false},
+		{"Sec-GPC", "1", true},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/s/", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if got := doNotTrack(r); got != tt.want {
+			t.Fatalf("doNotTrack with %s: %s want %v, got %v", tt.header, tt.value, tt.want, got)
+		}
+	}
+
+	honored, ignored := true, false
+	for _, tt := range []struct {
+		dnt  *bool
+		want bool
+	}{{nil, true}, {&honored, true}, {&ignored, false}} {
+		p := privacyPolicy{DNT: tt.dnt}
+		if got := p.honorDNT(); got != tt.want {
+			t.Fatalf("honorDNT with %v want %v, got %v", tt.dnt, tt.want, got)
+		}
+	}
+}
+
+func TestIPHasher(t *testing.T) {
+	db, err := model.NewDB(conf.Store)
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	defer db.DeleteSalts(ctx, "2021-12-31")
+
+	day1 := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+
+	h1, h2 := &ipHasher{db: db}, &ipHasher{db: db}
+	a, err := h1.hash(ctx, "192.168.1.1", day1)
+	if err != nil {
+		t.Fatalf("hash with err: %v", err)
+	}
+	if a == "192.168.1.1" || len(a) != 32 {
+		t.Fatalf("hash returns an invalid hash: %s", a)
+	}
+	// another server must produce the same hash on the same day.
+	b, err := h2.hash(ctx, "192.168.1.1", day1.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("hash with err: %v", err)
+	}
+	if a != b {
+		t.Fatalf("hashes of the same ip on the same day differ: %s, %s", a, b)
+	}
+	c, err := h1.hash(ctx, "192.168.1.2", day1)
+	if err != nil {
+		t.Fatalf("hash with err: %v", err)
+	}
+	if a == c {
+		t.Fatalf("hashes of different ips are the same: %s", a)
+	}
+	d, err := h1.hash(ctx, "192.168.1.1", day2)
+	if err != nil {
+		t.Fatalf("hash with err: %v", err)
+	}
+	if a == d {
+		t.Fatalf("hashes of the same ip on different days are the same: %s", a)
+	}
+}
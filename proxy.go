@@ -0,0 +1,174 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// trustedProxies is a list of networks of the reverse proxies whose
+// forwarding headers are trusted. A plain IP is a network of one IP.
+type trustedProxies []*net.IPNet
+
+func (tp *trustedProxies) UnmarshalYAML(n *yaml.Node) error {
+	var cidrs []string
+	err := n.Decode(&cidrs)
+	if err != nil {
+		return err
+	}
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	*tp = nets
+	return nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %q", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trusted reports whether the given IP belongs to a trusted proxy.
+func (tp trustedProxies) trusted(ip net.IP) bool {
+	for _, n := range tp {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the client IP of the request. The forwarding headers
+// are only honored if the request comes from a trusted proxy. The hops
+// in the Forwarded header, or in X-Forwarded-For if there is no Forwarded
+// header, are walked from the right, and the first hop that is not a
+// trusted proxy is the client.
+func (tp trustedProxies) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		return "unknown" // use unknown to guarantee non empty string
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !tp.trusted(ip) {
+		return host
+	}
+
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, h := range strings.Split(v, ",") {
+				hops = append(hops, strings.TrimSpace(h))
+			}
+		}
+	}
+	if len(hops) > 0 {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(hops[i])
+			if hop == nil {
+				// an obfuscated or malformed hop, the IP of the last
+				// trusted proxy is the best we know.
+				break
+			}
+			ip = hop
+			if !tp.trusted(ip) {
+				break
+			}
+		}
+		return ip.String()
+	}
+
+	for _, h := range []string{"X-Real-Ip", "X-Appengine-Remote-Addr"} {
+		if v := net.ParseIP(strings.TrimSpace(r.Header.Get(h))); v != nil {
+			return v.String()
+		}
+	}
+	return host
+}
+
+// forwardedFor returns the for parameters of the given Forwarded header
+// values defined in RFC 7239, in the order of the hops. The ports and the
+// brackets of IPv6 addresses are removed, and the obfuscated identifiers
+// are kept as they are.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, elem := range splitQuoted(v, ',') {
+			for _, pair := range splitQuoted(elem, ';') {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				hops = append(hops, forwardedNode(strings.Trim(kv[1], `"`)))
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedNode strips the port of a node of the Forwarded header, e.g.
+// "[2001:db8::1]:4711" is 2001:db8::1, and "192.0.2.1:80" is 192.0.2.1.
+func forwardedNode(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if i := strings.Index(node, "]"); i > 0 {
+			return node[1:i]
+		}
+		return node
+	}
+	if i := strings.LastIndex(node, ":"); i >= 0 && strings.Count(node, ":") == 1 {
+		return node[:i]
+	}
+	return node
+}
+
+// splitQuoted splits s by sep outside of quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var (
+		parts  []string
+		quoted bool
+		start  int
+	)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			if quoted {
+				i++
+			}
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestTrustedProxiesYAML(t *testing.T) {
+	var c struct {
+		TrustedProxies trustedProxies `yaml:"trusted_proxies"`
+	}
+	err := yaml.Unmarshal([]byte("trusted_proxies: [10.0.0.0/8, 192.168.1.1, \"::1\"]"), &c)
+	if err != nil {
+		t.Fatalf("cannot unmarshal trusted proxies: %v", err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.1/32", "::1/128"}
+	var got []string
+	for _, n := range c.TrustedProxies {
+		got = append(got, n.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want trusted proxies %v, got %v", want, got)
+	}
+
+	err = yaml.Unmarshal([]byte("trusted_proxies: [10.0.0.0/33]"), &c)
+	if err == nil {
+		t.Fatalf("invalid trusted proxy is accepted")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("parseCIDRs with err: %v", err)
+	}
+	tp := trustedProxies(nets)
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"direct", "203.0.113.1:1234", nil, "203.0.113.1"},
+		{"spoofed XFF", "203.0.113.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "203.0.113.1"},
+		{"spoofed X-Real-Ip", "203.0.113.1:1234", map[string]string{"X-Real-Ip": "1.1.1.1"}, "203.0.113.1"},
+		{"spoofed Forwarded", "203.0.113.1:1234", map[string]string{"Forwarded": "for=1.1.1.1"}, "203.0.113.1"},
+		{"trusted proxy", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"rightmost untrusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"all trusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"malformed hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"X-Real-Ip", "10.0.0.1:1234", map[string]string{"X-Real-Ip": "198.51.100.1"}, "198.51.100.1"},
+		{"appengine", "10.0.0.1:1234", map[string]string{"X-Appengine-Remote-Addr": "198.51.100.1"}, "198.51.100.1"},
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"Forwarded", "10.0.0.1:1234", map[string]string{"Forwarded": `for=198.51.100.1;proto=https, for="10.0.0.2:8080"`}, "198.51.100.1"},
+		{"Forwarded IPv6", "[2001:db8::1]:1234", map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{"Forwarded over XFF", "10.0.0.1:1234", map[string]string{"Forwarded": "for=198.51.100.1", "X-Forwarded-For": "1.1.1.1"}, "198.51.100.1"},
+		{"Forwarded obfuscated", "10.0.0.1:1234", map[string]string{"Forwarded": "for=_hidden, for=10.0.0.2"}, "10.0.0.2"},
+		{"Forwarded quoted", "10.0.0.1:1234", map[string]string{"Forwarded": `for=198.51.100.1;by="a,b", for=10.0.0.2`}, "198.51.100.1"},
+		{"invalid remote", "garbage", nil, "unknown"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/s/", nil)
+		r.RemoteAddr = tt.remote
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := tp.clientIP(r); got != tt.want {
+			t.Fatalf("%s: clientIP want %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+	"golang.design/x/redir/internal/model"
+)
+
+const (
+	qrSuffix      = ".qr"
+	qrDefaultSize = 256
+	qrMaxSize     = 2048
+)
+
+// qrLevels maps the error correction levels defined by the QR code
+// specification to the recovery levels of the encoder.
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// writeQR encodes the given content as a QR code image in the given
+// format (png or svg) with the given size in pixels and error correction
+// level (L, M, Q or H).
+func writeQR(w io.Writer, content, format string, size int, level string) error {
+	l, ok := qrLevels[strings.ToUpper(level)]
+	if !ok {
+		return fmt.Errorf("unsupported error correction level: %s", level)
+	}
+	if size <= 0 || size > qrMaxSize {
+		return fmt.Errorf("size must be in (0, %d]: %d", qrMaxSize, size)
+	}
+	q, err := qrcode.New(content, l)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "png":
+		return q.Write(size, w)
+	case "svg":
+		return writeSVG(w, q.Bitmap(), size)
+	default:
+		return fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+// writeSVG draws the given bitmap of a QR code as an SVG image that
+// consists of one path of all dark modules.
+func writeSVG(w io.Writer, bitmap [][]bool, size int) error {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, len(bitmap), len(bitmap))
+	fmt.Fprintf(b, `<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="`)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(b, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// qr serves the QR code image of the short link of the given alias. The
+// image format, size and error correction level can be specified by the
+// format, size and level query parameters.
+func (s *server) qr(w http.ResponseWriter, r *http.Request, alias string) error {
+	format, size, level := parseQRParams(r.URL.Query())
+	b := &bytes.Buffer{}
+	err := writeQR(b, shortLink(alias), format, size, level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, err = b.WriteTo(w)
+	return err
+}
+
+func parseQRParams(p url.Values) (format string, size int, level string) {
+	format = strings.ToLower(p.Get("format"))
+	if format == "" {
+		format = "png"
+	}
+	size = qrDefaultSize
+	if v := p.Get("size"); v != "" {
+		size, _ = strconv.Atoi(v)
+	}
+	level = p.Get("level")
+	if level == "" {
+		level = "M"
+	}
+	return
+}
+
+// shortLink returns the complete short link of the given alias.
+func shortLink(alias string) string {
+	return conf.Host + conf.S.Prefix + alias
+}
+
+// qrCmd writes the QR code image of the short link of the given alias to
+// a file, the image format is determined by the file extension.
+func qrCmd(ctx context.Context, alias, out string) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("cannot create qr code of %s: %w", alias, err)
+		}
+	}()
+
+	s, err := model.NewDB(conf.Store)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+	_, err = s.FetchAlias(ctx, alias)
+	if err != nil {
+		return
+	}
+
+	if out == "" {
+		out = alias + ".png"
+	}
+	format := "png"
+	if strings.EqualFold(filepath.Ext(out), ".svg") {
+		format = "svg"
+	}
+	b := &bytes.Buffer{}
+	err = writeQR(b, shortLink(alias), format, qrDefaultSize, "M")
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(out, b.Bytes(), 0644)
+	if err != nil {
+		return
+	}
+	log.Printf("qr code of %s has been written to %s\n", alias, out)
+	return
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWriteQR(t *testing.T) {
+	link := "https://golang.design/s/redir"
+
+	b := &bytes.Buffer{}
+	err := writeQR(b, link, "png", 128, "H")
+	if err != nil {
+		t.Fatalf("writeQR png with err: %v", err)
+	}
+	img, err := png.Decode(b)
+	if err != nil {
+		t.Fatalf("writeQR does not produce a png image: %v", err)
+	}
+	if s := img.Bounds().Size(); s.X != 128 || s.Y != 128 {
+		t.Fatalf("wrong image size, want 128x128, got %v", s)
+	}
+
+	b.Reset()
+	err = writeQR(b, link, "svg", 300, "l")
+	if err != nil {
+		t.Fatalf("writeQR svg with err: %v", err)
+	}
+	svg := b.String()
+	if !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, `width="300"`) {
+		t.Fatalf("writeQR does not produce an svg image: %s", svg)
+	}
+
+	for _, tt := range []struct {
+		format, level string
+		size          int
+	}{
+		{"gif", "M", 256},
+		{"png", "X", 256},
+		{"png", "M", 0},
+		{"svg", "M", qrMaxSize + 1},
+	} {
+		err = writeQR(&bytes.Buffer{}, link, tt.format, tt.size, tt.level)
+		if err == nil {
+			t.Fatalf("writeQR(%+v) should fail", tt)
+		}
+	}
+}
+
+func TestParseQRParams(t *testing.T) {
+	format, size, level := parseQRParams(url.Values{})
+	if format != "png" || size != qrDefaultSize || level != "M" {
+		t.Fatalf("wrong default parameters: %v, %v, %v", format, size, level)
+	}
+	format, size, level = parseQRParams(url.Values{
+		"format": {"SVG"},
+		"size":   {"512"},
+		"level":  {"Q"},
+	})
+	if format != "svg" || size != 512 || level != "Q" {
+		t.Fatalf("wrong parameters: %v, %v, %v", format, size, level)
+	}
+}
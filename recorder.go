@@ -0,0 +1,236 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+// The modes to handle visits when the visit queue is overloaded.
+const (
+	overloadDrop   = "drop"   // drop the visits that do not fit in the queue
+	overloadSample = "sample" // record a sample of the visits once the queue is half full
+)
+
+// The defaults of the visit recorder.
+const (
+	recorderDefaultQueue    = 4096
+	recorderDefaultWorkers  = 2
+	recorderDefaultBatch    = 100
+	recorderDefaultInterval = time.Second
+	recorderDefaultSample   = 0.1
+	recorderWriteTimeout    = 10 * time.Second
+)
+
+// recorderConfig configures the visit recorder.
+type recorderConfig struct {
+	Queue    int           `yaml:"queue"`
+	Workers  int           `yaml:"workers"`
+	Batch    int           `yaml:"batch"`
+	Interval time.Duration `yaml:"interval"`
+	Overload string        `yaml:"overload"`
+	Sample   float64       `yaml:"sample"`
+}
+
+func (c *recorderConfig) validate() error {
+	switch c.Overload {
+	case "", overloadDrop, overloadSample:
+	default:
+		return fmt.Errorf("unsupported visits overload mode: %s", c.Overload)
+	}
+	if c.Sample < 0 || c.Sample > 1 {
+		return fmt.Errorf("visits sample rate must be within [0, 1], got %v", c.Sample)
+	}
+	return nil
+}
+
+// visitWriter writes a batch of visits to the data store.
+type visitWriter interface {
+	RecordVisits(ctx context.Context, vs []*model.Visit) error
+}
+
+// recorderStats are the counters of a visit recorder.
+type recorderStats struct {
+	Queued   uint64 // visits accepted by the queue
+	Recorded uint64 // visits written to the data store
+	Dropped  uint64 // visits dropped because the queue is full
+	Sampled  uint64 // visits skipped by sampling under overload
+	Failed   uint64 // visits that cannot be written to the data store
+}
+
+// recorder records visits asynchronously. The visits are buffered in a
+// bounded queue and written in batches by a fixed number of workers, so
+// that a traffic spike neither blocks the redirects nor floods the data
+// store with concurrent writes.
+type recorder struct {
+	stats recorderStats // updated atomically, first for 64-bit alignment
+
+	db      visitWriter
+	prepare func(ctx context.Context, v *model.Visit) // optional, runs before a visit is written
+	conf    recorderConfig
+
+	queue chan *model.Visit
+	wg    sync.WaitGroup
+
+	mu     sync.RWMutex // guards closed and the sends to queue
+	closed bool
+
+	rmu  sync.Mutex
+	rand *rand.Rand
+}
+
+// newRecorder creates a visit recorder and starts its workers.
+func newRecorder(db visitWriter, prepare func(ctx context.Context, v *model.Visit), c recorderConfig) *recorder {
+	if c.Queue <= 0 {
+		c.Queue = recorderDefaultQueue
+	}
+	if c.Workers <= 0 {
+		c.Workers = recorderDefaultWorkers
+	}
+	if c.Batch <= 0 {
+		c.Batch = recorderDefaultBatch
+	}
+	if c.Interval <= 0 {
+		c.Interval = recorderDefaultInterval
+	}
+	if c.Overload == "" {
+		c.Overload = overloadDrop
+	}
+	if c.Overload == overloadSample && c.Sample == 0 {
+		c.Sample = recorderDefaultSample
+	}
+
+	r := &recorder{
+		db:      db,
+		prepare: prepare,
+		conf:    c,
+		queue:   make(chan *model.Visit, c.Queue),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	r.wg.Add(c.Workers)
+	for i := 0; i < c.Workers; i++ {
+		go r.work()
+	}
+	return r
+}
+
+// record queues a visit without blocking. It reports whether the visit
+// is accepted.
+func (r *recorder) record(v *model.Visit) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		atomic.AddUint64(&r.stats.Dropped, 1)
+		return false
+	}
+
+	if r.conf.Overload == overloadSample && len(r.queue) >= cap(r.queue)/2 && !r.keep() {
+		atomic.AddUint64(&r.stats.Sampled, 1)
+		return false
+	}
+	select {
+	case r.queue <- v:
+		atomic.AddUint64(&r.stats.Queued, 1)
+		return true
+	default:
+		atomic.AddUint64(&r.stats.Dropped, 1)
+		return false
+	}
+}
+
+// keep reports whether a visit is kept by sampling.
+func (r *recorder) keep() bool {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	return r.rand.Float64() < r.conf.Sample
+}
+
+// work writes the queued visits in batches until the queue is closed. A
+// batch is written once it is full, or once the interval elapses.
+func (r *recorder) work() {
+	defer r.wg.Done()
+
+	t := time.NewTicker(r.conf.Interval)
+	defer t.Stop()
+
+	batch := make([]*model.Visit, 0, r.conf.Batch)
+	for {
+		select {
+		case v, ok := <-r.queue:
+			if !ok {
+				r.flush(batch)
+				return
+			}
+			batch = append(batch, v)
+			if len(batch) >= r.conf.Batch {
+				r.flush(batch)
+				batch = batch[:0]
+			}
+		case <-t.C:
+			r.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (r *recorder) flush(batch []*model.Visit) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), recorderWriteTimeout)
+	defer cancel()
+
+	if r.prepare != nil {
+		for _, v := range batch {
+			r.prepare(ctx, v)
+		}
+	}
+	err := r.db.RecordVisits(ctx, batch)
+	if err != nil {
+		atomic.AddUint64(&r.stats.Failed, uint64(len(batch)))
+		log.Printf("cannot record %d visits: %v\n", len(batch), err)
+		return
+	}
+	atomic.AddUint64(&r.stats.Recorded, uint64(len(batch)))
+}
+
+// close stops accepting visits, and waits until the queued visits are
+// written.
+func (r *recorder) close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.queue)
+	r.mu.Unlock()
+
+	r.wg.Wait()
+}
+
+// depth returns the number of queued visits that are not written yet.
+func (r *recorder) depth() int {
+	return len(r.queue)
+}
+
+// counters returns a snapshot of the counters of the recorder.
+func (r *recorder) counters() recorderStats {
+	return recorderStats{
+		Queued:   atomic.LoadUint64(&r.stats.Queued),
+		Recorded: atomic.LoadUint64(&r.stats.Recorded),
+		Dropped:  atomic.LoadUint64(&r.stats.Dropped),
+		Sampled:  atomic.LoadUint64(&r.stats.Sampled),
+		Failed:   atomic.LoadUint64(&r.stats.Failed),
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+// fakeVisitWriter records the sizes of the written batches, and blocks
+// the writes until it is released.
+type fakeVisitWriter struct {
+	release chan struct{}
+
+	mu      sync.Mutex
+	batches []int
+	visits  []*model.Visit
+}
+
+func (w *fakeVisitWriter) RecordVisits(ctx context.Context, vs []*model.Visit) error {
+	if w.release != nil {
+		<-w.release
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.batches = append(w.batches, len(vs))
+	w.visits = append(w.visits, vs...)
+	return nil
+}
+
+func TestRecorderBatch(t *testing.T) {
+	w := &fakeVisitWriter{}
+	r := newRecorder(w, func(ctx context.Context, v *model.Visit) {
+		v.IP = truncateIP(v.IP)
+	}, recorderConfig{Workers: 1, Batch: 10, Interval: time.Hour})
+	for i := 0; i < 25; i++ {
+		if !r.record(&model.Visit{Alias: "a", IP: "192.168.0.1"}) {
+			t.Fatalf("record rejects visit %d", i)
+		}
+	}
+	r.close()
+
+	want := []int{10, 10, 5}
+	if len(w.batches) != len(want) {
+		t.Fatalf("recorder writes batches %v, want %v", w.batches, want)
+	}
+	for i := range want {
+		if w.batches[i] != want[i] {
+			t.Fatalf("recorder writes batches %v, want %v", w.batches, want)
+		}
+	}
+	if w.visits[0].IP != "192.168.0.0" {
+		t.Fatalf("recorder does not prepare visits, got ip %s", w.visits[0].IP)
+	}
+	c := r.counters()
+	if c.Queued != 25 || c.Recorded != 25 || c.Dropped != 0 {
+		t.Fatalf("recorder counters are wrong: %+v", c)
+	}
+	if r.record(&model.Visit{Alias: "a"}) {
+		t.Fatalf("closed recorder accepts visit")
+	}
+}
+
+func TestRecorderInterval(t *testing.T) {
+	w := &fakeVisitWriter{}
+	r := newRecorder(w, nil, recorderConfig{Workers: 1, Batch: 100, Interval: 10 * time.Millisecond})
+	defer r.close()
+
+	r.record(&model.Visit{Alias: "a"})
+	deadline := time.Now().Add(time.Second)
+	for r.counters().Recorded != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("recorder does not flush a partial batch after the interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRecorderOverload(t *testing.T) {
+	for _, mode := range []string{overloadDrop, overloadSample} {
+		w := &fakeVisitWriter{release: make(chan struct{})}
+		r := newRecorder(w, nil, recorderConfig{
+			Queue:    10,
+			Workers:  1,
+			Batch:    1,
+			Interval: time.Hour,
+			Overload: mode,
+			Sample:   0.0001,
+		})
+
+		// the worker takes the first visit and blocks on writing it, then
+		// the queue is filled.
+		r.record(&model.Visit{Alias: "a"})
+		deadline := time.Now().Add(time.Second)
+		for len(r.queue) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: worker does not take the visit", mode)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		for i := 0; i < 100; i++ {
+			r.record(&model.Visit{Alias: "a"})
+		}
+		c := r.counters()
+		if c.Queued+c.Dropped+c.Sampled != 101 {
+			t.Fatalf("%s: recorder loses visits in counters: %+v", mode, c)
+		}
+		switch mode {
+		case overloadDrop:
+			if c.Queued != 11 || c.Dropped != 90 || c.Sampled != 0 {
+				t.Fatalf("%s: recorder counters are wrong: %+v", mode, c)
+			}
+		case overloadSample:
+			if c.Queued > 7 || c.Sampled < 90 {
+				t.Fatalf("%s: recorder counters are wrong: %+v", mode, c)
+			}
+		}
+
+		close(w.release)
+		r.close()
+		if got := r.counters().Recorded; got != c.Queued {
+			t.Fatalf("%s: recorder does not flush on close, want %d recorded, got %d", mode, c.Queued, got)
+		}
+	}
+}
@@ -14,20 +14,45 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
+
+	"golang.design/x/redir/internal/model"
 )
 
 var (
 	daemon   = flag.Bool("s", false, "run redir service")
 	fromfile = flag.String("f", "", "import aliases from a YAML file")
-	operate  = flag.String("op", "create", "operators, create/update/delete/fetch")
-	alias    = flag.String("a", "", "alias for a new link")
-	link     = flag.String("l", "", "actual link for the alias, optional for delete/fetch")
+	operate  = flag.String("op", "create", "operators, create/update/delete/fetch/check/qr/sign/stats/webhooks")
+	alias    = flag.String("a", "", "alias for a new link, optional for check/stats")
+	link     = flag.String("l", "", "actual link for the alias, optional for delete/fetch/check")
+	desc     = flag.String("d", "", "description of the alias, optional")
+	owner    = flag.String("owner", "", "owner of the alias, default to the current user")
+	wait     = flag.Int("i", 0, "seconds to show an interstitial page before redirecting, optional")
+	output   = flag.String("o", "", "output file for qr, default to <alias>.png, or for stats, default to stdout")
+	password = flag.String("p", "", "password to protect the alias, optional")
+	maxVisit = flag.Int64("m", 0, "maximum number of visits of the alias, optional")
+	signed   = flag.Bool("signed", false, "require signed parameters to visit the alias, optional")
+	query    = flag.String("q", "", "query parameters to sign, e.g. k1=v1&k2=v2, optional for sign")
+	expire   = flag.Duration("e", 0, "expiration of a signed link, e.g. 24h, optional for sign")
+	export   = flag.String("export", exportDaily, "stats to export, daily/visits, optional for stats")
+	format   = flag.String("format", formatCSV, "format of the exported stats, csv/ndjson, optional for stats")
+	t0       = flag.String("t0", "", "start of the exported stats, e.g. 2021-12-01, default to a week ago")
+	t1       = flag.String("t1", "", "end of the exported stats, e.g. 2021-12-31T12:00:00Z, default to now")
+	bots     = flag.Bool("bots", false, "include the visits of bots in the exported stats, optional for stats")
+	unset    = flag.String("clear", "", "fields to clear, e.g. password,max_visits,signed,sticky,rules, optional for update")
+	rules    ruleFlags
 )
 
+func init() {
+	flag.Var(&rules, "r", "ordered redirect `rule` \"[cond[,cond...]] link\", conditions are\nplatform=ios|android|windows|macos|linux, lang=<tag>, referer=<host> or country=<code>, repeatable, optional")
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr,
-		`usage: redir [-s] [-f <file>] [-op <operator> -a <alias> -l <link>]
+		`usage: redir [-s] [-f <file>] [-op <operator> -a <alias> -l <link> -d <description> -i <seconds> -p <password> -m <visits>]
 options:
 `)
 	flag.PrintDefaults()
@@ -37,6 +62,24 @@ redir -s                  run the redir service
 redir -f ./import.yml     import aliases from a file
 redir -a alias -l link    allocate new short link if possible
 redir -op fetch -a alias  fetch alias information
+redir -op check           check whether the links of all aliases are alive
+redir -op qr -a alias -o qr.svg
+                          write the qr code of a short link to a png or svg file
+redir -op update -a alias -i 5
+                          show a preview page 5 seconds before redirecting
+redir -a alias -l link -m 1
+                          allocate a short link that can only be visited once
+redir -op update -a alias -clear password,max_visits
+                          remove the password and the visit limit of an alias
+redir -op sign -a alias -q "k=v" -e 24h
+                          sign a short link with parameters that expires in a day
+redir -op update -a alias -r "platform=ios https://apps.apple.com" -r "lang=zh https://golang.design/zh"
+                          redirect iOS and Chinese visitors to dedicated links
+redir -op stats -a alias -format csv -t0 2021-12-01 -o stats.csv
+                          export the daily visits of an alias to a csv file
+redir -op stats -export visits -format ndjson
+                          export the visits of all aliases in the last week
+redir -op webhooks        list the latest webhook deliveries
 `)
 	os.Exit(2)
 }
@@ -59,13 +102,38 @@ func main() {
 	runCmd()
 }
 
+// shutdownTimeout is the time to wait for the ongoing requests when the
+// server is shutting down.
+const shutdownTimeout = 10 * time.Second
+
 func runServer() {
-	s := newServer(context.Background())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := newServer(ctx)
 	s.registerHandler()
+	srv := &http.Server{Addr: conf.Addr}
+	// the live streams do not end by themselves.
+	srv.RegisterOnShutdown(s.live.close)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		log.Println("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown %s: %v\n", conf.Addr, err)
+		}
+	}()
+
 	log.Printf("serving at %s\n", conf.Addr)
-	if err := http.ListenAndServe(conf.Addr, nil); err != nil {
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Printf("ListenAndServe %s: %v\n", conf.Addr, err)
 	}
+	// wait for the ongoing requests so that their visits are flushed.
+	stop()
+	<-done
 	s.close()
 }
 
@@ -86,19 +154,45 @@ func runCmd() {
 			flag.Usage()
 			return
 		}
-	case opUpdate, opDelete, opFetch:
+	case opUpdate, opDelete, opFetch, opQR, opSign:
 		if *alias == "" {
 			flag.Usage()
 			return
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	timeout := 5 * time.Second
+	if o := op(*operate); o == opCheck || o == opStats {
+		timeout = 30 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	done := make(chan bool, 1)
 	go func() {
-		err := shortCmd(ctx, op(*operate), *alias, *link)
+		var err error
+		switch o := op(*operate); o {
+		case opQR:
+			err = qrCmd(ctx, *alias, *output)
+		case opSign:
+			err = signCmd(ctx, *alias, *query, *expire)
+		case opStats:
+			err = statsCmd(ctx, *alias, *export, *format, *t0, *t1, *output, *bots)
+		case opWebhooks:
+			err = webhooksCmd(ctx)
+		default:
+			err = redirCmd(ctx, o, &model.Redirect{
+				Alias:        *alias,
+				URL:          *link,
+				Owner:        *owner,
+				Description:  *desc,
+				Interstitial: *wait,
+				Password:     *password,
+				MaxVisits:    *maxVisit,
+				Signed:       *signed,
+				Rules:        model.Rules(rules),
+			}, strings.Split(*unset, ",")...)
+		}
 		if err != nil {
 			log.Println(err)
 		}
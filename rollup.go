@@ -0,0 +1,73 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+// rollupDefaultTop is the default number of top referers and user agent
+// families that are kept for each alias and day.
+const rollupDefaultTop = 10
+
+// rollupMinGrace is the least time after the end of a day before it is
+// rolled up.
+const rollupMinGrace = time.Hour
+
+// rollupGrace returns how long after the end of a day it is rolled up,
+// which is longer than the queued visits of the day take to be written,
+// since the later visits of a rolled-up day would never be counted.
+func rollupGrace(c recorderConfig) time.Duration {
+	if c.Interval <= 0 {
+		c.Interval = recorderDefaultInterval
+	}
+	return rollupMinGrace + c.Interval + recorderWriteTimeout
+}
+
+// runRollup rolls up the raw visits of complete days into the daily
+// tables every interval until ctx is done, once their grace has passed,
+// and deletes the raw visits that are rolled up and older than the
+// retention if it is positive.
+func runRollup(ctx context.Context, db *model.Store, interval, retention time.Duration, top int) {
+	top = rollupTop(top)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		now := time.Now().UTC()
+		n, err := db.RollupVisits(ctx, now.Add(-rollupGrace(conf.Visits)), top)
+		if err != nil {
+			log.Printf("cannot roll up visits: %v\n", err)
+		} else if n > 0 {
+			log.Printf("visits of %d days have been rolled up\n", n)
+		}
+		if err == nil && retention > 0 {
+			n, err := db.DeleteRolledVisits(ctx, now.Add(-retention))
+			if err != nil {
+				log.Printf("cannot delete rolled up visits: %v\n", err)
+			} else if n > 0 {
+				log.Printf("%d rolled up visits have been deleted\n", n)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// rollupTop returns the configured number of top referers and user agent
+// families, or the default if it is not positive.
+func rollupTop(top int) int {
+	if top <= 0 {
+		return rollupDefaultTop
+	}
+	return top
+}
@@ -0,0 +1,217 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.design/x/redir/internal/model"
+	"golang.design/x/redir/internal/ua"
+)
+
+// platforms maps the supported platforms of a rule to the operating
+// systems that are parsed from the user agent.
+var platforms = map[string]string{
+	"ios":     "iOS",
+	"android": "Android",
+	"windows": "Windows",
+	"macos":   "macOS",
+	"linux":   "Linux",
+}
+
+// preferredLanguage returns the language tag with the highest quality
+// in the given Accept-Language header, or an empty string if there is
+// none. The first tag wins among the tags of the same quality.
+func preferredLanguage(header string) string {
+	type tag struct {
+		name string
+		q    float64
+	}
+	var tags []tag
+	for _, s := range strings.Split(header, ",") {
+		parts := strings.Split(strings.TrimSpace(s), ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" || name == "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				v, err := strconv.ParseFloat(p[2:], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			tags = append(tags, tag{name, q})
+		}
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	return tags[0].name
+}
+
+// matchLanguage reports whether the language tag matches the pattern.
+// A pattern matches the tag itself and all its subtags, e.g. zh matches
+// zh, zh-CN and zh-TW, but zh-TW only matches zh-TW.
+func matchLanguage(pattern, lang string) bool {
+	pattern = strings.ToLower(pattern)
+	return lang == pattern || strings.HasPrefix(lang, pattern+"-")
+}
+
+// matchRule reports whether the request from the given country matches
+// all the non-empty conditions of the given rule.
+func matchRule(rule *model.Rule, r *http.Request, country string) bool {
+	if rule.Country != "" && !strings.EqualFold(rule.Country, country) {
+		return false
+	}
+	if rule.Platform != "" && platforms[strings.ToLower(rule.Platform)] != ua.Parse(r.UserAgent()).OS {
+		return false
+	}
+	if rule.Language != "" && !matchLanguage(rule.Language, preferredLanguage(r.Header.Get("Accept-Language"))) {
+		return false
+	}
+	if rule.Referer != "" {
+		u, err := url.Parse(r.Referer())
+		if err != nil || u.Hostname() == "" {
+			return false
+		}
+		host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+		if !matchDomain([]string{rule.Referer}, host) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRules returns the first rule that matches the request from the
+// given country, or nil if no rule matches.
+func matchRules(rules model.Rules, r *http.Request, country string) *model.Rule {
+	for i := range rules {
+		if matchRule(&rules[i], r, country) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// checkRules validates the rules of an alias.
+func checkRules(rules model.Rules) error {
+	for i, rule := range rules {
+		if rule.URL == "" {
+			return fmt.Errorf("rule %d has no link", i+1)
+		}
+		if rule.Platform != "" && !validPlatform(rule.Platform) {
+			return fmt.Errorf("rule %d has an unsupported platform: %s", i+1, rule.Platform)
+		}
+		if rule.Country != "" && len(rule.Country) != 2 {
+			return fmt.Errorf("rule %d has an invalid country code: %s", i+1, rule.Country)
+		}
+		err := conf.Policy.check(rule.URL)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validPlatform(name string) bool {
+	_, ok := platforms[strings.ToLower(name)]
+	return ok
+}
+
+// parseRule parses a rule in the form of "[cond[,cond...]] link", where
+// a condition is one of platform=<name>, lang=<tag>, referer=<host> or
+// country=<code>, e.g. "platform=ios https://apps.apple.com/app/id0".
+func parseRule(s string) (model.Rule, error) {
+	var rule model.Rule
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		rule.URL = fields[0]
+		return rule, nil
+	case 2:
+		rule.URL = fields[1]
+	default:
+		return rule, fmt.Errorf("invalid rule: %q", s)
+	}
+
+	for _, cond := range strings.Split(fields[0], ",") {
+		kv := strings.SplitN(cond, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return rule, fmt.Errorf("invalid rule condition: %q", cond)
+		}
+		switch kv[0] {
+		case "platform":
+			rule.Platform = kv[1]
+		case "lang":
+			rule.Language = kv[1]
+		case "referer":
+			rule.Referer = kv[1]
+		case "country":
+			rule.Country = strings.ToUpper(kv[1])
+		default:
+			return rule, fmt.Errorf("unsupported rule condition: %q", kv[0])
+		}
+	}
+	return rule, nil
+}
+
+// formatRule formats a rule in the form that is accepted by parseRule.
+func formatRule(rule model.Rule) string {
+	var conds []string
+	if rule.Platform != "" {
+		conds = append(conds, "platform="+rule.Platform)
+	}
+	if rule.Language != "" {
+		conds = append(conds, "lang="+rule.Language)
+	}
+	if rule.Referer != "" {
+		conds = append(conds, "referer="+rule.Referer)
+	}
+	if rule.Country != "" {
+		conds = append(conds, "country="+rule.Country)
+	}
+	if len(conds) == 0 {
+		return rule.URL
+	}
+	return strings.Join(conds, ",") + " " + rule.URL
+}
+
+// ruleFlags collects the rules of repeated rule flags.
+type ruleFlags model.Rules
+
+func (f *ruleFlags) String() string {
+	if f == nil {
+		return ""
+	}
+	s := make([]string, len(*f))
+	for i, r := range *f {
+		s[i] = formatRule(r)
+	}
+	return strings.Join(s, "; ")
+}
+
+func (f *ruleFlags) Set(s string) error {
+	if strings.TrimSpace(s) == "" {
+		return errors.New("empty rule")
+	}
+	r, err := parseRule(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, r)
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.design/x/redir/internal/geoip"
+	"golang.design/x/redir/internal/model"
+)
+
+func TestRulePlatform(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 15_0 like Mac OS X) AppleWebKit/605.1.15", "ios"},
+		{"Mozilla/5.0 (iPad; CPU OS 15_0 like Mac OS X) AppleWebKit/605.1.15", "ios"},
+		{"Mozilla/5.0 (Linux; Android 12; Pixel 6) AppleWebKit/537.36", "android"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36", "windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36", "macos"},
+		{"Microsoft Office/16.0 (Macintosh; Mac OS X 10_15_7; Microsoft Outlook 16.55.1111; Pro)", "macos"},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36", "linux"},
+		{"Mozilla/5.0 (Mobile; Windows Phone 8.1; Android 4.0; ARM; Trident/7.0; Touch; rv:11.0; IEMobile/11.0; NOKIA; Lumia 635) like iPhone OS 7_0_3 Mac OS X AppleWebKit/537 (KHTML, like Gecko) Mobile Safari/537", ""},
+		{"curl/7.79.1", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/s/alias", nil)
+		r.Header.Set("User-Agent", tt.ua)
+		for platform := range platforms {
+			if got := matchRule(&model.Rule{Platform: platform}, r, ""); got != (platform == tt.want) {
+				t.Fatalf("platform %s of %q want %v, got %v", platform, tt.ua, !got, got)
+			}
+		}
+	}
+}
+
+func TestPreferredLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"zh-CN,zh;q=0.9,en;q=0.8", "zh-cn"},
+		{"en-US,en;q=0.9,zh;q=0.1", "en-us"},
+		{"en;q=0.5, zh-TW", "zh-tw"},
+		{"*, fr;q=0.8", "fr"},
+		{"de;q=0", ""},
+	}
+	for _, tt := range tests {
+		if got := preferredLanguage(tt.header); got != tt.want {
+			t.Fatalf("preferredLanguage(%q) want %q, got %q", tt.header, tt.want, got)
+		}
+	}
+}
+
+func TestMatchRules(t *testing.T) {
+	rules := model.Rules{
+		{Platform: "ios", URL: "https://apps.apple.com"},
+		{Platform: "android", URL: "https://play.google.com"},
+		{Language: "zh", URL: "https://golang.design/zh"},
+		{Referer: "*.google.com", URL: "https://golang.design/search"},
+	}
+	tests := []struct {
+		ua, lang, referer string
+		want              string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 15_0 like Mac OS X)", "zh-CN", "", "https://apps.apple.com"},
+		{"Mozilla/5.0 (Linux; Android 12; Pixel 6)", "", "", "https://play.google.com"},
+		{"Mozilla/5.0 (X11; Linux x86_64)", "zh-TW,en;q=0.5", "", "https://golang.design/zh"},
+		{"Mozilla/5.0 (X11; Linux x86_64)", "en", "https://www.google.com/search?q=go", "https://golang.design/search"},
+		{"Mozilla/5.0 (X11; Linux x86_64)", "en", "https://google.com.evil.com/", ""},
+		{"Mozilla/5.0 (X11; Linux x86_64)", "en", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/s/app", nil)
+		r.Header.Set("User-Agent", tt.ua)
+		r.Header.Set("Accept-Language", tt.lang)
+		r.Header.Set("Referer", tt.referer)
+
+		got := ""
+		if rule := matchRules(rules, r, ""); rule != nil {
+			got = rule.URL
+		}
+		if got != tt.want {
+			t.Fatalf("matchRules(%q, %q, %q) want %q, got %q", tt.ua, tt.lang, tt.referer, tt.want, got)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		s    string
+		want model.Rule
+		err  bool
+	}{
+		{"https://golang.design", model.Rule{URL: "https://golang.design"}, false},
+		{"platform=ios https://apps.apple.com", model.Rule{Platform: "ios", URL: "https://apps.apple.com"}, false},
+		{"lang=zh,referer=*.google.com https://golang.design/zh", model.Rule{Language: "zh", Referer: "*.google.com", URL: "https://golang.design/zh"}, false},
+		{"platform=android,country=CN https://golang.google.cn", model.Rule{Platform: "android", Country: "CN", URL: "https://golang.google.cn"}, false},
+		{"os=ios https://apps.apple.com", model.Rule{}, true},
+		{"platform= https://apps.apple.com", model.Rule{}, true},
+		{"platform=ios lang=zh https://apps.apple.com", model.Rule{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRule(tt.s)
+		if tt.err {
+			if err == nil {
+				t.Fatalf("parseRule(%q) without error", tt.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parseRule(%q) with error: %v", tt.s, err)
+		}
+		if got != tt.want {
+			t.Fatalf("parseRule(%q) want %+v, got %+v", tt.s, tt.want, got)
+		}
+		if s := formatRule(got); s != tt.s {
+			t.Fatalf("formatRule want %q, got %q", tt.s, s)
+		}
+	}
+
+	if err := checkRules(model.Rules{{Platform: "beos", URL: "https://golang.design"}}); err == nil {
+		t.Fatalf("checkRules accepts an unsupported platform")
+	}
+	if err := checkRules(model.Rules{{Country: "CHN", URL: "https://golang.design"}}); err == nil {
+		t.Fatalf("checkRules accepts an invalid country code")
+	}
+}
+
+func TestCountryRules(t *testing.T) {
+	geo, err := geoip.Open("internal/geoip/testdata/country.mmdb")
+	if err != nil {
+		t.Fatalf("cannot open geoip database: %v", err)
+	}
+	s := &server{geo: geo}
+	rules := model.Rules{
+		{Country: "CN", URL: "https://golang.google.cn"},
+	}
+	tests := []struct {
+		ip      string
+		country string
+		want    string
+	}{
+		{"1.0.0.1", "CN", "https://golang.google.cn"},
+		{"8.8.8.8", "US", ""},
+		{"192.168.0.1", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/s/go", nil)
+		r.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+
+		country := s.country(r)
+		if country != tt.country {
+			t.Fatalf("country of %s want %q, got %q", tt.ip, tt.country, country)
+		}
+		got := ""
+		if rule := matchRules(rules, r, country); rule != nil {
+			got = rule.URL
+		}
+		if got != tt.want {
+			t.Fatalf("matchRules of %s want %q, got %q", tt.ip, tt.want, got)
+		}
+	}
+}
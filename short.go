@@ -9,6 +9,7 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,10 +18,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/user"
+	"strconv"
 	"strings"
 	"time"
 
 	"golang.design/x/redir/internal/model"
+	"golang.design/x/redir/internal/referer"
 	"gopkg.in/yaml.v3"
 )
 
@@ -36,17 +40,92 @@ const (
 	opUpdate = "update"
 	// opFetch represents a fetch operation for short link
 	opFetch = "fetch"
+	// opCheck represents a health check operation for short links
+	opCheck = "check"
+	// opQR represents a QR code generation operation for short link
+	opQR = "qr"
+	// opSign represents a signing operation for short link
+	opSign = "sign"
+	// opStats represents a stats export operation for short links
+	opStats = "stats"
+	// opWebhooks represents a listing operation for webhook deliveries
+	opWebhooks = "webhooks"
 )
 
 func (o op) valid() bool {
 	switch o {
-	case opCreate, opDelete, opUpdate, opFetch:
+	case opCreate, opDelete, opUpdate, opFetch, opCheck, opQR, opSign, opStats, opWebhooks:
 		return true
 	default:
 		return false
 	}
 }
 
+// The fields of an alias that an update can clear.
+const (
+	fieldDescription  = "description"
+	fieldInterstitial = "interstitial"
+	fieldPassword     = "password"
+	fieldMaxVisits    = "max_visits"
+	fieldSigned       = "signed"
+	fieldVariants     = "variants"
+	fieldSticky       = "sticky"
+	fieldRules        = "rules"
+)
+
+// clearFields resets the given fields of a redirect.
+func clearFields(r *model.Redirect, fields []string) error {
+	for _, f := range fields {
+		switch strings.TrimSpace(f) {
+		case fieldDescription:
+			r.Description = ""
+		case fieldInterstitial:
+			r.Interstitial = 0
+		case fieldPassword:
+			r.Password = ""
+		case fieldMaxVisits:
+			r.MaxVisits = 0
+		case fieldSigned:
+			r.Signed = false
+		case fieldVariants:
+			r.Variants = nil
+		case fieldSticky:
+			r.Sticky = false
+		case fieldRules:
+			r.Rules = nil
+		case "":
+		default:
+			return fmt.Errorf("cannot clear unknown field: %s", f)
+		}
+	}
+	return nil
+}
+
+// importEntry is an alias entry in an import file. An entry is either
+// the link of the alias, or a mapping that describes the alias in detail.
+// Clear lists the fields to clear if the alias exists.
+type importEntry struct {
+	URL          string         `yaml:"url"`
+	Owner        string         `yaml:"owner"`
+	Description  string         `yaml:"description"`
+	Interstitial int            `yaml:"interstitial"`
+	Password     string         `yaml:"password"`
+	MaxVisits    int64          `yaml:"max_visits"`
+	Signed       bool           `yaml:"signed"`
+	Variants     model.Variants `yaml:"variants"`
+	Sticky       bool           `yaml:"sticky"`
+	Rules        model.Rules    `yaml:"rules"`
+	Clear        []string       `yaml:"clear"`
+}
+
+func (e *importEntry) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&e.URL)
+	}
+	type plain importEntry
+	return n.Decode((*plain)(e))
+}
+
 func importFile(fname string) {
 	b, err := os.ReadFile(fname)
 	if err != nil {
@@ -54,7 +133,7 @@ func importFile(fname string) {
 	}
 
 	var d struct {
-		Short map[string]string `yaml:"short"`
+		Short map[string]importEntry `yaml:"short"`
 	}
 	err = yaml.Unmarshal(b, &d)
 	if err != nil {
@@ -62,10 +141,23 @@ func importFile(fname string) {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
 	defer cancel()
-	for alias, link := range d.Short {
-		err = shortCmd(ctx, opUpdate, alias, link)
+	for alias, e := range d.Short {
+		r := &model.Redirect{
+			Alias:        alias,
+			URL:          e.URL,
+			Owner:        e.Owner,
+			Description:  e.Description,
+			Interstitial: e.Interstitial,
+			Password:     e.Password,
+			MaxVisits:    e.MaxVisits,
+			Signed:       e.Signed,
+			Variants:     e.Variants,
+			Sticky:       e.Sticky,
+			Rules:        e.Rules,
+		}
+		err = redirCmd(ctx, opUpdate, r, e.Clear...)
 		if err != nil {
-			err = shortCmd(ctx, opCreate, alias, link)
+			err = redirCmd(ctx, opCreate, r)
 			if err != nil {
 				log.Printf("cannot import alias %v: %v\n", alias, err)
 			}
@@ -74,7 +166,31 @@ func importFile(fname string) {
 }
 
 // shortCmd processes the given alias and link with a specified op.
-func shortCmd(ctx context.Context, operate op, alias, link string) (err error) {
+func shortCmd(ctx context.Context, operate op, alias, link string) error {
+	return redirCmd(ctx, operate, &model.Redirect{Alias: alias, URL: link})
+}
+
+// redirCmd processes the given redirect with a specified op. For update,
+// the given fields are cleared first, and then only the non-zero fields
+// of the given redirect are changed. The password of the given redirect
+// is in plain text and is hashed before storing, unless it is unchanged.
+func redirCmd(ctx context.Context, operate op, red *model.Redirect, fields ...string) (err error) {
+	alias := red.Alias
+	cp := *red // don't modify the caller's redirect
+	red = &cp
+	if len(red.Variants) > 0 {
+		red.Variants = append(model.Variants(nil), red.Variants...)
+		err = checkVariants(red.Variants)
+		if err != nil {
+			return
+		}
+	}
+	err = checkRules(red.Rules)
+	if err != nil {
+		return
+	}
+	password := red.Password
+
 	var s *model.Store
 	s, err = model.NewDB(conf.Store)
 	if err != nil {
@@ -91,31 +207,86 @@ func shortCmd(ctx context.Context, operate op, alias, link string) (err error) {
 
 	switch operate {
 	case opCreate:
-		err = s.StoreAlias(ctx, &model.Redirect{
-			Alias: alias,
-			URL:   link,
-		})
+		err = conf.Policy.check(red.URL)
+		if err != nil {
+			return
+		}
+		if password != "" {
+			red.Password, err = hashPassword(password)
+			if err != nil {
+				return
+			}
+		}
+		if red.Owner == "" {
+			if u, err := user.Current(); err == nil {
+				red.Owner = u.Username
+			}
+		}
+		err = s.StoreAlias(ctx, red)
 		if err != nil {
 			return
 		}
+		newWebhooks(s, conf.Webhooks).aliasChanged(ctx, eventAliasCreated, alias, red)
 		log.Printf("alias %v has been created:\n", alias)
 		fmt.Printf("%s%s%s\n", conf.Host, conf.S.Prefix, alias)
 	case opUpdate:
-		redir, err := s.FetchAlias(ctx, alias)
+		r, err := s.FetchAlias(ctx, alias)
+		if err != nil {
+			return err
+		}
+		err = clearFields(r, fields)
+		if err != nil {
+			return err
+		}
+		if red.URL != "" {
+			r.URL = red.URL
+		}
+		if red.Owner != "" {
+			r.Owner = red.Owner
+		}
+		if red.Description != "" {
+			r.Description = red.Description
+		}
+		if red.Interstitial != 0 {
+			r.Interstitial = red.Interstitial
+		}
+		if password != "" && !samePassword(r.Password, password) {
+			r.Password, err = hashPassword(password)
+			if err != nil {
+				return err
+			}
+		}
+		if red.MaxVisits != 0 {
+			r.MaxVisits = red.MaxVisits
+		}
+		if red.Signed {
+			r.Signed = red.Signed
+		}
+		if len(red.Variants) > 0 {
+			r.Variants = red.Variants
+		}
+		if red.Sticky {
+			r.Sticky = red.Sticky
+		}
+		if len(red.Rules) > 0 {
+			r.Rules = red.Rules
+		}
+		err = conf.Policy.check(r.URL)
 		if err != nil {
 			return err
 		}
-		redir.URL = link
-		err = s.UpdateAlias(ctx, redir)
+		err = s.UpdateAlias(ctx, r)
 		if err != nil {
 			return err
 		}
+		newWebhooks(s, conf.Webhooks).aliasChanged(ctx, eventAliasUpdated, alias, r)
 		log.Printf("alias %v has been updated.\n", alias)
 	case opDelete:
 		err = s.DeleteAlias(ctx, alias)
 		if err != nil {
 			return
 		}
+		newWebhooks(s, conf.Webhooks).aliasChanged(ctx, eventAliasDeleted, alias, nil)
 		log.Printf("alias %v has been deleted.\n", alias)
 	case opFetch:
 		var r *model.Redirect
@@ -124,6 +295,34 @@ func shortCmd(ctx context.Context, operate op, alias, link string) (err error) {
 			return
 		}
 		log.Println(r.URL)
+		if n := r.Remaining(); n >= 0 {
+			log.Printf("remaining visits: %d of %d\n", n, r.MaxVisits)
+		}
+		for i, rule := range r.Rules {
+			log.Printf("rule %d: %s\n", i+1, formatRule(rule))
+		}
+	case opCheck:
+		var rs []*model.Redirect
+		if alias != "" {
+			var r *model.Redirect
+			r, err = s.FetchAlias(ctx, alias)
+			if err != nil {
+				return
+			}
+			rs = append(rs, r)
+		} else {
+			rs, err = s.FetchAliases(ctx)
+			if err != nil {
+				return
+			}
+		}
+		for _, h := range newChecker(s).checkRedirects(ctx, rs) {
+			state := "ok"
+			if h.Broken() {
+				state = "broken"
+			}
+			fmt.Printf("%-6s %3d %6dms %s %s\n", state, h.Status, h.Latency, h.Alias, h.URL)
+		}
 	}
 	return
 }
@@ -151,84 +350,285 @@ func (s *server) shortHandler() http.Handler {
 			return
 		}
 
-		// figure out redirect location
-		url, ok := s.cache.Get(alias)
-		if !ok {
-			url, err = s.checkdb(ctx, alias)
+		if strings.HasSuffix(alias, qrSuffix) {
+			alias = strings.TrimSuffix(alias, qrSuffix)
+			var red *model.Redirect
+			red, err = s.lookup(ctx, alias)
 			if err != nil {
-				url, err = s.checkvcs(ctx, alias)
-				if err != nil {
-					return
-				}
+				return
 			}
-			s.cache.Put(alias, url)
+			resolved(ctx, red)
+			err = s.qr(w, r, alias)
+			return
+		}
+
+		preview := r.URL.Query().Get("preview") != ""
+		if strings.HasSuffix(alias, "+") {
+			alias, preview = strings.TrimSuffix(alias, "+"), true
 		}
 
-		// redirect the user immediate, but run pv/uv count in background
-		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+		// figure out redirect location
+		var red *model.Redirect
+		red, err = s.lookup(ctx, alias)
+		if err != nil {
+			return
+		}
+		resolved(ctx, red)
 
-		// count visit in another goroutine so it won't block the redirect.
-		go func() {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-			defer cancel()
+		// a password protected alias requires the visitor to unlock it
+		// before anything about where it goes is resolved.
+		if red.Password != "" && !unlocked(r, red) {
+			err = s.unlock(w, r, red)
+			return
+		}
+
+		// the first matching rule decides where the visitor goes,
+		// otherwise an alias with variants splits its visitors into the
+		// variants by their weights.
+		target := red.URL
+		variant := ""
+		country := s.country(r)
+		if rule := matchRules(red.Rules, r, country); rule != nil {
+			target = rule.URL
+		} else if v := pickVariant(w, r, red); v != nil {
+			target, variant = v.URL, v.Name
+		}
+
+		// a signed alias only accepts signed parameters, and fills them
+		// into its link.
+		if red.Signed {
+			params := r.URL.Query()
+			if err := verifyParams(serverSecret(), alias, params); err != nil {
+				log.Printf("alias %s: %v\n", alias, err)
+				s.notice(w, http.StatusForbidden, &notice{
+					Heading: "Invalid Link",
+					Message: fmt.Sprintf("The short link %s%s is invalid or has expired.", conf.S.Prefix, alias),
+				})
+				return
+			}
+			target, err = expandLink(target, params)
+			if err != nil {
+				return
+			}
+		}
 
-			err := s.db.RecordVisit(ctx, &model.Visit{
-				Alias:   alias,
-				IP:      readIP(r),
-				UA:      r.UserAgent(),
-				Referer: r.Referer(),
-				Time:    time.Now().UTC(),
+		// the domain policy may have changed since the alias was
+		// created, warn the user rather than redirecting to it.
+		if err := conf.Policy.check(target); err != nil {
+			log.Printf("alias %s: %v\n", alias, err)
+			s.notice(w, http.StatusForbidden, &notice{
+				Heading: "Warning",
+				Message: fmt.Sprintf("The short link %s%s points to a domain that is no longer allowed:", conf.S.Prefix, alias),
+				URL:     target,
+				Detail: "The link has been disabled to protect you from possible phishing or malicious content. " +
+					"We recommend not to visit the address above.",
 			})
+			return
+		}
+
+		if preview {
+			err = s.preview(ctx, w, red, target, 0)
+			return
+		}
+
+		// consume a visit of a limited alias, this must be checked against
+		// the database since the cached redirect might be outdated.
+		if red.MaxVisits > 0 {
+			// crawlers and link unfurlers would use up the visits
+			// before the recipient clicks the link, they are served
+			// without a redirect.
+			if r.Method == http.MethodHead || s.isBot(r) {
+				s.notice(w, http.StatusOK, &notice{
+					Heading: "Limited Link",
+					Message: fmt.Sprintf("The short link %s%s can only be visited a limited number of times.", conf.S.Prefix, alias),
+				})
+				return
+			}
+			var ok bool
+			ok, err = s.db.ConsumeVisit(ctx, alias)
 			if err != nil {
-				log.Printf("cannot record %s visit: %v", alias, err)
+				s.metrics.dbError(err)
+				return
 			}
-		}()
+			if !ok {
+				s.notice(w, http.StatusGone, &notice{
+					Heading: "Link Exhausted",
+					Message: fmt.Sprintf("The short link %s%s has reached its maximum number of visits and is no longer available.", conf.S.Prefix, alias),
+				})
+				return
+			}
+		}
+
+		// the access log records the target only once the visitor is
+		// sent there.
+		resolvedTarget(ctx, target)
+		if red.Interstitial > 0 {
+			// show where the link goes before redirecting the user.
+			err = s.preview(ctx, w, red, target, red.Interstitial)
+			if err != nil {
+				return
+			}
+		} else {
+			// redirect the user immediate, but run pv/uv count in background
+			http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+		}
+
+		// respect the visitor who asks not to be tracked.
+		if conf.Privacy.honorDNT() && doNotTrack(r) {
+			return
+		}
+
+		// queue the visit so that it is counted in the background
+		// without blocking the redirect.
+		s.visits.record(&model.Visit{
+			Alias:   alias,
+			IP:      readIP(r),
+			UA:      r.UserAgent(),
+			Referer: r.Referer(),
+			Variant: variant,
+			Country: country,
+			Bot:     s.isBot(r),
+			Channel: referer.Channel(r.Referer(), r.Host, referer.Host(conf.Host)),
+			Time:    time.Now().UTC(),
+		})
 	})
 }
 
-// checkdb checks whether the given alias is exsited in the redir database
-func (s *server) checkdb(ctx context.Context, alias string) (string, error) {
-	a, err := s.db.FetchAlias(ctx, alias)
+// lookup figures out the redirect of the given alias from the cache,
+// the redir database, or the VCS in order.
+func (s *server) lookup(ctx context.Context, alias string) (red *model.Redirect, err error) {
+	// the latency is observed by where the redirect is found.
+	start, source := time.Now(), "cache"
+	defer func() {
+		if err != nil {
+			source = "none"
+		}
+		s.metrics.lookups.observe(source, time.Since(start))
+	}()
+
+	if red, ok := s.cache.Get(alias); ok {
+		s.metrics.cache.inc("hit")
+		return red.(*model.Redirect), nil
+	}
+	s.metrics.cache.inc("miss")
+	source = "db"
+	red, err = s.checkdb(ctx, alias)
 	if err != nil {
-		return "", err
+		source = "vcs"
+		red, err = s.checkvcs(ctx, alias)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.cache.Put(alias, red)
+	return red, nil
+}
+
+// checkdb checks whether the given alias is exsited in the redir database
+func (s *server) checkdb(ctx context.Context, alias string) (*model.Redirect, error) {
+	red, err := s.db.FetchAlias(ctx, alias)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		s.metrics.dbError(err)
 	}
-	return a.URL, nil
+	return red, err
 }
 
 // checkvcs checks whether the given alias is an repository on VCS, if so,
 // then creates a new alias and returns url of the vcs repository.
-func (s *server) checkvcs(ctx context.Context, alias string) (string, error) {
+func (s *server) checkvcs(ctx context.Context, alias string) (*model.Redirect, error) {
 	// construct the try path and make the request to vcs
 	repoPath := strings.TrimSuffix(conf.X.RepoPath, "/*")
 	tryPath := fmt.Sprintf("%s/%s", repoPath, alias)
 	resp, err := http.Get(tryPath)
 	if err != nil {
-		return "", err
+		s.metrics.vcs.inc("error")
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK &&
 		resp.StatusCode != http.StatusMovedPermanently {
-		return "", fmt.Errorf("%s is not a repository", tryPath)
+		s.metrics.vcs.inc("not_found")
+		return nil, fmt.Errorf("%s is not a repository", tryPath)
 	}
+	s.metrics.vcs.inc("found")
 
 	// figure out the new location
 	if resp.StatusCode == http.StatusMovedPermanently {
 		tryPath = resp.Header.Get("Location")
 	}
 
+	err = conf.Policy.check(tryPath)
+	if err != nil {
+		return nil, err
+	}
+
 	// store such a try path
-	err = s.db.StoreAlias(ctx, &model.Redirect{
-		Alias: alias,
-		URL:   tryPath,
-	})
+	red := &model.Redirect{
+		Alias:     alias,
+		URL:       tryPath,
+		CreatedAt: time.Now().UTC(),
+	}
+	err = s.db.StoreAlias(ctx, red)
 	if err != nil {
 		if errors.Is(err, model.ErrExistedAlias) {
 			return s.checkdb(ctx, alias)
 		}
-		return "", err
+		return nil, s.metrics.dbError(err)
+	}
+	s.hooks.aliasChanged(ctx, eventAliasCreated, alias, red)
+
+	return red, nil
+}
+
+// notice is a message page that is shown instead of redirecting.
+type notice struct {
+	Title           string
+	Heading         string
+	Message         string
+	URL             string
+	Detail          string
+	GoogleAnalytics string
+}
+
+// notice renders a message page with the given status code.
+func (s *server) notice(w http.ResponseWriter, code int, n *notice) {
+	n.Title = conf.Title
+	n.GoogleAnalytics = conf.GoogleAnalytics
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	err := noticeTmpl.Execute(w, n)
+	if err != nil {
+		log.Printf("cannot render notice page: %v\n", err)
 	}
+}
 
-	return tryPath, nil
+// preview renders a page that shows the given redirect goes to target.
+// If countdown is positive, the page redirects to the target after
+// countdown seconds.
+func (s *server) preview(ctx context.Context, w http.ResponseWriter, red *model.Redirect, target string, countdown int) error {
+	rec, err := s.db.CountAliasVisit(ctx, red.Alias, model.Filter{})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html")
+	return previewTmpl.Execute(w, &struct {
+		Title           string
+		Prefix          string
+		Redirect        *model.Redirect
+		Target          string
+		Record          *model.Record
+		Countdown       int
+		GoogleAnalytics string
+	}{
+		Title:           conf.Title,
+		Prefix:          conf.S.Prefix,
+		Redirect:        red,
+		Target:          target,
+		Record:          rec,
+		Countdown:       countdown,
+		GoogleAnalytics: conf.GoogleAnalytics,
+	})
 }
 
 var errInvalidStatParam = errors.New("invalid stat parameter")
@@ -238,11 +638,22 @@ type records struct {
 	Host            string
 	Prefix          string
 	Records         []model.Record
+	Broken          []model.Health
+	Bots            bool
 	GoogleAnalytics string
 }
 
 func (s *server) stats(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	if len(r.URL.Query()) != 0 {
+	// the stats page only takes the bots parameter, the others are
+	// parameters of the stat data, of an export or of the live stream.
+	q := r.URL.Query()
+	if q.Get("export") != "" {
+		return s.export(ctx, w, r)
+	}
+	if q.Get("live") != "" {
+		return s.liveStream(ctx, w, r)
+	}
+	if len(q) > 1 || len(q) == 1 && q.Get("bots") == "" {
 		err := s.statData(ctx, w, r)
 		if !errors.Is(err, errInvalidStatParam) {
 			return err
@@ -259,11 +670,16 @@ func (s *server) stats(ctx context.Context, w http.ResponseWriter, r *http.Reque
 		Records:         nil,
 		GoogleAnalytics: conf.GoogleAnalytics,
 	}
-	rs, err := s.db.CountVisit(ctx)
+	ars.Bots, _ = strconv.ParseBool(q.Get("bots"))
+	rs, err := s.db.CountVisit(ctx, model.Filter{Bots: ars.Bots})
 	if err != nil {
 		return err
 	}
 	ars.Records = rs
+	ars.Broken, err = s.db.FetchBrokenLinks(ctx)
+	if err != nil {
+		return err
+	}
 	statsTmpl = template.Must(template.ParseFiles("public/stats.html"))
 	return statsTmpl.Execute(w, ars)
 }
@@ -292,17 +708,44 @@ func (s *server) statData(
 		return
 	}
 
-	start, end, err := parseDuration(params)
+	loc, err := parseLocation(params)
+	if err != nil {
+		retErr = err
+		return
+	}
+	start, end, err := parseDuration(params, loc)
 	if err != nil {
 		retErr = err
 		return
 	}
 
+	f := model.Filter{Variant: params.Get("variant")}
+	if v := params.Get("bots"); v != "" {
+		f.Bots, err = strconv.ParseBool(v)
+		if err != nil {
+			retErr = fmt.Errorf("invalid bots parameter: %w", err)
+			return
+		}
+	}
 	w.Header().Add("Content-Type", "application/json")
 
 	switch mode {
 	case "referer":
-		referers, err := s.db.CountReferer(ctx, a, start, end)
+		referers, err := s.db.CountReferer(ctx, a, start, end, f)
+		if err != nil {
+			retErr = err
+			return
+		}
+		b, err := json.Marshal(referers)
+		if err != nil {
+			retErr = err
+			return
+		}
+		w.Write(b)
+		return
+	case "referer-host":
+		path, _ := strconv.ParseBool(params.Get("path"))
+		referers, err := s.db.CountRefererHost(ctx, a, start, end, path, f)
 		if err != nil {
 			retErr = err
 			return
@@ -314,8 +757,21 @@ func (s *server) statData(
 		}
 		w.Write(b)
 		return
+	case "channel":
+		channels, err := s.db.CountChannel(ctx, a, start, end, f)
+		if err != nil {
+			retErr = err
+			return
+		}
+		b, err := json.Marshal(channels)
+		if err != nil {
+			retErr = err
+			return
+		}
+		w.Write(b)
+		return
 	case "ua":
-		referers, err := s.db.CountUA(ctx, a, start, end)
+		referers, err := s.db.CountUA(ctx, a, start, end, f)
 		if err != nil {
 			retErr = err
 			return
@@ -328,7 +784,17 @@ func (s *server) statData(
 		w.Write(b)
 		return
 	case "time":
-		hist, err := s.db.CountVisitHist(ctx, a, start, end)
+		bucket, err := parseBucket(params)
+		if err != nil {
+			retErr = err
+			return
+		}
+		hist, err := s.db.CountVisitHist(ctx, a, start, end, f)
+		if err != nil {
+			retErr = err
+			return
+		}
+		hist, err = bucketHist(hist, start, end, bucket, loc)
 		if err != nil {
 			retErr = err
 			return
@@ -340,16 +806,102 @@ func (s *server) statData(
 		}
 		w.Write(b)
 		return
+	case "browser":
+		browsers, err := s.db.CountBrowser(ctx, a, start, end, f)
+		if err != nil {
+			retErr = err
+			return
+		}
+		b, err := json.Marshal(browsers)
+		if err != nil {
+			retErr = err
+			return
+		}
+		w.Write(b)
+		return
+	case "os":
+		oses, err := s.db.CountOS(ctx, a, start, end, f)
+		if err != nil {
+			retErr = err
+			return
+		}
+		b, err := json.Marshal(oses)
+		if err != nil {
+			retErr = err
+			return
+		}
+		w.Write(b)
+		return
+	case "device":
+		devices, err := s.db.CountDevice(ctx, a, start, end, f)
+		if err != nil {
+			retErr = err
+			return
+		}
+		b, err := json.Marshal(devices)
+		if err != nil {
+			retErr = err
+			return
+		}
+		w.Write(b)
+		return
+	case "country":
+		countries, err := s.db.CountCountry(ctx, a, start, end, f)
+		if err != nil {
+			retErr = err
+			return
+		}
+		b, err := json.Marshal(countries)
+		if err != nil {
+			retErr = err
+			return
+		}
+		w.Write(b)
+		return
+	case "summary":
+		top, err := parseTop(params)
+		if err != nil {
+			retErr = err
+			return
+		}
+		sum, err := summarize(ctx, s.db, a, start, end, top, f)
+		if err != nil {
+			retErr = err
+			return
+		}
+		b, err := json.Marshal(sum)
+		if err != nil {
+			retErr = err
+			return
+		}
+		w.Write(b)
+		return
+	case "variant":
+		variants, err := s.db.CountVariant(ctx, a, start, end, f)
+		if err != nil {
+			retErr = err
+			return
+		}
+		b, err := json.Marshal(variants)
+		if err != nil {
+			retErr = err
+			return
+		}
+		w.Write(b)
+		return
 	default:
 		retErr = fmt.Errorf("%s stat mode is not supported", mode)
 		return
 	}
 }
 
-func parseDuration(p url.Values) (start, end time.Time, err error) {
+// parseDuration parses the t0 and t1 parameters, which are either RFC
+// 3339 timestamps or dates in the given location, and are the last week
+// by default. The returned times are in UTC, as the visits are stored.
+func parseDuration(p url.Values, loc *time.Location) (start, end time.Time, err error) {
 	t0 := p.Get("t0")
 	if t0 != "" {
-		start, err = time.Parse("2006-01-02", t0)
+		start, err = parseTime(t0, loc)
 		if err != nil {
 			return
 		}
@@ -358,12 +910,19 @@ func parseDuration(p url.Values) (start, end time.Time, err error) {
 	}
 	t1 := p.Get("t1")
 	if t1 != "" {
-		end, err = time.Parse("2006-01-02", t1)
+		end, err = parseTime(t1, loc)
 		if err != nil {
 			return
 		}
 	} else {
 		end = time.Now().UTC()
 	}
-	return
+	return start.UTC(), end.UTC(), nil
+}
+
+func parseTime(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, loc)
 }
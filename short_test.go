@@ -9,7 +9,16 @@ package main
 
 import (
 	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+	"golang.design/x/redir/internal/ua"
+	"gopkg.in/yaml.v3"
 )
 
 func TestOpValid(t *testing.T) {
@@ -63,3 +72,166 @@ func TestShortCmd(t *testing.T) {
 		}
 	}
 }
+
+func TestImportEntry(t *testing.T) {
+	var d struct {
+		Short map[string]importEntry `yaml:"short"`
+	}
+	err := yaml.Unmarshal([]byte(`
+short:
+  a: https://golang.design
+  b:
+    url: https://changkun.de
+    owner: changkun
+    description: personal homepage
+    interstitial: 5
+    clear: [password, rules]
+  c:
+    url: https://golang.design
+    sticky: true
+    variants:
+      - url: https://golang.design/a
+        weight: 3
+      - name: new
+        url: https://golang.design/b
+        weight: 1
+`), &d)
+	if err != nil {
+		t.Fatalf("cannot unmarshal import entries: %v", err)
+	}
+	if d.Short["a"].URL != "https://golang.design" {
+		t.Fatalf("wrong link of a: %+v", d.Short["a"])
+	}
+	want := importEntry{
+		URL:          "https://changkun.de",
+		Owner:        "changkun",
+		Description:  "personal homepage",
+		Interstitial: 5,
+		Clear:        []string{fieldPassword, fieldRules},
+	}
+	if !reflect.DeepEqual(d.Short["b"], want) {
+		t.Fatalf("want %+v, got %+v", want, d.Short["b"])
+	}
+	want = importEntry{
+		URL:    "https://golang.design",
+		Sticky: true,
+		Variants: model.Variants{
+			{URL: "https://golang.design/a", Weight: 3},
+			{Name: "new", URL: "https://golang.design/b", Weight: 1},
+		},
+	}
+	if !reflect.DeepEqual(d.Short["c"], want) {
+		t.Fatalf("want %+v, got %+v", want, d.Short["c"])
+	}
+}
+
+func TestLimitedAlias(t *testing.T) {
+	conf.parse()
+	noticeTmpl = template.Must(template.ParseFiles("public/notice.html"))
+	db, err := model.NewDB(conf.Store)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	err = db.StoreAlias(ctx, &model.Redirect{Alias: "limited", URL: "https://example.com", MaxVisits: 1, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		t.Fatalf("StoreAlias with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "limited")
+
+	s := &server{
+		db:      db,
+		cache:   newLRU(false),
+		bots:    ua.NewBots(),
+		metrics: newMetrics(),
+	}
+	s.visits = newRecorder(&fakeVisitWriter{}, nil, recorderConfig{Workers: 1, Batch: 10, Interval: time.Hour})
+	defer s.visits.close()
+
+	visit := func(method, agent string) int {
+		r := httptest.NewRequest(method, conf.S.Prefix+"limited", nil)
+		r.Header.Set("User-Agent", agent)
+		w := httptest.NewRecorder()
+		s.shortHandler().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// HEAD requests and link unfurlers do not use up the visits.
+	for _, c := range []struct{ method, agent string }{
+		{http.MethodHead, "Mozilla/5.0"},
+		{http.MethodGet, "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"},
+		{http.MethodGet, "WhatsApp/2.23.20.0 A"},
+	} {
+		if code := visit(c.method, c.agent); code != http.StatusOK {
+			t.Fatalf("%s %s want %d, got %d", c.method, c.agent, http.StatusOK, code)
+		}
+	}
+	red, err := db.FetchAlias(ctx, "limited")
+	if err != nil || red.Visits != 0 {
+		t.Fatalf("limited alias want no consumed visits, got %+v, %v", red, err)
+	}
+
+	if code := visit(http.MethodGet, "Mozilla/5.0"); code != http.StatusTemporaryRedirect {
+		t.Fatalf("first visit want %d, got %d", http.StatusTemporaryRedirect, code)
+	}
+	if code := visit(http.MethodGet, "Mozilla/5.0"); code != http.StatusGone {
+		t.Fatalf("exhausted alias want %d, got %d", http.StatusGone, code)
+	}
+}
+
+func TestRedirCmdUpdate(t *testing.T) {
+	conf.parse()
+	db, err := model.NewDB(conf.Store)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	err = redirCmd(ctx, opCreate, &model.Redirect{
+		Alias:     "update",
+		URL:       "https://example.com",
+		Password:  "secret",
+		MaxVisits: 3,
+		Signed:    true,
+		Sticky:    true,
+		Rules:     model.Rules{{Platform: "ios", URL: "https://apps.apple.com"}},
+	})
+	if err != nil {
+		t.Fatalf("redirCmd create with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "update")
+	red, err := db.FetchAlias(ctx, "update")
+	if err != nil {
+		t.Fatalf("FetchAlias with err: %v", err)
+	}
+
+	// the same password is not hashed again.
+	err = redirCmd(ctx, opUpdate, &model.Redirect{Alias: "update", Password: "secret"})
+	if err != nil {
+		t.Fatalf("redirCmd update with err: %v", err)
+	}
+	got, err := db.FetchAlias(ctx, "update")
+	if err != nil || got.Password != red.Password {
+		t.Fatalf("same password is hashed again: %v, %v", got, err)
+	}
+
+	err = redirCmd(ctx, opUpdate, &model.Redirect{Alias: "update"}, "nothing")
+	if err == nil {
+		t.Fatalf("redirCmd clears an unknown field")
+	}
+	err = redirCmd(ctx, opUpdate, &model.Redirect{Alias: "update"},
+		fieldPassword, fieldMaxVisits, fieldSigned, fieldSticky, fieldRules)
+	if err != nil {
+		t.Fatalf("redirCmd update with err: %v", err)
+	}
+	got, err = db.FetchAlias(ctx, "update")
+	if err != nil {
+		t.Fatalf("FetchAlias with err: %v", err)
+	}
+	if got.URL != red.URL || got.Password != "" || got.MaxVisits != 0 || got.Signed || got.Sticky || len(got.Rules) != 0 {
+		t.Fatalf("redirCmd does not clear the fields: %+v", got)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+const (
+	// sigParam is the query parameter that carries the signature.
+	sigParam = "sig"
+	// expParam is the query parameter that carries the expiration time
+	// of a signed link as a unix timestamp.
+	expParam = "exp"
+)
+
+var (
+	errInvalidSignature = errors.New("invalid signature")
+	errExpiredSignature = errors.New("signature is expired")
+)
+
+// signature computes the signature of an alias and its parameters. The
+// parameters are encoded in the order of their keys, and the parameters
+// that do not belong to the link, such as sig and preview, are excluded.
+func signature(secret []byte, alias string, params url.Values) string {
+	p := url.Values{}
+	for k, v := range params {
+		if k == sigParam || k == "preview" {
+			continue
+		}
+		p[k] = v
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(alias + "?" + p.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signParams adds an expiration time if exp is positive, and the
+// signature to the given parameters of the alias.
+func signParams(secret []byte, alias string, params url.Values, exp time.Duration) url.Values {
+	p := url.Values{}
+	for k, v := range params {
+		p[k] = v
+	}
+	p.Del(sigParam)
+	if exp > 0 {
+		p.Set(expParam, strconv.FormatInt(time.Now().Add(exp).Unix(), 10))
+	}
+	p.Set(sigParam, signature(secret, alias, p))
+	return p
+}
+
+// verifyParams checks the signature and the expiration time of the
+// given parameters of the alias.
+func verifyParams(secret []byte, alias string, params url.Values) error {
+	sig := params.Get(sigParam)
+	if sig == "" {
+		return fmt.Errorf("%w: missing signature", errInvalidSignature)
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, alias, params))) {
+		return errInvalidSignature
+	}
+	if e := params.Get(expParam); e != "" {
+		exp, err := strconv.ParseInt(e, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidSignature, err)
+		}
+		if time.Now().Unix() > exp {
+			return errExpiredSignature
+		}
+	}
+	return nil
+}
+
+// expandLink fills the signed parameters into the given link. A {name}
+// placeholder in the link is replaced by the value of parameter name,
+// and the remaining parameters are passed through as query parameters.
+func expandLink(link string, params url.Values) (string, error) {
+	rest := url.Values{}
+	for k, v := range params {
+		switch k {
+		case sigParam, expParam, "preview":
+			continue
+		}
+		placeholder := "{" + k + "}"
+		if strings.Contains(link, placeholder) {
+			// escape spaces as %20 that is valid in both path and query.
+			val := strings.ReplaceAll(url.QueryEscape(v[0]), "+", "%20")
+			link = strings.ReplaceAll(link, placeholder, val)
+			continue
+		}
+		rest[k] = v
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	if len(rest) > 0 {
+		q := u.Query()
+		for k, v := range rest {
+			q[k] = v
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String(), nil
+}
+
+// signCmd prints a signed short link of the given alias with the given
+// query parameters that expires after exp, or never expires if exp is
+// not positive.
+func signCmd(ctx context.Context, alias, query string, exp time.Duration) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("cannot sign alias %s: %w", alias, err)
+		}
+	}()
+
+	if conf.Secret == "" {
+		return errors.New("secret is not configured")
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return
+	}
+
+	s, err := model.NewDB(conf.Store)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+	r, err := s.FetchAlias(ctx, alias)
+	if err != nil {
+		return
+	}
+	if !r.Signed {
+		return errors.New("alias does not require a signature")
+	}
+
+	p := signParams([]byte(conf.Secret), alias, params, exp)
+	fmt.Printf("%s?%s\n", shortLink(alias), p.Encode())
+	return
+}
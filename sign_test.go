@@ -0,0 +1,89 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignParams(t *testing.T) {
+	secret := []byte("secret")
+	params := url.Values{"utm": {"talk"}, "page": {"2"}}
+
+	p := signParams(secret, "alias", params, time.Hour)
+	if p.Get(expParam) == "" || p.Get(sigParam) == "" {
+		t.Fatalf("signParams does not add exp and sig: %v", p)
+	}
+	if err := verifyParams(secret, "alias", p); err != nil {
+		t.Fatalf("verifyParams with err: %v", err)
+	}
+
+	// a preview parameter does not invalidate the signature
+	pv, _ := url.ParseQuery(p.Encode() + "&preview=1")
+	if err := verifyParams(secret, "alias", pv); err != nil {
+		t.Fatalf("verifyParams with preview parameter: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		alias  string
+		secret []byte
+		modify func(url.Values)
+		want   error
+	}{
+		{"other alias", "other", secret, func(url.Values) {}, errInvalidSignature},
+		{"other secret", "alias", []byte("guess"), func(url.Values) {}, errInvalidSignature},
+		{"altered param", "alias", secret, func(v url.Values) { v.Set("page", "3") }, errInvalidSignature},
+		{"added param", "alias", secret, func(v url.Values) { v.Set("x", "1") }, errInvalidSignature},
+		{"removed exp", "alias", secret, func(v url.Values) { v.Del(expParam) }, errInvalidSignature},
+		{"missing sig", "alias", secret, func(v url.Values) { v.Del(sigParam) }, errInvalidSignature},
+	}
+	for _, tt := range tests {
+		v, _ := url.ParseQuery(p.Encode())
+		tt.modify(v)
+		if err := verifyParams(tt.secret, tt.alias, v); !errors.Is(err, tt.want) {
+			t.Fatalf("%s: want %v, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	expired := signParams(secret, "alias", params, -time.Hour)
+	expired.Set(expParam, "1")
+	expired.Set(sigParam, signature(secret, "alias", expired))
+	if err := verifyParams(secret, "alias", expired); !errors.Is(err, errExpiredSignature) {
+		t.Fatalf("want %v, got %v", errExpiredSignature, err)
+	}
+
+	forever := signParams(secret, "alias", nil, 0)
+	if forever.Get(expParam) != "" {
+		t.Fatalf("signParams adds exp for a link without expiration")
+	}
+	if err := verifyParams(secret, "alias", forever); err != nil {
+		t.Fatalf("verifyParams with err: %v", err)
+	}
+}
+
+func TestExpandLink(t *testing.T) {
+	tests := []struct {
+		link   string
+		params url.Values
+		want   string
+	}{
+		{"https://golang.design", url.Values{"sig": {"x"}, "exp": {"1"}}, "https://golang.design"},
+		{"https://golang.design/?a=1", url.Values{"b": {"2"}, "sig": {"x"}}, "https://golang.design/?a=1&b=2"},
+		{"https://golang.design/talks/{id}", url.Values{"id": {"a b"}, "c": {"3"}}, "https://golang.design/talks/a%20b?c=3"},
+	}
+	for _, tt := range tests {
+		got, err := expandLink(tt.link, tt.params)
+		if err != nil {
+			t.Fatalf("expandLink with err: %v", err)
+		}
+		if got != tt.want {
+			t.Fatalf("expandLink(%s, %v): want %s, got %s", tt.link, tt.params, tt.want, got)
+		}
+	}
+}
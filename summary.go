@@ -0,0 +1,123 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+// The number of top referers, user agents and countries of a summary.
+const (
+	defaultSummaryTop = 5
+	maxSummaryTop     = 100
+)
+
+// summary summarizes the visits of an alias in a time range, compared
+// with the previous period of the same length.
+type summary struct {
+	Alias     string              `json:"alias"`
+	Start     time.Time           `json:"start"`
+	End       time.Time           `json:"end"`
+	PV        int64               `json:"pv"`
+	UV        int64               `json:"uv"`
+	Previous  period              `json:"previous"`
+	PVChange  *float64            `json:"pv_change"` // in percent, null without previous visits
+	UVChange  *float64            `json:"uv_change"`
+	First     *time.Time          `json:"first_visit"` // null without visits
+	Last      *time.Time          `json:"last_visit"`
+	Referers  []model.Refstat     `json:"referers"`
+	UAs       []model.UAstat      `json:"uas"`
+	Countries []model.Countrystat `json:"countries"`
+}
+
+// period counts the visits of a time range.
+type period struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	PV    int64     `json:"pv"`
+	UV    int64     `json:"uv"`
+}
+
+// summarize summarizes the visits of the given alias from start to end
+// with the top n referers, user agents and countries.
+func summarize(ctx context.Context, db model.RedirStatModel, a string, start, end time.Time, n int, f model.Filter) (*summary, error) {
+	cur, err := db.CountAliasRange(ctx, a, start, end, f)
+	if err != nil {
+		return nil, err
+	}
+	// the previous period ends right before the current one.
+	prevEnd := start.Add(-time.Nanosecond)
+	prevStart := prevEnd.Add(-end.Sub(start))
+	prev, err := db.CountAliasRange(ctx, a, prevStart, prevEnd, f)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &summary{
+		Alias:    a,
+		Start:    start,
+		End:      end,
+		PV:       cur.PV,
+		UV:       cur.UV,
+		Previous: period{Start: prevStart, End: prevEnd, PV: prev.PV, UV: prev.UV},
+		PVChange: percentChange(prev.PV, cur.PV),
+		UVChange: percentChange(prev.UV, cur.UV),
+		First:    cur.First,
+		Last:     cur.Last,
+	}
+
+	s.Referers, err = db.CountReferer(ctx, a, start, end, f)
+	if err != nil {
+		return nil, err
+	}
+	s.UAs, err = db.CountUA(ctx, a, start, end, f)
+	if err != nil {
+		return nil, err
+	}
+	s.Countries, err = db.CountCountry(ctx, a, start, end, f)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Referers) > n {
+		s.Referers = s.Referers[:n]
+	}
+	if len(s.UAs) > n {
+		s.UAs = s.UAs[:n]
+	}
+	if len(s.Countries) > n {
+		s.Countries = s.Countries[:n]
+	}
+	return s, nil
+}
+
+// percentChange returns the change from prev to cur in percent, rounded
+// to one decimal, or nil if prev is zero.
+func percentChange(prev, cur int64) *float64 {
+	if prev == 0 {
+		return nil
+	}
+	c := math.Round(float64(cur-prev)/float64(prev)*1000) / 10
+	return &c
+}
+
+// parseTop parses the top parameter of a summary.
+func parseTop(p url.Values) (int, error) {
+	top := p.Get("top")
+	if top == "" {
+		return defaultSummaryTop, nil
+	}
+	n, err := strconv.Atoi(top)
+	if err != nil || n < 1 || n > maxSummaryTop {
+		return 0, fmt.Errorf("top must be between 1 and %d: %s", maxSummaryTop, top)
+	}
+	return n, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+func TestPercentChange(t *testing.T) {
+	tests := []struct {
+		prev, cur int64
+		want      float64
+	}{
+		{10, 15, 50},
+		{10, 5, -50},
+		{3, 4, 33.3},
+		{5, 5, 0},
+	}
+	for _, tt := range tests {
+		got := percentChange(tt.prev, tt.cur)
+		if got == nil || *got != tt.want {
+			t.Fatalf("percentChange(%d, %d) want %v, got %v", tt.prev, tt.cur, tt.want, got)
+		}
+	}
+	if got := percentChange(0, 10); got != nil {
+		t.Fatalf("percentChange without previous visits want nil, got %v", *got)
+	}
+
+	for _, top := range []string{"0", "101", "x"} {
+		if _, err := parseTop(url.Values{"top": {top}}); err == nil {
+			t.Fatalf("parseTop accepts %s", top)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	conf.parse()
+	db, err := model.NewDB(conf.Store)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	end := time.Now().UTC().Truncate(time.Second)
+	start := end.Add(-24 * time.Hour)
+	vs := []*model.Visit{
+		// the previous day
+		{Alias: "summary", IP: "1.1.1.1", Country: "DE", Time: start.Add(-time.Hour)},
+		{Alias: "summary", IP: "1.1.1.1", Country: "DE", Time: start.Add(-2 * time.Hour)},
+	}
+	for i, ref := range []string{"https://z.com", "https://a.com", "https://z.com", "https://c.com"} {
+		vs = append(vs, &model.Visit{
+			Alias:   "summary",
+			IP:      fmt.Sprintf("1.1.1.%d", i+1),
+			Referer: ref,
+			Country: "US",
+			Time:    start.Add(time.Duration(i+1) * time.Hour),
+		})
+	}
+	err = db.RecordVisits(ctx, vs)
+	if err != nil {
+		t.Fatalf("RecordVisits with err: %v", err)
+	}
+	defer db.DeleteAlias(ctx, "summary")
+
+	s, err := summarize(ctx, db, "summary", start, end, 2, model.Filter{})
+	if err != nil {
+		t.Fatalf("summarize with err: %v", err)
+	}
+	if s.PV != 4 || s.UV != 4 || s.Previous.PV != 2 || s.Previous.UV != 1 {
+		t.Fatalf("summarize counts wrong visits: %+v", s)
+	}
+	if s.PVChange == nil || *s.PVChange != 100 || s.UVChange == nil || *s.UVChange != 300 {
+		t.Fatalf("summarize want 100%% pv and 300%% uv changes, got %v, %v", s.PVChange, s.UVChange)
+	}
+	if !s.Previous.End.Before(start) || !s.Previous.Start.Equal(s.Previous.End.Add(-24*time.Hour)) {
+		t.Fatalf("summarize compares with a wrong period: %+v", s.Previous)
+	}
+	if s.First == nil || !s.First.Equal(start.Add(time.Hour)) || s.Last == nil || !s.Last.Equal(start.Add(4*time.Hour)) {
+		t.Fatalf("summarize finds wrong first and last visits: %v, %v", s.First, s.Last)
+	}
+	// the top referers are the most frequent ones, not the first ones by
+	// name.
+	if len(s.Referers) != 2 || s.Referers[0].Referer != "https://z.com" || s.Referers[0].Count != 2 ||
+		s.Referers[1].Referer != "https://a.com" || s.Referers[1].Count != 1 {
+		t.Fatalf("summarize want the top 2 referers, got %+v", s.Referers)
+	}
+	if len(s.Countries) != 1 || s.Countries[0].Country != "US" || s.Countries[0].Count != 4 {
+		t.Fatalf("summarize want the visits from US, got %+v", s.Countries)
+	}
+	if len(s.UAs) != 1 {
+		t.Fatalf("summarize want 1 user agent, got %+v", s.UAs)
+	}
+}
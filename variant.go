@@ -0,0 +1,124 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+// variantCookieAge is the lifetime of the cookie that keeps a visitor on
+// the same variant of a sticky alias.
+const variantCookieAge = 30 * 24 * time.Hour
+
+var (
+	variantMu   sync.Mutex
+	variantRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// checkVariants validates the variants of an alias, and names the
+// variants without a name by their position, i.e. a, b, c, etc.
+func checkVariants(vs model.Variants) error {
+	total := 0
+	names := map[string]bool{}
+	for i := range vs {
+		if vs[i].Name == "" {
+			vs[i].Name = variantName(i)
+		}
+		if names[vs[i].Name] {
+			return fmt.Errorf("duplicated variant name: %s", vs[i].Name)
+		}
+		names[vs[i].Name] = true
+		if vs[i].Weight < 0 {
+			return fmt.Errorf("variant %s has a negative weight", vs[i].Name)
+		}
+		err := conf.Policy.check(vs[i].URL)
+		if err != nil {
+			return err
+		}
+		total += vs[i].Weight
+	}
+	if len(vs) > 0 && total == 0 {
+		return errors.New("variants must have a positive total weight")
+	}
+	return nil
+}
+
+// variantName returns the default name of the variant at the given
+// position, i.e. a to z, then aa, ab, etc.
+func variantName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('a'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// pickVariant chooses a variant of the given redirect randomly by their
+// weights. For a sticky redirect, a visitor keeps the variant that is
+// remembered by a cookie, as long as the variant still exists.
+func pickVariant(w http.ResponseWriter, r *http.Request, red *model.Redirect) *model.Variant {
+	if len(red.Variants) == 0 {
+		return nil
+	}
+
+	name := variantCookieName(red.Alias)
+	if red.Sticky {
+		if c, err := r.Cookie(name); err == nil {
+			for i := range red.Variants {
+				if red.Variants[i].Name == c.Value && red.Variants[i].Weight > 0 {
+					return &red.Variants[i]
+				}
+			}
+		}
+	}
+
+	v := weightedVariant(red.Variants)
+	if red.Sticky {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    v.Name,
+			Path:     conf.S.Prefix,
+			MaxAge:   int(variantCookieAge.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return v
+}
+
+// weightedVariant chooses a variant randomly by their weights.
+func weightedVariant(vs model.Variants) *model.Variant {
+	total := 0
+	for _, v := range vs {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return &vs[0]
+	}
+
+	variantMu.Lock()
+	n := variantRand.Intn(total)
+	variantMu.Unlock()
+
+	for i := range vs {
+		if n < vs[i].Weight {
+			return &vs[i]
+		}
+		n -= vs[i].Weight
+	}
+	return &vs[len(vs)-1]
+}
+
+func variantCookieName(alias string) string {
+	return "redir_v_" + base64.RawURLEncoding.EncodeToString([]byte(alias))
+}
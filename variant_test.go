@@ -0,0 +1,103 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.design/x/redir/internal/model"
+)
+
+func TestCheckVariants(t *testing.T) {
+	vs := model.Variants{
+		{URL: "https://golang.design/a", Weight: 1},
+		{URL: "https://golang.design/b", Weight: 2},
+	}
+	if err := checkVariants(vs); err != nil {
+		t.Fatalf("checkVariants with err: %v", err)
+	}
+	if vs[0].Name != "a" || vs[1].Name != "b" {
+		t.Fatalf("checkVariants want default names a and b, got %+v", vs)
+	}
+
+	// the default names go on after z.
+	for i, want := range map[int]string{0: "a", 25: "z", 26: "aa", 27: "ab", 51: "az", 52: "ba", 701: "zz", 702: "aaa"} {
+		if got := variantName(i); got != want {
+			t.Fatalf("variantName(%d) want %s, got %s", i, want, got)
+		}
+	}
+	vs = make(model.Variants, 30)
+	for i := range vs {
+		vs[i] = model.Variant{URL: "https://golang.design", Weight: 1}
+	}
+	if err := checkVariants(vs); err != nil {
+		t.Fatalf("checkVariants of 30 variants with err: %v", err)
+	}
+
+	for _, vs := range []model.Variants{
+		{{Name: "a", URL: "https://golang.design/a", Weight: -1}},
+		{{Name: "a", URL: "https://golang.design/a", Weight: 0}},
+		{{Name: "a", URL: "https://golang.design/a", Weight: 1}, {Name: "a", URL: "https://golang.design/b", Weight: 1}},
+	} {
+		if err := checkVariants(vs); err == nil {
+			t.Fatalf("checkVariants without err: %+v", vs)
+		}
+	}
+}
+
+func TestWeightedVariant(t *testing.T) {
+	vs := model.Variants{
+		{Name: "a", Weight: 1},
+		{Name: "b", Weight: 3},
+		{Name: "c", Weight: 0},
+	}
+	n := 10000
+	count := map[string]int{}
+	for i := 0; i < n; i++ {
+		count[weightedVariant(vs).Name]++
+	}
+	if count["c"] != 0 {
+		t.Fatalf("variant with zero weight is chosen %d times", count["c"])
+	}
+	// a is expected to be chosen 25% of the time.
+	if p := float64(count["a"]) / float64(n); p < 0.22 || p > 0.28 {
+		t.Fatalf("variant a is chosen with probability %v, want 0.25", p)
+	}
+}
+
+func TestPickVariantSticky(t *testing.T) {
+	red := &model.Redirect{
+		Alias: "ab",
+		Variants: model.Variants{
+			{Name: "a", URL: "https://golang.design/a", Weight: 1},
+			{Name: "b", URL: "https://golang.design/b", Weight: 1},
+		},
+		Sticky: true,
+	}
+
+	w := httptest.NewRecorder()
+	v := pickVariant(w, httptest.NewRequest(http.MethodGet, "/s/ab", nil), red)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != v.Name {
+		t.Fatalf("pickVariant want a cookie of variant %s, got %+v", v.Name, cookies)
+	}
+
+	for i := 0; i < 20; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/s/ab", nil)
+		r.AddCookie(cookies[0])
+		if got := pickVariant(httptest.NewRecorder(), r, red); got.Name != v.Name {
+			t.Fatalf("sticky visitor want variant %s, got %s", v.Name, got.Name)
+		}
+	}
+
+	red.Sticky = false
+	w = httptest.NewRecorder()
+	pickVariant(w, httptest.NewRequest(http.MethodGet, "/s/ab", nil), red)
+	if len(w.Result().Cookies()) != 0 {
+		t.Fatalf("non-sticky alias should not set a cookie")
+	}
+}
@@ -0,0 +1,468 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+// The events of webhooks.
+const (
+	eventAliasCreated   = "alias.created"
+	eventAliasUpdated   = "alias.updated"
+	eventAliasDeleted   = "alias.deleted"
+	eventAliasMilestone = "alias.milestone" // an alias reaches a number of visits
+)
+
+// The defaults of webhooks.
+const (
+	webhookDefaultInterval    = 5 * time.Second
+	webhookDefaultTimeout     = 10 * time.Second
+	webhookDefaultMaxAttempts = 10
+	webhookDefaultBackoff     = 30 * time.Second
+	webhookDefaultMaxBackoff  = 6 * time.Hour
+	// webhookBatch is the number of webhooks read from the outbox at once.
+	webhookBatch = 100
+	// webhookMaxError bounds the length of an error in the delivery log.
+	webhookMaxError = 500
+)
+
+// webhookEndpoint receives the webhooks of its events.
+type webhookEndpoint struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"` // signs the payloads
+	Events []string `yaml:"events"` // all events if empty
+}
+
+// webhookConfig configures the webhooks.
+type webhookConfig struct {
+	Endpoints   []webhookEndpoint `yaml:"endpoints"`
+	Milestones  []int64           `yaml:"milestones"` // visits of an alias that fire alias.milestone
+	Interval    time.Duration     `yaml:"interval"`   // between two polls of the outbox
+	Timeout     time.Duration     `yaml:"timeout"`
+	MaxAttempts int               `yaml:"max_attempts"`
+	Backoff     time.Duration     `yaml:"backoff"` // before the first retry, doubled for each retry
+	MaxBackoff  time.Duration     `yaml:"max_backoff"`
+}
+
+func (c *webhookConfig) validate() error {
+	for _, e := range c.Endpoints {
+		u, err := url.Parse(e.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook url: %s", e.URL)
+		}
+		if e.Secret == "" {
+			return fmt.Errorf("webhook %s has no secret", e.URL)
+		}
+		for _, ev := range e.Events {
+			switch ev {
+			case eventAliasCreated, eventAliasUpdated, eventAliasDeleted, eventAliasMilestone:
+			default:
+				return fmt.Errorf("unsupported webhook event: %s", ev)
+			}
+		}
+	}
+	for _, m := range c.Milestones {
+		if m <= 0 {
+			return fmt.Errorf("webhook milestones must be positive, got %d", m)
+		}
+	}
+	sort.Slice(c.Milestones, func(i, j int) bool { return c.Milestones[i] < c.Milestones[j] })
+	if c.Interval < 0 || c.Timeout < 0 || c.MaxAttempts < 0 || c.Backoff < 0 || c.MaxBackoff < 0 {
+		return errors.New("webhook interval, timeout, max_attempts and backoffs must not be negative")
+	}
+	return nil
+}
+
+// webhookEvent is the payload of a webhook.
+type webhookEvent struct {
+	ID        string          `json:"id"` // the same for all endpoints of the event
+	Event     string          `json:"event"`
+	Time      time.Time       `json:"time"`
+	Alias     string          `json:"alias"`
+	Link      string          `json:"link"`                // the short link of the alias
+	Redirect  *model.Redirect `json:"redirect,omitempty"`  // the alias after it is created or updated
+	Milestone int64           `json:"milestone,omitempty"` // the reached milestone
+	PV        int64           `json:"pv,omitempty"`        // the visits of the alias when the milestone is reached
+}
+
+// webhookSignature signs the timestamp and the body of a webhook request,
+// so that a receiver can reject forged and replayed requests.
+func webhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhooks enqueues the webhook events into the outbox of the data store,
+// and delivers the due webhooks of the outbox. The events of the commands
+// are enqueued by their processes and delivered by the server.
+type webhooks struct {
+	db     model.RedirWebhookModel
+	conf   webhookConfig
+	client *http.Client
+	wake   chan struct{} // wakes the dispatcher up after an enqueue
+	done   chan struct{} // closed once the dispatcher stops, nil if not started
+
+	mu      sync.Mutex
+	reached map[string]int64 // the largest reached milestone of each alias
+}
+
+func newWebhooks(db model.RedirWebhookModel, c webhookConfig) *webhooks {
+	if c.Interval == 0 {
+		c.Interval = webhookDefaultInterval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = webhookDefaultTimeout
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = webhookDefaultMaxAttempts
+	}
+	if c.Backoff == 0 {
+		c.Backoff = webhookDefaultBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = webhookDefaultMaxBackoff
+	}
+	return &webhooks{
+		db:   db,
+		conf: c,
+		client: &http.Client{
+			// a redirect would turn the POST into a GET.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		wake:    make(chan struct{}, 1),
+		reached: map[string]int64{},
+	}
+}
+
+// subscribed returns the endpoints of an event.
+func (h *webhooks) subscribed(event string) []webhookEndpoint {
+	eps := []webhookEndpoint{}
+	for _, e := range h.conf.Endpoints {
+		if len(e.Events) == 0 {
+			eps = append(eps, e)
+			continue
+		}
+		for _, ev := range e.Events {
+			if ev == event {
+				eps = append(eps, e)
+				break
+			}
+		}
+	}
+	return eps
+}
+
+// endpoint returns the configured endpoint of a URL.
+func (h *webhooks) endpoint(u string) (webhookEndpoint, bool) {
+	for _, e := range h.conf.Endpoints {
+		if e.URL == u {
+			return e, true
+		}
+	}
+	return webhookEndpoint{}, false
+}
+
+// notify enqueues an event for each of its endpoints.
+func (h *webhooks) notify(ctx context.Context, e *webhookEvent) error {
+	eps := h.subscribed(e.Event)
+	if len(eps) == 0 {
+		return nil
+	}
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return err
+	}
+	e.ID = hex.EncodeToString(id)
+	e.Time = time.Now().UTC()
+	e.Link = conf.Host + conf.S.Prefix + e.Alias
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ws := make([]*model.Webhook, 0, len(eps))
+	for _, ep := range eps {
+		ws = append(ws, &model.Webhook{Event: e.Event, Alias: e.Alias, URL: ep.URL, Payload: string(b)})
+	}
+	err = h.db.EnqueueWebhooks(ctx, ws)
+	if err != nil {
+		return err
+	}
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// aliasChanged notifies the creation, the update or the deletion of an
+// alias. It only logs an error since the change itself succeeded.
+func (h *webhooks) aliasChanged(ctx context.Context, event, alias string, red *model.Redirect) {
+	err := h.notify(ctx, &webhookEvent{Event: event, Alias: alias, Redirect: red})
+	if err != nil {
+		log.Printf("cannot enqueue %s webhooks of alias %s: %v\n", event, alias, err)
+	}
+}
+
+// visited notifies the milestones that are reached by the aliases of the
+// given recorded visits. Only the largest milestone that an alias reaches
+// at once is notified, e.g. if the milestones are configured after it
+// already has many visits, and the visits of bots are not counted.
+func (h *webhooks) visited(ctx context.Context, vs []*model.Visit) error {
+	if len(h.conf.Milestones) == 0 || len(h.subscribed(eventAliasMilestone)) == 0 {
+		return nil
+	}
+	aliases := []string{}
+	seen := map[string]bool{}
+	for _, v := range vs {
+		if !v.Bot && !seen[v.Alias] {
+			seen[v.Alias] = true
+			aliases = append(aliases, v.Alias)
+		}
+	}
+	pvs, err := h.db.CountPV(ctx, aliases, model.Filter{})
+	if err != nil {
+		return err
+	}
+	for _, a := range aliases {
+		pv := pvs[a]
+		h.mu.Lock()
+		last := h.reached[a]
+		if pv < last {
+			// the alias is deleted and created again.
+			last = 0
+		}
+		h.mu.Unlock()
+
+		candidates := []int64{}
+		for _, m := range h.conf.Milestones {
+			if m > last && m <= pv {
+				candidates = append(candidates, m)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		reached, err := h.db.ReachMilestones(ctx, a, candidates)
+		if err != nil {
+			return err
+		}
+		h.mu.Lock()
+		h.reached[a] = candidates[len(candidates)-1]
+		h.mu.Unlock()
+		if len(reached) == 0 {
+			continue
+		}
+		err = h.notify(ctx, &webhookEvent{Event: eventAliasMilestone, Alias: a, Milestone: reached[len(reached)-1], PV: pv})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start delivers the due webhooks in the background until ctx is done.
+func (h *webhooks) start(ctx context.Context) {
+	h.done = make(chan struct{})
+	go h.run(ctx)
+}
+
+func (h *webhooks) run(ctx context.Context) {
+	defer close(h.done)
+	t := time.NewTicker(h.conf.Interval)
+	defer t.Stop()
+	for {
+		h.dispatch(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-h.wake:
+		}
+	}
+}
+
+// wait waits until the dispatcher stops, if it is started.
+func (h *webhooks) wait() {
+	if h.done != nil {
+		<-h.done
+	}
+}
+
+// dispatch delivers the webhooks that are due at the given time.
+func (h *webhooks) dispatch(ctx context.Context, now time.Time) {
+	for {
+		ws, err := h.db.FetchDueWebhooks(ctx, now, webhookBatch)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("cannot fetch due webhooks: %v\n", err)
+			}
+			return
+		}
+		for _, w := range ws {
+			if ctx.Err() != nil {
+				return
+			}
+			h.deliver(ctx, w, now)
+		}
+		// the failed webhooks are due later, thus not fetched again.
+		if len(ws) < webhookBatch {
+			return
+		}
+	}
+}
+
+// deliver attempts to deliver a webhook, and records the attempt. A failed
+// webhook is retried with an exponential backoff until it runs out of
+// attempts.
+func (h *webhooks) deliver(ctx context.Context, w *model.Webhook, now time.Time) {
+	w.Attempts++
+	d := &model.Delivery{Attempt: w.Attempts, CreatedAt: time.Now().UTC()}
+	ep, ok := h.endpoint(w.URL)
+	if !ok {
+		w.State = model.WebhookFailed
+		d.Error = "the endpoint is no longer configured"
+	} else {
+		start := time.Now()
+		status, err := h.post(ctx, ep, w)
+		d.Status, d.Latency = status, time.Since(start).Milliseconds()
+		switch {
+		case err == nil:
+			w.State = model.WebhookDelivered
+		case ctx.Err() != nil:
+			// the server is shutting down, the webhook is attempted
+			// again once it restarts.
+			return
+		default:
+			d.Error = err.Error()
+			if len(d.Error) > webhookMaxError {
+				d.Error = d.Error[:webhookMaxError]
+			}
+			w.State = model.WebhookPending
+			if w.Attempts >= h.conf.MaxAttempts {
+				w.State = model.WebhookFailed
+			}
+			w.NextAt = now.Add(h.backoff(w.Attempts))
+		}
+	}
+	err := h.db.RecordDelivery(ctx, w, d)
+	if err != nil {
+		log.Printf("cannot record delivery of webhook %d: %v\n", w.ID, err)
+	}
+}
+
+// backoff returns the delay before the next attempt of a webhook that
+// failed the given number of attempts.
+func (h *webhooks) backoff(attempts int) time.Duration {
+	d := h.conf.Backoff
+	for i := 1; i < attempts && d < h.conf.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > h.conf.MaxBackoff {
+		d = h.conf.MaxBackoff
+	}
+	return d
+}
+
+// post sends a webhook to its endpoint, and returns the status code of
+// the response. Any status code other than 2xx is an error.
+func (h *webhooks) post(ctx context.Context, ep webhookEndpoint, w *model.Webhook) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.conf.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, strings.NewReader(w.Payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "redir-webhook")
+	req.Header.Set("X-Redir-Event", w.Event)
+	req.Header.Set("X-Redir-Delivery", strconv.FormatInt(w.ID, 10))
+	req.Header.Set("X-Redir-Timestamp", ts)
+	req.Header.Set("X-Redir-Signature", "sha256="+webhookSignature([]byte(ep.Secret), ts, []byte(w.Payload)))
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// drain the response so that the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookWriter writes visits to the data store, and notifies the visit
+// milestones that they reach.
+type webhookWriter struct {
+	visitWriter
+	hooks *webhooks
+}
+
+func (w *webhookWriter) RecordVisits(ctx context.Context, vs []*model.Visit) error {
+	err := w.visitWriter.RecordVisits(ctx, vs)
+	if err != nil {
+		return err
+	}
+	// the visits are recorded even if their milestones cannot be checked.
+	if err := w.hooks.visited(ctx, vs); err != nil {
+		log.Printf("cannot check visit milestones: %v\n", err)
+	}
+	return nil
+}
+
+// webhooksCmd prints the latest attempts of the webhook deliveries.
+func webhooksCmd(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("cannot fetch webhook deliveries: %w", err)
+		}
+	}()
+
+	s, err := model.NewDB(conf.Store)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+
+	ds, err := s.FetchDeliveries(ctx, 50)
+	if err != nil {
+		return
+	}
+	for _, d := range ds {
+		state := "ok"
+		if d.Error != "" {
+			state = "failed"
+		}
+		fmt.Printf("%s %-6s %3d %6dms #%d/%d %-15s %s %s %s\n",
+			d.CreatedAt.UTC().Format(time.RFC3339), state, d.Status, d.Latency,
+			d.WebhookID, d.Attempt, d.Event, d.Alias, d.URL, d.Error)
+	}
+	return nil
+}
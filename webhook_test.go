@@ -0,0 +1,218 @@
+// Copyright 2021 The golang.design Initiative Authors.
+// All rights reserved. Use of this source code is governed
+// by a MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.design/x/redir/internal/model"
+)
+
+// receiver is a webhook endpoint that fails the first given number of
+// requests.
+type receiver struct {
+	mu   sync.Mutex
+	fail int
+	reqs []*receivedHook
+}
+
+type receivedHook struct {
+	header http.Header
+	body   []byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.reqs = append(rc.reqs, &receivedHook{header: r.Header, body: b})
+	if rc.fail > 0 {
+		rc.fail--
+		http.Error(w, "try again later", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rc *receiver) received() []*receivedHook {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]*receivedHook(nil), rc.reqs...)
+}
+
+func TestWebhookConfig(t *testing.T) {
+	for _, c := range []webhookConfig{
+		{Endpoints: []webhookEndpoint{{URL: "ftp://example.com", Secret: "s"}}},
+		{Endpoints: []webhookEndpoint{{URL: "https://example.com"}}},
+		{Endpoints: []webhookEndpoint{{URL: "https://example.com", Secret: "s", Events: []string{"alias.renamed"}}}},
+		{Milestones: []int64{0}},
+		{Backoff: -time.Second},
+	} {
+		if err := c.validate(); err == nil {
+			t.Fatalf("invalid webhook config %+v is accepted", c)
+		}
+	}
+	c := webhookConfig{Milestones: []int64{100, 10}}
+	if err := c.validate(); err != nil || c.Milestones[0] != 10 {
+		t.Fatalf("valid webhook config want sorted milestones, got %v, %v", c.Milestones, err)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	h := newWebhooks(nil, webhookConfig{Backoff: time.Second, MaxBackoff: 10 * time.Second})
+	for attempts, want := range map[int]time.Duration{
+		1:   time.Second,
+		2:   2 * time.Second,
+		4:   8 * time.Second,
+		5:   10 * time.Second,
+		100: 10 * time.Second,
+	} {
+		if got := h.backoff(attempts); got != want {
+			t.Fatalf("backoff after %d attempts want %v, got %v", attempts, want, got)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	conf.parse()
+	db, err := model.NewDB(conf.Store)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	rc := &receiver{fail: 1}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	h := newWebhooks(db, webhookConfig{
+		Endpoints: []webhookEndpoint{{URL: ts.URL, Secret: "secret", Events: []string{eventAliasCreated}}},
+		Backoff:   time.Minute,
+	})
+
+	// the events without endpoints are not enqueued.
+	h.aliasChanged(ctx, eventAliasDeleted, "hook", nil)
+	h.aliasChanged(ctx, eventAliasCreated, "hook", &model.Redirect{Alias: "hook", URL: "https://example.com", Password: "hash"})
+
+	now := time.Now()
+	h.dispatch(ctx, now)
+	if n := len(rc.received()); n != 1 {
+		t.Fatalf("webhooks want 1 attempt, got %d", n)
+	}
+	// the failed webhook is retried after the backoff.
+	h.dispatch(ctx, now.Add(time.Minute-time.Second))
+	if n := len(rc.received()); n != 1 {
+		t.Fatalf("webhooks are retried before the backoff, got %d attempts", n)
+	}
+	h.dispatch(ctx, now.Add(time.Minute))
+	reqs := rc.received()
+	if len(reqs) != 2 {
+		t.Fatalf("webhooks want 2 attempts, got %d", len(reqs))
+	}
+	h.dispatch(ctx, now.Add(time.Hour))
+	if n := len(rc.received()); n != 2 {
+		t.Fatalf("delivered webhooks are delivered again, got %d attempts", n)
+	}
+
+	for _, r := range reqs {
+		ts := r.header.Get("X-Redir-Timestamp")
+		if r.header.Get("X-Redir-Signature") != "sha256="+webhookSignature([]byte("secret"), ts, r.body) {
+			t.Fatalf("webhook has a wrong signature: %v", r.header)
+		}
+		if r.header.Get("X-Redir-Event") != eventAliasCreated || r.header.Get("Content-Type") != "application/json" {
+			t.Fatalf("webhook has wrong headers: %v", r.header)
+		}
+	}
+	e := struct {
+		webhookEvent
+		Redirect map[string]interface{} `json:"redirect"`
+	}{}
+	if err := json.Unmarshal(reqs[1].body, &e); err != nil {
+		t.Fatalf("webhook has an invalid payload %s: %v", reqs[1].body, err)
+	}
+	if e.ID == "" || e.Event != eventAliasCreated || e.Alias != "hook" || e.Redirect["url"] != "https://example.com" {
+		t.Fatalf("webhook has a wrong payload: %s", reqs[1].body)
+	}
+	if _, ok := e.Redirect["password"]; ok {
+		t.Fatalf("webhook payload contains the password: %s", reqs[1].body)
+	}
+	if string(reqs[0].body) != string(reqs[1].body) {
+		t.Fatalf("retried webhook has a different payload: %s, %s", reqs[0].body, reqs[1].body)
+	}
+
+	id, _ := strconv.ParseInt(reqs[0].header.Get("X-Redir-Delivery"), 10, 64)
+	ds, err := db.FetchDeliveries(ctx, 1000)
+	if err != nil {
+		t.Fatalf("FetchDeliveries with err: %v", err)
+	}
+	statuses := []int{}
+	for _, d := range ds {
+		if d.WebhookID == id {
+			statuses = append(statuses, d.Status)
+		}
+	}
+	if len(statuses) != 2 || statuses[0] != http.StatusNoContent || statuses[1] != http.StatusInternalServerError {
+		t.Fatalf("delivery log want 204 after 500, got %v", statuses)
+	}
+}
+
+func TestWebhookMilestones(t *testing.T) {
+	conf.parse()
+	db, err := model.NewDB(conf.Store)
+	if err != nil {
+		t.Fatalf("NewDB with err: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	rc := &receiver{}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	h := newWebhooks(db, webhookConfig{
+		Endpoints:  []webhookEndpoint{{URL: ts.URL, Secret: "secret"}},
+		Milestones: []int64{2, 3, 10},
+	})
+	w := &webhookWriter{db, h}
+	defer db.DeleteAlias(ctx, "hookmilestone")
+
+	now := time.Now().UTC()
+	record := func(vs ...*model.Visit) {
+		for _, v := range vs {
+			v.Alias, v.Time = "hookmilestone", now
+		}
+		if err := w.RecordVisits(ctx, vs); err != nil {
+			t.Fatalf("RecordVisits with err: %v", err)
+		}
+		h.dispatch(ctx, time.Now())
+	}
+
+	// the visits of bots are not counted.
+	record(&model.Visit{IP: "1.1.1.1"}, &model.Visit{IP: "1.1.1.2", UA: "Googlebot/2.1", Bot: true})
+	if n := len(rc.received()); n != 0 {
+		t.Fatalf("webhooks want no milestone, got %d", n)
+	}
+	// only the largest milestone that is reached at once is notified.
+	record(&model.Visit{IP: "1.1.1.3"}, &model.Visit{IP: "1.1.1.4"})
+	record(&model.Visit{IP: "1.1.1.5"})
+	reqs := rc.received()
+	if len(reqs) != 1 {
+		t.Fatalf("webhooks want 1 milestone, got %d", len(reqs))
+	}
+	e := webhookEvent{}
+	if err := json.Unmarshal(reqs[0].body, &e); err != nil {
+		t.Fatalf("webhook has an invalid payload %s: %v", reqs[0].body, err)
+	}
+	if e.Event != eventAliasMilestone || e.Alias != "hookmilestone" || e.Milestone != 3 || e.PV != 3 {
+		t.Fatalf("webhook has a wrong milestone: %s", reqs[0].body)
+	}
+}